@@ -20,8 +20,21 @@
 package main
 
 import (
+	"context"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/openpgp"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/asserts"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cache"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
@@ -29,26 +42,183 @@ import (
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/runner"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/si"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
-	"github.com/ubuntu-core/snappy/store"
 )
 
 func main() {
+	if err := run(); err != nil {
+		log.Fatal(err.Error())
+	}
+}
+
+// run builds the clients from the flags and runs the action, the CA bundle and
+// the build host are cleaned up whatever the outcome
+func run() error {
 	parsedFlags := flags.Parse()
 
 	setLogLevel(parsedFlags.LogLevel)
 
-	cliExecutor := &cli.Executor{}
-	httpClient := &web.Client{}
-	repo := store.NewUbuntuStoreSnapRepository(nil, "")
+	transportConfig := &web.TransportConfig{
+		Proxy:              parsedFlags.HTTPProxy,
+		ClientCert:         parsedFlags.HTTPClientCert,
+		ClientKey:          parsedFlags.HTTPClientKey,
+		InsecureSkipVerify: parsedFlags.HTTPInsecure,
+		ConnectTimeout:     time.Duration(parsedFlags.HTTPConnectTimeout) * time.Second,
+	}
+	if parsedFlags.HTTPCACerts != "" {
+		transportConfig.CAFiles = strings.Split(parsedFlags.HTTPCACerts, ",")
+	}
+	transport, err := web.NewTransport(transportConfig)
+	if err != nil {
+		return err
+	}
+	// the openstack client trusts the same certificates as the tool
+	var caBundle string
+	if len(transportConfig.CAFiles) > 0 {
+		caBundle, err = writeCABundle(transportConfig)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(caBundle)
+	}
 
-	imgDataOrigin := si.NewClient(httpClient)
-	imgDataTarget := cloud.NewClient(cliExecutor)
-	imgDriver := image.NewUDFQcow2(cliExecutor, repo)
+	var buildExecutor, cloudExecutor cli.Commander
+	buildExecutor = &cli.Executor{Timeout: time.Duration(parsedFlags.BuildTimeout) * time.Second}
+	var buildHost *cli.SSHExecutor
+	if parsedFlags.BuildHost != "" {
+		// the snaps are downloaded to the workspace or come from the snap cache,
+		// and the image is built in the workspace
+		mirror := []string{os.TempDir()}
+		for _, dir := range []string{parsedFlags.WorkspaceRoot, parsedFlags.SnapCacheDir} {
+			if dir != "" {
+				mirror = append(mirror, dir)
+			}
+		}
+		buildHost, err = cli.NewSSHExecutor(&cli.SSHConfig{
+			Host:        parsedFlags.BuildHost,
+			KeyFile:     parsedFlags.BuildHostKey,
+			HostKeyFile: parsedFlags.BuildHostPubkey,
+			Dir:         parsedFlags.BuildHostDir,
+			Mirror:      mirror,
+			Artifacts:   image.Artifacts,
+			Timeout:     time.Duration(parsedFlags.BuildTimeout) * time.Second,
+		})
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := buildHost.Close(); err != nil {
+				log.Warnf("Could not clean up the build host: %v", err)
+			}
+		}()
+		buildExecutor = buildHost
+	}
+	cloudExecutor = &cli.Executor{
+		Timeout: time.Duration(parsedFlags.CloudTimeout) * time.Second,
+		Env:     transportConfig.CommandEnv(caBundle),
+	}
+	if parsedFlags.RecordCommands != "" {
+		if err := os.MkdirAll(parsedFlags.RecordCommands, 0755); err != nil {
+			return err
+		}
+		buildExecutor = cli.NewRecorder(buildExecutor, filepath.Join(parsedFlags.RecordCommands, "build.json"))
+		cloudExecutor = cli.NewRecorder(cloudExecutor, filepath.Join(parsedFlags.RecordCommands, "cloud.json"))
+	}
+	httpConfig := web.DefaultConfig()
+	httpConfig.ConnectTimeout = transportConfig.ConnectTimeout
+	httpConfig.Transport = transport
+	httpConfig.ReadTimeout = time.Duration(parsedFlags.HTTPReadTimeout) * time.Second
+	httpConfig.Retries = parsedFlags.HTTPRetries
+	httpConfig.CacheDir = parsedFlags.HTTPCacheDir
+	httpConfig.CacheMaxAge = time.Duration(parsedFlags.HTTPCacheMaxAge) * time.Second
+	httpConfig.BypassCache = parsedFlags.HTTPNoCache
+	httpClient := web.NewClient(httpConfig)
+	// the store only knows the canonical names of the architectures
+	profile, err := arch.Get(parsedFlags.Arch)
+	if err != nil {
+		return err
+	}
+	storeConfig := *httpConfig
+	storeConfig.Header = image.StoreHeader(profile.Name)
+	repo := image.NewSnapStore(web.NewClient(&storeConfig))
 
-	runner := runner.NewRunner(imgDataOrigin, imgDataTarget, imgDriver)
-	if err := runner.Exec(parsedFlags); err != nil {
-		log.Fatal(err.Error())
+	var siKeyring openpgp.EntityList
+	if parsedFlags.SIKeyring != "" {
+		siKeyring, err = si.ReadKeyring(strings.Split(parsedFlags.SIKeyring, ",")...)
+		if err != nil {
+			return err
+		}
 	}
+
+	var siServers []string
+	if parsedFlags.SIServer != "" {
+		siServers = strings.Split(parsedFlags.SIServer, ",")
+	}
+	imgDataOrigin := si.NewClient(httpClient, siKeyring, &si.Config{
+		Servers:       siServers,
+		DevicePattern: parsedFlags.SIDevicePattern,
+		HTTPS:         parsedFlags.SIHTTPS,
+		Insecure:      parsedFlags.SIInsecure,
+	})
+	imgDataTarget := cloud.NewClient(cloudExecutor)
+	var trustedKeys []*asserts.AccountKey
+	if parsedFlags.AssertTrustedKeys != "" {
+		trustedKeys, err = asserts.ReadTrustedKeys(strings.Split(parsedFlags.AssertTrustedKeys, ",")...)
+		if err != nil {
+			return err
+		}
+	}
+	verifier := asserts.NewClient(httpClient, trustedKeys, parsedFlags.AssertInsecure)
+
+	var imgDriver *image.UDFQcow2
+	var snapCache runner.SnapCache
+	if parsedFlags.SnapCacheDir == "" {
+		imgDriver = image.NewUDFQcow2(buildExecutor, repo, verifier)
+	} else {
+		localCache, err := cache.New(parsedFlags.SnapCacheDir, parsedFlags.SnapCacheSize*1024*1024)
+		if err != nil {
+			return err
+		}
+		imgDriver = image.NewUDFQcow2(buildExecutor, cache.NewStore(repo, localCache), verifier)
+		snapCache = localCache
+	}
+	// ubuntu-device-flash downloads the snaps it isn't given through the proxy
+	imgDriver.Env = transportConfig.CommandEnv("")
+
+	// the workspace is checked and cleaned up where the image is built
+	runner := runner.NewRunner(imgDataOrigin, imgDataTarget, imgDriver, snapCache, buildExecutor, buildHost != nil)
+	return runner.Exec(signalContext(), parsedFlags)
+}
+
+// writeCABundle writes the system certificates and the CA files of config to a
+// temporary file and returns its path
+func writeCABundle(config *web.TransportConfig) (string, error) {
+	file, err := ioutil.TempFile("", "snappy-cloud-image-ca")
+	if err != nil {
+		return "", err
+	}
+	file.Close()
+	if err = config.WriteCABundle(file.Name()); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// signalContext returns a context that is cancelled on SIGINT or SIGTERM, so
+// that the running commands are killed and the runner returns, cleaning up the
+// workspace on its way out. A second signal terminates the process straight
+// away
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		signal.Stop(signals)
+		log.Warnf("Received %s, stopping", sig)
+		cancel()
+	}()
+	return ctx
 }
 
 func setLogLevel(lvl string) {
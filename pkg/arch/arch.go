@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package arch holds the details that change between the supported
+// architectures, adding a new one only requires a new profile here
+package arch
+
+import (
+	"fmt"
+	"sort"
+)
+
+const errUnknownFmt = "Unknown architecture %s, supported ones are %v"
+
+// Profile describes how to build and publish the images of an architecture
+type Profile struct {
+	// Name is the canonical name of the architecture, used in the image names
+	Name string
+	// Aliases are other names accepted for the architecture
+	Aliases []string
+	// SIDevice is the device name of the architecture in the system-image server
+	SIDevice string
+	// Gadget and Kernel are the default snaps of the architecture
+	Gadget, Kernel string
+	// QemuMachine is the machine type the image boots on
+	QemuMachine string
+	// CloudArch is the value of the architecture property of the cloud image
+	CloudArch string
+	// OEM is the oem snap of the board of the architecture, passed to
+	// ubuntu-device-flash on every release
+	OEM string
+}
+
+var profiles = []*Profile{
+	{
+		Name:        "amd64",
+		SIDevice:    "generic_amd64",
+		Gadget:      "canonical-pc",
+		Kernel:      "canonical-pc-linux",
+		QemuMachine: "pc",
+		CloudArch:   "x86_64",
+	},
+	{
+		Name:        "i386",
+		SIDevice:    "generic_i386",
+		Gadget:      "canonical-i386",
+		Kernel:      "canonical-pc-linux",
+		QemuMachine: "pc",
+		CloudArch:   "i686",
+	},
+	{
+		Name:        "armhf",
+		Aliases:     []string{"arm"},
+		SIDevice:    "generic_armhf",
+		Gadget:      "bbb",
+		Kernel:      "linux-generic-bbb",
+		QemuMachine: "virt",
+		CloudArch:   "armv7l",
+		OEM:         "beagleblack",
+	},
+	{
+		Name:        "arm64",
+		SIDevice:    "generic_arm64",
+		Gadget:      "canonical-dragon",
+		Kernel:      "canonical-snapdragon-linux",
+		QemuMachine: "virt",
+		CloudArch:   "aarch64",
+	},
+}
+
+// ErrUnknown is the error returned when there is no profile for the given
+// architecture
+type ErrUnknown struct {
+	name string
+}
+
+func (e *ErrUnknown) Error() string {
+	return fmt.Sprintf(errUnknownFmt, e.name, Names())
+}
+
+// Get returns the profile of the architecture with the given name or alias
+func Get(name string) (*Profile, error) {
+	for _, profile := range profiles {
+		if profile.Name == name {
+			return profile, nil
+		}
+		for _, alias := range profile.Aliases {
+			if alias == name {
+				return profile, nil
+			}
+		}
+	}
+	return nil, &ErrUnknown{name: name}
+}
+
+// Names returns the sorted canonical names of the supported architectures
+func Names() (names []string) {
+	for _, profile := range profiles {
+		names = append(names, profile.Name)
+	}
+	sort.Strings(names)
+	return
+}
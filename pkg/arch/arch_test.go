@@ -0,0 +1,87 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package arch
+
+import (
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&archSuite{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type archSuite struct{}
+
+func (s *archSuite) TestGetReturnsProfileByName(c *check.C) {
+	testCases := []struct {
+		name, siDevice, cloudArch string
+	}{
+		{"amd64", "generic_amd64", "x86_64"},
+		{"i386", "generic_i386", "i686"},
+		{"armhf", "generic_armhf", "armv7l"},
+		{"arm64", "generic_arm64", "aarch64"},
+	}
+	for _, item := range testCases {
+		profile, err := Get(item.name)
+
+		c.Assert(err, check.IsNil)
+		c.Check(profile.Name, check.Equals, item.name)
+		c.Check(profile.SIDevice, check.Equals, item.siDevice)
+		c.Check(profile.CloudArch, check.Equals, item.cloudArch)
+	}
+}
+
+func (s *archSuite) TestGetReturnsProfileByAlias(c *check.C) {
+	profile, err := Get("arm")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(profile.Name, check.Equals, "armhf")
+}
+
+func (s *archSuite) TestGetReturnsErrUnknown(c *check.C) {
+	_, err := Get("myarch")
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnknown{})
+	c.Assert(err.Error(), check.Equals,
+		"Unknown architecture myarch, supported ones are [amd64 arm64 armhf i386]")
+}
+
+func (s *archSuite) TestArmhfProfileTargetsOneBoard(c *check.C) {
+	profile, err := Get("armhf")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(profile.Gadget, check.Equals, "bbb")
+	c.Assert(profile.Kernel, check.Equals, "linux-generic-bbb")
+	c.Assert(profile.QemuMachine, check.Equals, "virt")
+	c.Assert(profile.OEM, check.Equals, "beagleblack")
+}
+
+func (s *archSuite) TestProfilesHaveDefaultSnaps(c *check.C) {
+	for _, name := range Names() {
+		profile, err := Get(name)
+
+		c.Assert(err, check.IsNil)
+		c.Check(profile.Gadget, check.Not(check.Equals), "")
+		c.Check(profile.Kernel, check.Not(check.Equals), "")
+		c.Check(profile.QemuMachine, check.Not(check.Equals), "")
+	}
+}
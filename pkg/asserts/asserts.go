@@ -0,0 +1,297 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package asserts retrieves the store assertions of the snaps and checks
+// the downloaded files against them
+package asserts
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/sha3"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	baseURL             = "https://assertions.ubuntu.com/v1/assertions"
+	series              = "16"
+	storeAuthority      = "canonical"
+	snapRevisionType    = "snap-revision"
+	snapDeclarationType = "snap-declaration"
+	errDecodeFmt        = "Could not decode assertion: %s"
+	errMismatchFmt      = "%s assertion mismatch on %s, expected %s, got %s"
+)
+
+// Assertion holds the headers, the body and the signature of a store assertion
+type Assertion struct {
+	headers   map[string]string
+	body      []byte
+	signature []byte
+	// content is the signed part of the assertion, the headers and the body
+	content []byte
+}
+
+// Header returns the value of the given header, empty if not present
+func (a *Assertion) Header(name string) string {
+	return a.headers[name]
+}
+
+// ErrDecode is the error returned when the content retrieved is not a
+// valid assertion
+type ErrDecode struct {
+	msg string
+}
+
+func (e *ErrDecode) Error() string {
+	return fmt.Sprintf(errDecodeFmt, e.msg)
+}
+
+// ErrMismatch is the error returned when a snap doesn't match the
+// details in one of its assertions
+type ErrMismatch struct {
+	assertType, header, expected, actual string
+}
+
+func (e *ErrMismatch) Error() string {
+	return fmt.Sprintf(errMismatchFmt, e.assertType, e.header, e.expected, e.actual)
+}
+
+// Client is the default snap verifier, it gets the assertions from the
+// store assertions service. Their signatures are checked against the account
+// keys of the store, which must be signed by one of the trusted keys
+type Client struct {
+	httpClient web.ContextGetter
+	trusted    map[string]*AccountKey
+	insecure   bool
+
+	mu sync.Mutex
+	// keys are the account keys already fetched and checked
+	keys map[string]*AccountKey
+}
+
+// NewClient is the Client constructor. When insecure is set the signatures of
+// the assertions are not checked, otherwise the checks fail without trusted keys
+func NewClient(httpClient web.ContextGetter, trusted []*AccountKey, insecure bool) *Client {
+	c := &Client{httpClient: httpClient, trusted: make(map[string]*AccountKey), insecure: insecure,
+		keys: make(map[string]*AccountKey)}
+	for _, key := range trusted {
+		c.trusted[key.ID()] = key
+	}
+	return c
+}
+
+// Verify checks the snap file in path against its snap-revision and snap-declaration
+// assertions, which must be signed by the store: the sha3-384 digest, size and
+// revision must match the former, and the latter must declare the given name and
+// the same publisher as the developer of the revision. A revision of 0 is not checked.
+// The requests for the assertions are abandoned when ctx is done
+func (c *Client) Verify(ctx context.Context, name string, revision int, path string) (err error) {
+	if c.insecure {
+		log.Warnf("The signatures of the assertions of %s are not checked", name)
+	}
+	digest, size, err := fileDigest(path)
+	if err != nil {
+		return
+	}
+	log.Debugf("Verifying %s with sha3-384 %s", name, digest)
+
+	snapRevision, err := c.get(ctx, snapRevisionType, digest)
+	if err != nil {
+		return
+	}
+	if err = checkHeader(snapRevision, snapRevisionType, "snap-sha3-384", digest); err != nil {
+		return
+	}
+	if err = checkHeader(snapRevision, snapRevisionType, "snap-size", strconv.FormatInt(size, 10)); err != nil {
+		return
+	}
+	if revision != 0 {
+		if err = checkHeader(snapRevision, snapRevisionType, "snap-revision", strconv.Itoa(revision)); err != nil {
+			return
+		}
+	}
+
+	snapDeclaration, err := c.get(ctx, snapDeclarationType, series, snapRevision.Header("snap-id"))
+	if err != nil {
+		return
+	}
+	if err = checkHeader(snapDeclaration, snapDeclarationType, "snap-name", name); err != nil {
+		return
+	}
+	return checkHeader(snapDeclaration, snapDeclarationType, "publisher-id", snapRevision.Header("developer-id"))
+}
+
+// get returns the assertion of the store with the given type and key, after
+// checking its signature
+func (c *Client) get(ctx context.Context, assertType string, primaryKey ...string) (*Assertion, error) {
+	assertion, err := c.fetch(ctx, assertType, primaryKey...)
+	if err != nil {
+		return nil, err
+	}
+	if err = checkHeader(assertion, assertType, "authority-id", storeAuthority); err != nil {
+		return nil, err
+	}
+	if c.insecure {
+		return assertion, nil
+	}
+	key, err := c.accountKey(ctx, assertType, assertion.Header("sign-key-sha3-384"))
+	if err != nil {
+		return nil, err
+	}
+	return assertion, key.verify(assertion)
+}
+
+// accountKey returns the key with the given id, either a trusted one or an
+// account key of the store signed by a trusted one
+func (c *Client) accountKey(ctx context.Context, assertType, id string) (*AccountKey, error) {
+	if len(c.trusted) == 0 {
+		return nil, &ErrSignature{assertType: assertType, msg: errNoTrustedKeys}
+	}
+	if key, ok := c.trusted[id]; ok {
+		return key, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if key, ok := c.keys[id]; ok {
+		return key, nil
+	}
+	assertion, err := c.fetch(ctx, accountKeyType, id)
+	if err != nil {
+		return nil, err
+	}
+	key, err := newAccountKey(assertion)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := c.trusted[assertion.Header("sign-key-sha3-384")]
+	if !ok {
+		return nil, &ErrSignature{assertType: accountKeyType, msg: "not signed by a trusted key"}
+	}
+	if err = signer.verify(assertion); err != nil {
+		return nil, err
+	}
+	c.keys[id] = key
+	return key, nil
+}
+
+func (c *Client) fetch(ctx context.Context, assertType string, primaryKey ...string) (*Assertion, error) {
+	url := strings.Join(append([]string{baseURL, assertType}, primaryKey...), "/")
+	content, err := c.httpClient.GetContext(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	assertion, err := Decode(content)
+	if err != nil {
+		return nil, err
+	}
+	if assertion.Header("type") != assertType {
+		return nil, &ErrMismatch{assertType: assertType, header: "type", expected: assertType, actual: assertion.Header("type")}
+	}
+	return assertion, nil
+}
+
+// Decode parses the given assertion, made of the headers, the body if its
+// body-length header is not 0 and the signature, separated by blank lines
+func Decode(content []byte) (*Assertion, error) {
+	headersEnd := bytes.Index(content, []byte("\n\n"))
+	if headersEnd < 0 {
+		return nil, &ErrDecode{msg: "missing signature"}
+	}
+	headers, err := decodeHeaders(content[:headersEnd])
+	if err != nil {
+		return nil, err
+	}
+	a := &Assertion{headers: headers, content: content[:headersEnd]}
+	rest := content[headersEnd+2:]
+	if length := headers["body-length"]; length != "" && length != "0" {
+		n, err := strconv.Atoi(length)
+		if err != nil || n < 0 || len(rest) < n+2 || string(rest[n:n+2]) != "\n\n" {
+			return nil, &ErrDecode{msg: "invalid body-length " + length}
+		}
+		a.body = rest[:n]
+		a.content = content[:headersEnd+2+n]
+		rest = rest[n+2:]
+	}
+	a.signature = bytes.TrimSpace(rest)
+	if len(a.signature) == 0 {
+		return nil, &ErrDecode{msg: "missing signature"}
+	}
+	return a, nil
+}
+
+func decodeHeaders(content []byte) (map[string]string, error) {
+	headers := make(map[string]string)
+	var last string
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			break
+		}
+		if strings.HasPrefix(line, " ") && last != "" {
+			headers[last] += "\n" + strings.TrimSpace(line)
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return nil, &ErrDecode{msg: "invalid header line " + line}
+		}
+		last = parts[0]
+		headers[last] = strings.TrimSpace(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if headers["type"] == "" {
+		return nil, &ErrDecode{msg: "missing type header"}
+	}
+	return headers, nil
+}
+
+func checkHeader(assertion *Assertion, assertType, header, expected string) error {
+	if actual := assertion.Header(header); actual != expected {
+		return &ErrMismatch{assertType: assertType, header: header, expected: expected, actual: actual}
+	}
+	return nil
+}
+
+func fileDigest(path string) (digest string, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha3.New384()
+	if size, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return base64.RawURLEncoding.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,390 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/sha3"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	testName        = "mykernel"
+	testRevision    = 23
+	testSnapID      = "mysnapid"
+	testPublisherID = "mypublisherid"
+	testContent     = "this is the snap content"
+	revisionBase    = `type: snap-revision
+authority-id: canonical
+snap-sha3-384: %s
+developer-id: %s
+snap-id: %s
+snap-revision: %d
+snap-size: %d
+timestamp: 2016-04-13T07:43:00Z`
+	declarationBase = `type: snap-declaration
+authority-id: canonical
+series: 16
+snap-id: %s
+snap-name: %s
+publisher-id: %s
+timestamp: 2016-04-13T07:43:00Z`
+	accountKeyBase = `type: account-key
+authority-id: %s
+account-id: %s
+public-key-sha3-384: %s
+since: 2016-01-01T00:00:00Z%s
+body-length: %d
+sign-key-sha3-384: %s
+
+%s`
+)
+
+var _ = check.Suite(&assertsSuite{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type assertsSuite struct {
+	subject   *Client
+	webGetter *fakeWebGetter
+	snapPath  string
+	digest    string
+	rootKey   *testKey
+	storeKey  *testKey
+	otherKey  *testKey
+	trusted   []*AccountKey
+}
+
+// testKey is an OpenPGP key signing the assertions of the tests
+type testKey struct {
+	entity *openpgp.Entity
+	id     string
+	pubKey string
+}
+
+func newTestKey(c *check.C) *testKey {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", &packet.Config{RSABits: 1024})
+	c.Assert(err, check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(entity.PrimaryKey.Serialize(&buf), check.IsNil)
+	digest := sha3.Sum384(buf.Bytes())
+	return &testKey{entity: entity, id: base64.RawURLEncoding.EncodeToString(digest[:]),
+		pubKey: base64.StdEncoding.EncodeToString(buf.Bytes())}
+}
+
+// sign returns the assertion with the given headers signed by the key
+func (k *testKey) sign(c *check.C, headers string) string {
+	content := headers + "\nsign-key-sha3-384: " + k.id
+	if n := strings.Index(headers, "\n\n"); n >= 0 {
+		content = headers[:n] + "\nsign-key-sha3-384: " + k.id + headers[n:]
+	}
+	sig := &packet.Signature{SigType: packet.SigTypeBinary, PubKeyAlgo: k.entity.PrivateKey.PubKeyAlgo,
+		Hash: crypto.SHA512, CreationTime: time.Now(), IssuerKeyId: &k.entity.PrivateKey.KeyId}
+	hash := crypto.SHA512.New()
+	hash.Write([]byte(content))
+	c.Assert(sig.Sign(hash, k.entity.PrivateKey, nil), check.IsNil)
+	var buf bytes.Buffer
+	c.Assert(sig.Serialize(&buf), check.IsNil)
+	return content + "\n\n" + base64.StdEncoding.EncodeToString(buf.Bytes())
+}
+
+// accountKey returns the account-key assertion of the key for account signed
+// by signer, extra are more headers
+func (k *testKey) accountKey(c *check.C, signer *testKey, account, extra string) string {
+	headers := fmt.Sprintf(accountKeyBase, "canonical", account, k.id, extra, len(k.pubKey), signer.id, k.pubKey)
+	// the signing key is set by sign
+	headers = strings.Replace(headers, "\nsign-key-sha3-384: "+signer.id, "", 1)
+	return signer.sign(c, headers)
+}
+
+type fakeWebGetter struct {
+	calls   map[string]int
+	outputs map[string]string
+	error   bool
+	ctx     context.Context
+}
+
+func (w *fakeWebGetter) Get(url string) (output []byte, err error) {
+	return w.GetContext(context.Background(), url)
+}
+
+func (w *fakeWebGetter) GetContext(ctx context.Context, url string) (output []byte, err error) {
+	w.ctx = ctx
+	w.calls[url]++
+	if w.error {
+		err = &web.ErrHTTPGet{}
+	}
+	return []byte(w.outputs[url]), err
+}
+
+func (s *assertsSuite) SetUpSuite(c *check.C) {
+	s.rootKey, s.storeKey, s.otherKey = newTestKey(c), newTestKey(c), newTestKey(c)
+	trustedPath := filepath.Join(c.MkDir(), "root.account-key")
+	c.Assert(ioutil.WriteFile(trustedPath, []byte(s.rootKey.accountKey(c, s.rootKey, "canonical", "")), 0644), check.IsNil)
+	var err error
+	s.trusted, err = ReadTrustedKeys(trustedPath)
+	c.Assert(err, check.IsNil)
+
+	s.webGetter = &fakeWebGetter{}
+	s.digest = testDigest(testContent)
+}
+
+func (s *assertsSuite) SetUpTest(c *check.C) {
+	s.snapPath = filepath.Join(c.MkDir(), "snap")
+	c.Assert(ioutil.WriteFile(s.snapPath, []byte(testContent), 0644), check.IsNil)
+
+	s.webGetter.calls = make(map[string]int)
+	s.subject = NewClient(s.webGetter, s.trusted, false)
+	s.webGetter.error = false
+	s.webGetter.outputs = map[string]string{
+		revisionURL(s.digest): s.storeKey.sign(c, fmt.Sprintf(revisionBase,
+			s.digest, testPublisherID, testSnapID, testRevision, len(testContent))),
+		declarationURL(testSnapID): s.storeKey.sign(c, fmt.Sprintf(declarationBase,
+			testSnapID, testName, testPublisherID)),
+		accountKeyURL(s.storeKey.id): s.storeKey.accountKey(c, s.rootKey, "canonical", ""),
+	}
+}
+
+func (s *assertsSuite) TestVerifyAcceptsMatchingSnap(c *check.C) {
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls[revisionURL(s.digest)], check.Equals, 1)
+	c.Assert(s.webGetter.calls[declarationURL(testSnapID)], check.Equals, 1)
+}
+
+func (s *assertsSuite) TestVerifyPassesContextToWebClient(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := s.subject.Verify(ctx, testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.ctx, check.Equals, ctx)
+}
+
+func (s *assertsSuite) TestVerifyReturnsWebError(c *check.C) {
+	s.webGetter.error = true
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &web.ErrHTTPGet{})
+}
+
+func (s *assertsSuite) TestVerifyReturnsDecodeErrorOnMissingAssertion(c *check.C) {
+	s.webGetter.outputs[revisionURL(s.digest)] = `{"status": 404, "title": "not found"}`
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrDecode{})
+}
+
+func (s *assertsSuite) TestVerifyChecksRevisionAssertion(c *check.C) {
+	testCases := []struct {
+		revision, size   int
+		digest, header   string
+		verifiedRevision int
+	}{
+		{testRevision, len(testContent) + 1, s.digest, "snap-size", testRevision},
+		{testRevision + 1, len(testContent), s.digest, "snap-revision", testRevision},
+		{testRevision, len(testContent), testDigest("another"), "snap-sha3-384", testRevision},
+	}
+	for _, item := range testCases {
+		s.webGetter.outputs[revisionURL(s.digest)] = s.storeKey.sign(c, fmt.Sprintf(revisionBase,
+			item.digest, testPublisherID, testSnapID, item.revision, item.size))
+
+		err := s.subject.Verify(context.Background(), testName, item.verifiedRevision, s.snapPath)
+
+		c.Assert(err, check.FitsTypeOf, &ErrMismatch{})
+		c.Check(err.(*ErrMismatch).header, check.Equals, item.header)
+	}
+}
+
+func (s *assertsSuite) TestVerifyDoesNotCheckZeroRevision(c *check.C) {
+	err := s.subject.Verify(context.Background(), testName, 0, s.snapPath)
+
+	c.Assert(err, check.IsNil)
+}
+
+func (s *assertsSuite) TestVerifyChecksDeclarationAssertion(c *check.C) {
+	testCases := []struct {
+		name, publisherID, header string
+	}{
+		{"anothername", testPublisherID, "snap-name"},
+		{testName, "anotherpublisher", "publisher-id"},
+	}
+	for _, item := range testCases {
+		s.webGetter.outputs[declarationURL(testSnapID)] = s.storeKey.sign(c, fmt.Sprintf(declarationBase,
+			testSnapID, item.name, item.publisherID))
+
+		err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+		c.Assert(err, check.FitsTypeOf, &ErrMismatch{})
+		c.Check(err.(*ErrMismatch).header, check.Equals, item.header)
+	}
+}
+
+func (s *assertsSuite) TestVerifyChecksAssertionType(c *check.C) {
+	s.webGetter.outputs[revisionURL(s.digest)] = s.webGetter.outputs[declarationURL(testSnapID)]
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMismatch{})
+	c.Assert(err.(*ErrMismatch).header, check.Equals, "type")
+}
+
+func (s *assertsSuite) TestVerifyRejectsTamperedAssertion(c *check.C) {
+	url := revisionURL(s.digest)
+	s.webGetter.outputs[url] = strings.Replace(s.webGetter.outputs[url],
+		"developer-id: "+testPublisherID, "developer-id: attacker", 1)
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *assertsSuite) TestVerifyRejectsAccountKeyNotSignedByTrustedKey(c *check.C) {
+	s.webGetter.outputs[accountKeyURL(s.storeKey.id)] = s.storeKey.accountKey(c, s.otherKey, "canonical", "")
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *assertsSuite) TestVerifyRejectsKeyOfAnotherAccount(c *check.C) {
+	s.webGetter.outputs[accountKeyURL(s.storeKey.id)] = s.storeKey.accountKey(c, s.rootKey, testPublisherID, "")
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *assertsSuite) TestVerifyRejectsOtherAuthority(c *check.C) {
+	s.webGetter.outputs[revisionURL(s.digest)] = s.storeKey.sign(c, strings.Replace(fmt.Sprintf(revisionBase,
+		s.digest, testPublisherID, testSnapID, testRevision, len(testContent)),
+		"authority-id: canonical", "authority-id: "+testPublisherID, 1))
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrMismatch{})
+	c.Assert(err.(*ErrMismatch).header, check.Equals, "authority-id")
+}
+
+func (s *assertsSuite) TestVerifyRejectsExpiredKey(c *check.C) {
+	s.webGetter.outputs[accountKeyURL(s.storeKey.id)] = s.storeKey.accountKey(c, s.rootKey, "canonical",
+		"\nuntil: 2016-02-01T00:00:00Z")
+
+	err := s.subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *assertsSuite) TestVerifyFetchesAccountKeyOnce(c *check.C) {
+	c.Assert(s.subject.Verify(context.Background(), testName, testRevision, s.snapPath), check.IsNil)
+	c.Assert(s.subject.Verify(context.Background(), testName, testRevision, s.snapPath), check.IsNil)
+
+	c.Assert(s.webGetter.calls[accountKeyURL(s.storeKey.id)] <= 1, check.Equals, true)
+}
+
+func (s *assertsSuite) TestVerifyFailsWithoutTrustedKeys(c *check.C) {
+	subject := NewClient(s.webGetter, nil, false)
+
+	err := subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *assertsSuite) TestVerifyInsecureSkipsSignatures(c *check.C) {
+	subject := NewClient(s.webGetter, nil, true)
+	url := revisionURL(s.digest)
+	s.webGetter.outputs[url] = fmt.Sprintf(revisionBase,
+		s.digest, testPublisherID, testSnapID, testRevision, len(testContent)) + "\n\nAcLBUgQAAQoABgUCV"
+
+	err := subject.Verify(context.Background(), testName, testRevision, s.snapPath)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls[accountKeyURL(s.storeKey.id)], check.Equals, 0)
+}
+
+func (s *assertsSuite) TestReadTrustedKeysChecksKeyDigest(c *check.C) {
+	path := filepath.Join(c.MkDir(), "root.account-key")
+	content := strings.Replace(s.rootKey.accountKey(c, s.rootKey, "canonical", ""),
+		"public-key-sha3-384: "+s.rootKey.id, "public-key-sha3-384: "+s.storeKey.id, 1)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+
+	_, err := ReadTrustedKeys(path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrTrustedKey{})
+}
+
+func (s *assertsSuite) TestDecodeSplitsBodyAndSignature(c *check.C) {
+	assertion, err := Decode([]byte("type: account-key\nbody-length: 4\n\nbody\n\nsignature\n"))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(string(assertion.body), check.Equals, "body")
+	c.Assert(string(assertion.signature), check.Equals, "signature")
+	c.Assert(string(assertion.content), check.Equals, "type: account-key\nbody-length: 4\n\nbody")
+}
+
+func (s *assertsSuite) TestDecodeRejectsInvalidBodyLength(c *check.C) {
+	_, err := Decode([]byte("type: account-key\nbody-length: 10\n\nbody\n\nsignature"))
+
+	c.Assert(err, check.FitsTypeOf, &ErrDecode{})
+}
+
+func (s *assertsSuite) TestDecodeParsesMultilineHeaders(c *check.C) {
+	assertion, err := Decode([]byte("type: account\nnames:\n  - one\n  - two\nid: myid\n\nbody"))
+
+	c.Assert(err, check.IsNil)
+	c.Assert(assertion.Header("names"), check.Equals, "\n- one\n- two")
+	c.Assert(assertion.Header("id"), check.Equals, "myid")
+}
+
+func revisionURL(digest string) string {
+	return baseURL + "/snap-revision/" + digest
+}
+
+func accountKeyURL(id string) string {
+	return baseURL + "/account-key/" + id
+}
+
+func declarationURL(snapID string) string {
+	return baseURL + "/snap-declaration/16/" + snapID
+}
+
+func testDigest(content string) string {
+	digest := sha3.Sum384([]byte(content))
+	return base64.RawURLEncoding.EncodeToString(digest[:])
+}
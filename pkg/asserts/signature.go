@@ -0,0 +1,186 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package asserts
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/sha3"
+)
+
+const (
+	accountKeyType   = "account-key"
+	openpgpPrefix    = "openpgp "
+	errSignatureFmt  = "Invalid signature of the %s assertion: %s"
+	errTrustedKeyFmt = "Could not read the trusted key %s: %s"
+	errNoTrustedKeys = "there are no trusted keys to check it"
+)
+
+// ErrSignature is the error returned when an assertion is not signed by a
+// valid key of its authority that chains up to a trusted key
+type ErrSignature struct {
+	assertType, msg string
+}
+
+func (e *ErrSignature) Error() string {
+	return fmt.Sprintf(errSignatureFmt, e.assertType, e.msg)
+}
+
+// ErrTrustedKey is the error returned when a trusted key file can't be loaded
+type ErrTrustedKey struct {
+	path, msg string
+}
+
+func (e *ErrTrustedKey) Error() string {
+	return fmt.Sprintf(errTrustedKeyFmt, e.path, e.msg)
+}
+
+// AccountKey is an account-key assertion with its decoded public key
+type AccountKey struct {
+	assertion *Assertion
+	pubKey    *packet.PublicKey
+}
+
+// ReadTrustedKeys loads the account-key assertions in the given files, one in
+// each file. They are trusted without checking their signatures, like the root
+// keys of the store
+func ReadTrustedKeys(paths ...string) (keys []*AccountKey, err error) {
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		assertion, err := Decode(content)
+		if err != nil {
+			return nil, &ErrTrustedKey{path: path, msg: err.Error()}
+		}
+		key, err := newAccountKey(assertion)
+		if err != nil {
+			return nil, &ErrTrustedKey{path: path, msg: err.Error()}
+		}
+		keys = append(keys, key)
+	}
+	return
+}
+
+// newAccountKey decodes the public key in the body of the assertion, which
+// must match its public-key-sha3-384 header
+func newAccountKey(assertion *Assertion) (*AccountKey, error) {
+	if assertion.Header("type") != accountKeyType {
+		return nil, &ErrMismatch{assertType: accountKeyType, header: "type", expected: accountKeyType, actual: assertion.Header("type")}
+	}
+	content, err := decodeBase64(assertion.body)
+	if err != nil {
+		return nil, &ErrDecode{msg: "invalid public key, " + err.Error()}
+	}
+	p, err := packet.Read(bytes.NewReader(content))
+	if err != nil {
+		return nil, &ErrDecode{msg: "invalid public key, " + err.Error()}
+	}
+	pubKey, ok := p.(*packet.PublicKey)
+	if !ok {
+		return nil, &ErrDecode{msg: "the body is not a public key"}
+	}
+	digest := sha3.Sum384(content)
+	if err = checkHeader(assertion, accountKeyType, "public-key-sha3-384", base64.RawURLEncoding.EncodeToString(digest[:])); err != nil {
+		return nil, err
+	}
+	return &AccountKey{assertion: assertion, pubKey: pubKey}, nil
+}
+
+// ID returns the sha3-384 digest of the key, as referred by the
+// sign-key-sha3-384 header of the assertions it signs
+func (k *AccountKey) ID() string {
+	return k.assertion.Header("public-key-sha3-384")
+}
+
+// verify checks that the assertion is signed by the key, and that the key
+// belongs to the authority of the assertion and was valid when it was made
+func (k *AccountKey) verify(assertion *Assertion) error {
+	assertType := assertion.Header("type")
+	if account := k.assertion.Header("account-id"); assertion.Header("authority-id") != account {
+		return &ErrSignature{assertType: assertType,
+			msg: fmt.Sprintf("signed with a key of %s instead of %s", account, assertion.Header("authority-id"))}
+	}
+	if err := k.checkValidity(assertion); err != nil {
+		return &ErrSignature{assertType: assertType, msg: err.Error()}
+	}
+	content, err := decodeBase64(assertion.signature)
+	if err != nil {
+		return &ErrSignature{assertType: assertType, msg: err.Error()}
+	}
+	p, err := packet.Read(bytes.NewReader(content))
+	if err != nil {
+		return &ErrSignature{assertType: assertType, msg: err.Error()}
+	}
+	sig, ok := p.(*packet.Signature)
+	if !ok {
+		return &ErrSignature{assertType: assertType, msg: "not a signature"}
+	}
+	hash := sig.Hash.New()
+	hash.Write(assertion.content)
+	if err = k.pubKey.VerifySignature(hash, sig); err != nil {
+		return &ErrSignature{assertType: assertType, msg: err.Error()}
+	}
+	return nil
+}
+
+// checkValidity returns an error if the time of the assertion, its timestamp
+// or the since of the account keys, is out of the validity of the key
+func (k *AccountKey) checkValidity(assertion *Assertion) error {
+	stamp := assertion.Header("timestamp")
+	if stamp == "" {
+		stamp = assertion.Header("since")
+	}
+	made, err := time.Parse(time.RFC3339, stamp)
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", stamp)
+	}
+	since, err := time.Parse(time.RFC3339, k.assertion.Header("since"))
+	if err != nil {
+		return fmt.Errorf("invalid since of the key %q", k.assertion.Header("since"))
+	}
+	if made.Before(since) {
+		return fmt.Errorf("made at %s, before the key was valid", stamp)
+	}
+	if until := k.assertion.Header("until"); until != "" {
+		end, err := time.Parse(time.RFC3339, until)
+		if err != nil {
+			return fmt.Errorf("invalid until of the key %q", until)
+		}
+		if !made.Before(end) {
+			return fmt.Errorf("made at %s, after the key expired", stamp)
+		}
+	}
+	return nil
+}
+
+// decodeBase64 decodes the standard base64 encoding of the signatures and
+// the public keys, optionally prefixed by their format
+func decodeBase64(content []byte) ([]byte, error) {
+	encoded := strings.TrimPrefix(strings.TrimSpace(string(content)), openpgpPrefix)
+	return base64.StdEncoding.DecodeString(encoded)
+}
@@ -0,0 +1,461 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package cache keeps a local content-addressed copy of the snaps downloaded
+// from the store, so that they can be reused between builds
+package cache
+
+import (
+	"context"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/ubuntu-core/snappy/snap"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	indexFileName   = "index.json"
+	lockFileName    = "lock"
+	blobsDirName    = "blobs"
+	checkoutDirName = "checkout"
+	errMissFmt      = "Snap %s with revision %d is not in the cache"
+	errIntegrityFmt = "Cached snap %s with revision %d is corrupted, expected digest %s, got %s"
+)
+
+var now = time.Now
+
+// Entry holds the details of a cached snap
+type Entry struct {
+	Name     string    `json:"name"`
+	Revision int       `json:"revision"`
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last-used"`
+}
+
+// ErrMiss is the error returned when a snap is not in the cache
+type ErrMiss struct {
+	name     string
+	revision int
+}
+
+func (e *ErrMiss) Error() string {
+	return fmt.Sprintf(errMissFmt, e.name, e.revision)
+}
+
+// ErrIntegrity is the error returned when the content of a cached snap doesn't
+// match its recorded digest
+type ErrIntegrity struct {
+	name             string
+	revision         int
+	expected, actual string
+}
+
+func (e *ErrIntegrity) Error() string {
+	return fmt.Sprintf(errIntegrityFmt, e.name, e.revision, e.expected, e.actual)
+}
+
+// Cache is a size limited local store of snaps keyed by name, revision and
+// digest. When the limit is exceeded the least recently used snaps are evicted.
+// The index is locked with flock and read again for each operation, so that
+// several processes can share the cache directory
+type Cache struct {
+	dir     string
+	maxSize int64
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	counter int
+}
+
+// New is the Cache constructor, it creates the directories of the cache in dir
+// if needed. A maxSize of 0 means no limit
+func New(dir string, maxSize int64) (*Cache, error) {
+	for _, subdir := range []string{blobsDirName, checkoutDirName} {
+		if err := os.MkdirAll(filepath.Join(dir, subdir), 0755); err != nil {
+			return nil, err
+		}
+	}
+	c := &Cache{dir: dir, maxSize: maxSize, entries: make(map[string]*Entry)}
+	return c, c.locked(syscall.LOCK_SH, func() error { return nil })
+}
+
+// locked runs fn holding the lock of the cache directory, with the entries
+// read from the index
+func (c *Cache) locked(how int, fn func() error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	lock, err := os.OpenFile(filepath.Join(c.dir, lockFileName), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err = syscall.Flock(int(lock.Fd()), how); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	if err = c.load(); err != nil {
+		return err
+	}
+	return fn()
+}
+
+func (c *Cache) load() error {
+	c.entries = make(map[string]*Entry)
+	content, err := ioutil.ReadFile(c.indexPath())
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var entries []*Entry
+	if err = json.Unmarshal(content, &entries); err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		c.entries[key(entry.Name, entry.Revision)] = entry
+	}
+	return nil
+}
+
+// Get returns the path of a private copy of the cached snap with the given name
+// and revision, that the caller is free to remove. When digest is not empty it must
+// match the one of the cached snap. The content of the snap is checked against its
+// recorded digest before being handed out, and corrupted entries are evicted
+func (c *Cache) Get(name string, revision int, digest string) (path string, err error) {
+	err = c.locked(syscall.LOCK_EX, func() error {
+		entry, ok := c.entries[key(name, revision)]
+		if !ok || (digest != "" && entry.Digest != digest) {
+			return &ErrMiss{name: name, revision: revision}
+		}
+		actual, err := fileDigest(c.blobPath(entry.Digest))
+		if err != nil || actual != entry.Digest {
+			log.Warnf("Evicting corrupted cache entry for %s revision %d", name, revision)
+			c.remove(entry)
+			if saveErr := c.save(); saveErr != nil {
+				return saveErr
+			}
+			if err == nil {
+				err = &ErrIntegrity{name: name, revision: revision, expected: entry.Digest, actual: actual}
+			}
+			return err
+		}
+		if path, err = c.checkout(entry); err != nil {
+			return err
+		}
+		entry.LastUsed = now()
+		return c.save()
+	})
+	return
+}
+
+// Put adds the snap file in path to the cache under the given name and revision,
+// the file is left untouched. If digest is empty it is computed from the content
+func (c *Cache) Put(name string, revision int, digest, path string) (err error) {
+	actual, err := fileDigest(path)
+	if err != nil {
+		return
+	}
+	if digest != "" && digest != actual {
+		return &ErrIntegrity{name: name, revision: revision, expected: digest, actual: actual}
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return
+	}
+
+	return c.locked(syscall.LOCK_EX, func() error {
+		// the blob is renamed in place, so that the others never see it
+		// partially written
+		tmpPath := c.blobPath(actual) + ".tmp"
+		if err := copyFile(path, tmpPath); err != nil {
+			os.Remove(tmpPath)
+			return err
+		}
+		if err := os.Rename(tmpPath, c.blobPath(actual)); err != nil {
+			return err
+		}
+		c.entries[key(name, revision)] = &Entry{
+			Name: name, Revision: revision, Digest: actual, Size: info.Size(), LastUsed: now()}
+		c.evict()
+		return c.save()
+	})
+}
+
+// List returns the cached entries, most recently used first
+func (c *Cache) List() (entries []Entry, err error) {
+	err = c.locked(syscall.LOCK_SH, func() error {
+		for _, entry := range c.sorted() {
+			entries = append(entries, *entry)
+		}
+		return nil
+	})
+	return
+}
+
+// Prune evicts the least recently used entries until the cache fits in its size
+// limit, drops the entries whose files are gone, and removes the files that are
+// not in the index and the checkouts of the processes that are gone. It returns
+// the evicted entries
+func (c *Cache) Prune() (evicted []Entry, err error) {
+	err = c.locked(syscall.LOCK_EX, func() error {
+		for _, entry := range c.entries {
+			if _, err := os.Stat(c.blobPath(entry.Digest)); os.IsNotExist(err) {
+				evicted = append(evicted, *entry)
+				c.remove(entry)
+			}
+		}
+		evicted = append(evicted, c.evict()...)
+		if err := c.sweepBlobs(); err != nil {
+			return err
+		}
+		if err := c.sweepCheckouts(); err != nil {
+			return err
+		}
+		return c.save()
+	})
+	return
+}
+
+// sweepBlobs removes the blobs that no entry of the index refers to, like
+// the ones left by interrupted writes
+func (c *Cache) sweepBlobs() error {
+	referenced := make(map[string]bool)
+	for _, entry := range c.entries {
+		referenced[filepath.Base(c.blobPath(entry.Digest))] = true
+	}
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, blobsDirName))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if !referenced[file.Name()] {
+			log.Debugf("Removing unreferenced cache file %s", file.Name())
+			os.Remove(filepath.Join(c.dir, blobsDirName, file.Name()))
+		}
+	}
+	return nil
+}
+
+// sweepCheckouts removes the checkouts handed out to the processes that are
+// not running anymore, the others may still be reading theirs
+func (c *Cache) sweepCheckouts() error {
+	files, err := ioutil.ReadDir(filepath.Join(c.dir, checkoutDirName))
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		if pid := checkoutPid(file.Name()); pid > 0 && processRunning(pid) {
+			continue
+		}
+		os.Remove(filepath.Join(c.dir, checkoutDirName, file.Name()))
+	}
+	return nil
+}
+
+// checkoutPid returns the pid in the name of a checkout, <name>_<revision>.<pid>.<counter>.snap,
+// or 0 if there is none
+func checkoutPid(name string) int {
+	parts := strings.Split(name, ".")
+	if len(parts) < 4 {
+		return 0
+	}
+	pid, err := strconv.Atoi(parts[len(parts)-3])
+	if err != nil {
+		return 0
+	}
+	return pid
+}
+
+func processRunning(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
+func (c *Cache) evict() (evicted []Entry) {
+	var total int64
+	for _, entry := range c.entries {
+		total += entry.Size
+	}
+	sorted := c.sorted()
+	for i := len(sorted) - 1; i >= 0 && c.maxSize > 0 && total > c.maxSize; i-- {
+		log.Debugf("Evicting %s revision %d from the snap cache", sorted[i].Name, sorted[i].Revision)
+		total -= sorted[i].Size
+		evicted = append(evicted, *sorted[i])
+		c.remove(sorted[i])
+	}
+	return
+}
+
+func (c *Cache) remove(entry *Entry) {
+	delete(c.entries, key(entry.Name, entry.Revision))
+	for _, other := range c.entries {
+		if other.Digest == entry.Digest {
+			return
+		}
+	}
+	os.Remove(c.blobPath(entry.Digest))
+}
+
+func (c *Cache) checkout(entry *Entry) (path string, err error) {
+	c.counter++
+	path = filepath.Join(c.dir, checkoutDirName,
+		fmt.Sprintf("%s_%d.%d.%d.snap", entry.Name, entry.Revision, os.Getpid(), c.counter))
+	if err = os.Link(c.blobPath(entry.Digest), path); err == nil {
+		return
+	}
+	return path, copyFile(c.blobPath(entry.Digest), path)
+}
+
+func (c *Cache) sorted() (entries []*Entry) {
+	for _, entry := range c.entries {
+		entries = append(entries, entry)
+	}
+	sort.Sort(byLastUsed(entries))
+	return
+}
+
+func (c *Cache) save() (err error) {
+	content, err := json.Marshal(c.sorted())
+	if err != nil {
+		return
+	}
+	tmpPath := c.indexPath() + ".tmp"
+	if err = ioutil.WriteFile(tmpPath, content, 0644); err != nil {
+		return
+	}
+	return os.Rename(tmpPath, c.indexPath())
+}
+
+func (c *Cache) indexPath() string {
+	return filepath.Join(c.dir, indexFileName)
+}
+
+func (c *Cache) blobPath(digest string) string {
+	return filepath.Join(c.dir, blobsDirName, digest+".snap")
+}
+
+type byLastUsed []*Entry
+
+func (b byLastUsed) Len() int           { return len(b) }
+func (b byLastUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastUsed) Less(i, j int) bool { return b[i].LastUsed.After(b[j].LastUsed) }
+
+type storeClient interface {
+	Download(ctx context.Context, remoteSnap *snap.Info, dir string, meter web.Meter) (path string, err error)
+	Snap(ctx context.Context, name, channel string) (r *snap.Info, err error)
+	SnapRevision(ctx context.Context, name, channel string, revision int) (r *snap.Info, err error)
+}
+
+// Store is a store client that serves the snap downloads from a Cache when
+// possible, and fills it with the snaps retrieved from the wrapped client
+type Store struct {
+	sc    storeClient
+	cache *Cache
+}
+
+// NewStore is the Store constructor
+func NewStore(sc storeClient, cache *Cache) *Store {
+	return &Store{sc: sc, cache: cache}
+}
+
+// Snap returns the details of the snap from the wrapped client
+func (s *Store) Snap(ctx context.Context, name, channel string) (*snap.Info, error) {
+	return s.sc.Snap(ctx, name, channel)
+}
+
+// SnapRevision returns the details of the given revision of the snap from the
+// wrapped client
+func (s *Store) SnapRevision(ctx context.Context, name, channel string, revision int) (*snap.Info, error) {
+	return s.sc.SnapRevision(ctx, name, channel, revision)
+}
+
+// Download returns the path of a copy of the given snap, from the cache if present
+// or else downloaded to dir by the wrapped client
+func (s *Store) Download(ctx context.Context, remoteSnap *snap.Info, dir string, meter web.Meter) (path string, err error) {
+	name := remoteSnap.Name()
+	path, err = s.cache.Get(name, remoteSnap.Revision, remoteSnap.Sha512)
+	if err == nil {
+		log.Debugf("Using cached %s revision %d", name, remoteSnap.Revision)
+		return
+	}
+	log.Debug(err.Error())
+
+	downloaded, err := s.sc.Download(ctx, remoteSnap, dir, meter)
+	if err != nil {
+		return
+	}
+	if err := s.cache.Put(name, remoteSnap.Revision, remoteSnap.Sha512, downloaded); err != nil {
+		log.Warnf("Could not cache %s revision %d: %v", name, remoteSnap.Revision, err)
+	}
+	return downloaded, nil
+}
+
+func key(name string, revision int) string {
+	return fmt.Sprintf("%s_%d", name, revision)
+}
+
+func fileDigest(path string) (digest string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha512.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func copyFile(src, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		out.Close()
+		return
+	}
+	return out.Close()
+}
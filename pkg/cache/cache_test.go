@@ -0,0 +1,337 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ubuntu-core/snappy/snap"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	testName     = "mykernel"
+	testRevision = 23
+	testContent  = "this is the snap content"
+)
+
+var _ = check.Suite(&cacheSuite{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type cacheSuite struct {
+	dir      string
+	subject  *Cache
+	snapPath string
+	backNow  func() time.Time
+	clockMu  sync.Mutex
+	clock    time.Time
+}
+
+type fakeStoreClient struct {
+	downloadCalls int
+	downloadErr   bool
+	path          string
+}
+
+func (f *fakeStoreClient) Download(ctx context.Context, remoteSnap *snap.Info, dir string, meter web.Meter) (string, error) {
+	f.downloadCalls++
+	if f.downloadErr {
+		return "", errors.New("download error")
+	}
+	return f.path, nil
+}
+
+func (f *fakeStoreClient) Snap(ctx context.Context, name, channel string) (*snap.Info, error) {
+	return &snap.Info{SideInfo: snap.SideInfo{OfficialName: name, Channel: channel, Revision: testRevision}}, nil
+}
+
+func (f *fakeStoreClient) SnapRevision(ctx context.Context, name, channel string, revision int) (*snap.Info, error) {
+	return &snap.Info{SideInfo: snap.SideInfo{OfficialName: name, Channel: channel, Revision: revision}}, nil
+}
+
+func (s *cacheSuite) SetUpSuite(c *check.C) {
+	s.backNow = now
+	now = func() time.Time {
+		s.clockMu.Lock()
+		defer s.clockMu.Unlock()
+		s.clock = s.clock.Add(time.Second)
+		return s.clock
+	}
+}
+
+func (s *cacheSuite) TearDownSuite(c *check.C) {
+	now = s.backNow
+}
+
+func (s *cacheSuite) SetUpTest(c *check.C) {
+	var err error
+	s.dir = c.MkDir()
+	s.subject, err = New(filepath.Join(s.dir, "cache"), 0)
+	c.Assert(err, check.IsNil)
+	s.snapPath = s.writeSnap(c, "snap", testContent)
+}
+
+func (s *cacheSuite) TestGetReturnsMissForUnknownSnap(c *check.C) {
+	_, err := s.subject.Get(testName, testRevision, "")
+
+	c.Assert(err, check.FitsTypeOf, &ErrMiss{})
+}
+
+func (s *cacheSuite) TestGetReturnsCopyOfPutSnap(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+
+	path, err := s.subject.Get(testName, testRevision, "")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Not(check.Equals), s.snapPath)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, testContent)
+}
+
+func (s *cacheSuite) TestGetKeepsCacheEntryWhenCopyIsRemoved(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	path, err := s.subject.Get(testName, testRevision, "")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(os.Remove(path), check.IsNil)
+
+	_, err = s.subject.Get(testName, testRevision, "")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *cacheSuite) TestGetReturnsMissOnDifferentDigest(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+
+	_, err := s.subject.Get(testName, testRevision, "anotherdigest")
+
+	c.Assert(err, check.FitsTypeOf, &ErrMiss{})
+}
+
+func (s *cacheSuite) TestGetEvictsCorruptedEntries(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	entries, err := s.subject.List()
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(s.subject.blobPath(entries[0].Digest), []byte("corrupted"), 0644)
+	c.Assert(err, check.IsNil)
+
+	_, err = s.subject.Get(testName, testRevision, "")
+
+	c.Assert(err, check.FitsTypeOf, &ErrIntegrity{})
+	entries, err = s.subject.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 0)
+}
+
+func (s *cacheSuite) TestPutReturnsErrorOnDigestMismatch(c *check.C) {
+	err := s.subject.Put(testName, testRevision, "anotherdigest", s.snapPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrIntegrity{})
+}
+
+func (s *cacheSuite) TestPutEvictsLeastRecentlyUsed(c *check.C) {
+	subject, err := New(filepath.Join(s.dir, "limited"), 2*int64(len(testContent)+1))
+	c.Assert(err, check.IsNil)
+	c.Assert(subject.Put("first", 1, "", s.writeSnap(c, "first", testContent+"1")), check.IsNil)
+	c.Assert(subject.Put("second", 1, "", s.writeSnap(c, "second", testContent+"2")), check.IsNil)
+	_, err = subject.Get("first", 1, "")
+	c.Assert(err, check.IsNil)
+
+	c.Assert(subject.Put("third", 1, "", s.writeSnap(c, "third", testContent+"3")), check.IsNil)
+
+	_, err = subject.Get("second", 1, "")
+	c.Assert(err, check.FitsTypeOf, &ErrMiss{})
+	_, err = subject.Get("first", 1, "")
+	c.Assert(err, check.IsNil)
+	_, err = subject.Get("third", 1, "")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *cacheSuite) TestNewLoadsPersistedEntries(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+
+	subject, err := New(filepath.Join(s.dir, "cache"), 0)
+	c.Assert(err, check.IsNil)
+
+	entries, err := subject.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 1)
+	c.Assert(entries[0].Name, check.Equals, testName)
+	c.Assert(entries[0].Revision, check.Equals, testRevision)
+	c.Assert(entries[0].Size, check.Equals, int64(len(testContent)))
+}
+
+func (s *cacheSuite) TestListReturnsMostRecentlyUsedFirst(c *check.C) {
+	c.Assert(s.subject.Put("first", 1, "", s.writeSnap(c, "first", "1")), check.IsNil)
+	c.Assert(s.subject.Put("second", 1, "", s.writeSnap(c, "second", "2")), check.IsNil)
+	_, err := s.subject.Get("first", 1, "")
+	c.Assert(err, check.IsNil)
+
+	entries, err := s.subject.List()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 2)
+	c.Assert(entries[0].Name, check.Equals, "first")
+	c.Assert(entries[1].Name, check.Equals, "second")
+}
+
+func (s *cacheSuite) TestPruneDropsEntriesWithoutFile(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	entries, err := s.subject.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(os.Remove(s.subject.blobPath(entries[0].Digest)), check.IsNil)
+
+	evicted, err := s.subject.Prune()
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(evicted), check.Equals, 1)
+	entries, err = s.subject.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 0)
+}
+
+func (s *cacheSuite) TestPruneKeepsCheckoutsOfRunningProcesses(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	path, err := s.subject.Get(testName, testRevision, "")
+	c.Assert(err, check.IsNil)
+
+	_, err = s.subject.Prune()
+
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *cacheSuite) TestPruneRemovesCheckoutsOfFinishedProcesses(c *check.C) {
+	cmd := exec.Command("true")
+	c.Assert(cmd.Run(), check.IsNil)
+	path := filepath.Join(s.dir, "cache", checkoutDirName,
+		fmt.Sprintf("%s_%d.%d.1.snap", testName, testRevision, cmd.ProcessState.Pid()))
+	c.Assert(ioutil.WriteFile(path, []byte(testContent), 0644), check.IsNil)
+
+	_, err := s.subject.Prune()
+
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *cacheSuite) TestPruneRemovesUnreferencedBlobs(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	orphan := s.subject.blobPath("orphan")
+	c.Assert(ioutil.WriteFile(orphan, []byte(testContent), 0644), check.IsNil)
+
+	_, err := s.subject.Prune()
+
+	c.Assert(err, check.IsNil)
+	_, err = os.Stat(orphan)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = s.subject.Get(testName, testRevision, "")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *cacheSuite) TestCachesSharingDirKeepEachOthersEntries(c *check.C) {
+	other, err := New(filepath.Join(s.dir, "cache"), 0)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(s.subject.Put("first", 1, "", s.writeSnap(c, "first", "1")), check.IsNil)
+	c.Assert(other.Put("second", 1, "", s.writeSnap(c, "second", "2")), check.IsNil)
+	_, err = s.subject.Get("second", 1, "")
+	c.Assert(err, check.IsNil)
+
+	entries, err := other.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 2)
+}
+
+func (s *cacheSuite) TestConcurrentPutsAreAllIndexed(c *check.C) {
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		subject, err := New(filepath.Join(s.dir, "cache"), 0)
+		c.Assert(err, check.IsNil)
+		path := s.writeSnap(c, fmt.Sprintf("snap%d", i), fmt.Sprintf("content %d", i))
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Check(subject.Put(fmt.Sprintf("snap%d", i), 1, "", path), check.IsNil)
+		}(i)
+	}
+	wg.Wait()
+
+	entries, err := s.subject.List()
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 8)
+}
+
+func (s *cacheSuite) TestStoreDownloadFillsCache(c *check.C) {
+	sc := &fakeStoreClient{path: s.snapPath}
+	subject := NewStore(sc, s.subject)
+	remoteSnap, _ := subject.Snap(context.Background(), testName, "edge")
+
+	path, err := subject.Download(context.Background(), remoteSnap, s.dir, nil)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, s.snapPath)
+	c.Assert(sc.downloadCalls, check.Equals, 1)
+	_, err = s.subject.Get(testName, testRevision, "")
+	c.Assert(err, check.IsNil)
+}
+
+func (s *cacheSuite) TestStoreDownloadUsesCache(c *check.C) {
+	c.Assert(s.subject.Put(testName, testRevision, "", s.snapPath), check.IsNil)
+	sc := &fakeStoreClient{}
+	subject := NewStore(sc, s.subject)
+	remoteSnap, _ := subject.Snap(context.Background(), testName, "edge")
+
+	path, err := subject.Download(context.Background(), remoteSnap, s.dir, nil)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(sc.downloadCalls, check.Equals, 0)
+	content, err := ioutil.ReadFile(path)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, testContent)
+}
+
+func (s *cacheSuite) TestStoreDownloadReturnsStoreError(c *check.C) {
+	subject := NewStore(&fakeStoreClient{downloadErr: true}, s.subject)
+	remoteSnap, _ := subject.Snap(context.Background(), testName, "edge")
+
+	_, err := subject.Download(context.Background(), remoteSnap, s.dir, nil)
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cacheSuite) writeSnap(c *check.C, name, content string) string {
+	path := filepath.Join(s.dir, name+".snap")
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+	return path
+}
@@ -20,25 +20,212 @@
 // Package cli handles the interaction with the command line
 package cli
 
-import "os/exec"
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	// DefaultMaxOutput is the number of bytes kept of each output stream
+	// when the executor doesn't set it
+	DefaultMaxOutput = 4 << 20
+	errTimeoutFmt    = "Command %q timed out after %s"
+	errCancelledFmt  = "Command %q cancelled after %s%s"
+)
 
 var (
 	execCommand = exec.Command
+	after       = time.After
+	now         = time.Now
+	// killGrace is the time given to the commands to exit after SIGTERM
+	// before they are sent SIGKILL
+	killGrace = 10 * time.Second
 )
 
 // Commander comprises the methods required by a generic command executor
 type Commander interface {
-	ExecCommand(...string) (output string, err error)
+	ExecCommand(ctx context.Context, cmds ...string) (output string, err error)
+}
+
+// StreamCommander is a Commander that keeps the standard output and error of
+// the commands apart
+type StreamCommander interface {
+	Commander
+	ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error)
 }
 
 // Executor is a concrete type for CLI execution
-type Executor struct{}
+type Executor struct {
+	// Timeout is the maximum running time of each command, 0 means no limit
+	Timeout time.Duration
+	// MaxOutput is the number of bytes kept of each output stream, the
+	// oldest ones are discarded. 0 means DefaultMaxOutput and a negative
+	// value no limit
+	MaxOutput int
+	// Env are the variables added to the environment of the commands, as
+	// key=value
+	Env []string
+}
+
+// ErrTimeout is the error returned when a command is killed because its
+// deadline was exceeded, with the signal that ended it and the last lines of
+// its standard error
+type ErrTimeout struct {
+	command string
+	elapsed time.Duration
+	signal  syscall.Signal
+	stderr  []string
+}
+
+func (e *ErrTimeout) Error() string {
+	return fmt.Sprintf(errTimeoutFmt, e.command, e.elapsed) + killDetails(e.signal, e.stderr)
+}
+
+// Signal returns the signal that killed the command, 0 if it exited by itself
+// once it was asked to terminate
+func (e *ErrTimeout) Signal() syscall.Signal {
+	return e.signal
+}
+
+// Stderr returns the last lines of the standard error of the command
+func (e *ErrTimeout) Stderr() []string {
+	return e.stderr
+}
 
 // ExecCommand sends the given command to the CLI and returns the output and
-// the resulting error
-func (e *Executor) ExecCommand(cmds ...string) (output string, err error) {
+// the resulting error. The output has the standard output and error of the
+// command interleaved, see ExecCommandStreams for the details of the execution
+func (e *Executor) ExecCommand(ctx context.Context, cmds ...string) (output string, err error) {
+	out, err := e.run(ctx, cmds)
+	if out != nil {
+		output = out.combined.String()
+	}
+	return
+}
+
+// ExecCommandStreams sends the given command to the CLI and returns its
+// standard output and error apart. Both are logged line by line while the
+// command runs, and only the last MaxOutput bytes of each one are kept. The
+// command runs in its own process group, which is killed when ctx is done or
+// the timeout of the executor is exceeded. In that case ErrTimeout is returned
+// for exceeded deadlines and the error of ctx for cancellations. Commands that
+// can't be started or fail return CommandError
+func (e *Executor) ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error) {
+	out, err := e.run(ctx, cmds)
+	if out != nil {
+		stdout, stderr = out.stdout.String(), out.stderr.String()
+	}
+	return
+}
+
+func (e *Executor) run(ctx context.Context, cmds []string) (out *output, err error) {
+	if e.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.Timeout)
+		defer cancel()
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	maxOutput := e.MaxOutput
+	if maxOutput == 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	out = newOutput(filepath.Base(cmds[0]), maxOutput)
 	cmd := execCommand(cmds[0], cmds[1:]...)
-	outputByte, err := cmd.CombinedOutput()
-	output = string(outputByte)
+	cmd.Stdout = out.stdoutWriter
+	cmd.Stderr = out.stderrWriter
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if len(e.Env) > 0 {
+		env := cmd.Env
+		if env == nil {
+			env = os.Environ()
+		}
+		cmd.Env = append(env, e.Env...)
+	}
+
+	start := now()
+	if err = cmd.Start(); err != nil {
+		return out, NewCommandError(cmds, err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = killGroup(cmd.Process.Pid, done)
+		out.flush()
+		return out, killedError(ctx, NewCommandError(cmds, err), now().Sub(start), out)
+	}
+	out.flush()
+	if err != nil {
+		commandErr := NewCommandError(cmds, err)
+		commandErr.duration = now().Sub(start).Round(time.Millisecond)
+		commandErr.stderr = lastLines(out.stderr.String(), stderrTail)
+		err = commandErr
+	}
+	return
+}
+
+// killGroup terminates the process group of the given leader, which is killed
+// if it is still running after killGrace, and returns the error of the leader
+// once it exits
+func killGroup(pid int, done <-chan error) error {
+	syscall.Kill(-pid, syscall.SIGTERM)
+	select {
+	case err := <-done:
+		return err
+	case <-after(killGrace):
+		syscall.Kill(-pid, syscall.SIGKILL)
+		return <-done
+	}
+}
+
+// killedError returns the error of a command killed because ctx is done, from
+// the CommandError of its exit. Exceeded deadlines return ErrTimeout, and
+// cancellations the error of ctx after logging the details of the command
+func killedError(ctx context.Context, exit *CommandError, elapsed time.Duration, out *output) error {
+	timeout := &ErrTimeout{
+		command: strings.Join(exit.args, " "),
+		elapsed: elapsed.Round(time.Millisecond),
+		signal:  exit.signal,
+		stderr:  lastLines(out.stderr.String(), stderrTail),
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		log.Warnf(errCancelledFmt, timeout.command, timeout.elapsed, killDetails(timeout.signal, timeout.stderr))
+		return err
+	}
+	return timeout
+}
+
+// killDetails describes how a killed command ended, for the error messages
+func killDetails(signal syscall.Signal, stderr []string) (details string) {
+	if signal != 0 {
+		details = ", killed by signal " + signal.String()
+	}
+	if len(stderr) > 0 {
+		details += ", stderr:\n" + strings.Join(stderr, "\n")
+	}
 	return
 }
+
+// Stdout runs the command with commander and returns its standard output, or
+// the whole output if commander can't keep the streams apart
+func Stdout(ctx context.Context, commander Commander, cmds ...string) (string, error) {
+	if streamer, ok := commander.(StreamCommander); ok {
+		stdout, _, err := streamer.ExecCommandStreams(ctx, cmds...)
+		return stdout, err
+	}
+	return commander.ExecCommand(ctx, cmds...)
+}
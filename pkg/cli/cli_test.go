@@ -20,10 +20,17 @@
 package cli
 
 import (
+	"context"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"os/exec"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -71,6 +78,38 @@ func (s *cliTestSuite) TestHelperProcessErr(c *check.C) {
 	baseHelperProcess(1)
 }
 
+// TestHelperProcessHang starts a child in its process group, writes its pid
+// and waits forever
+func (s *cliTestSuite) TestHelperProcessHang(c *check.C) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	child := exec.Command("/bin/sleep", "3600")
+	if err := child.Start(); err != nil {
+		os.Exit(2)
+	}
+	fmt.Fprintf(os.Stdout, "%d", child.Process.Pid)
+	time.Sleep(time.Hour)
+}
+
+// TestHelperProcessHangStderr writes a line to the standard error and waits
+// forever
+func (s *cliTestSuite) TestHelperProcessHangStderr(c *check.C) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprintln(os.Stderr, "waiting")
+	time.Sleep(time.Hour)
+}
+
+func (s *cliTestSuite) TestHelperProcessEnv(c *check.C) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprintf(os.Stdout, os.Getenv("https_proxy"))
+	os.Exit(0)
+}
+
 func baseHelperProcess(exitValue int) {
 	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
 		return
@@ -80,16 +119,193 @@ func baseHelperProcess(exitValue int) {
 }
 
 func (s *cliTestSuite) TestExecCommand(c *check.C) {
-	actualOutput, err := s.subject.ExecCommand("mycmd")
+	actualOutput, err := s.subject.ExecCommand(context.Background(), "mycmd")
 
 	c.Assert(actualOutput, check.Equals, execOutput)
 	c.Assert(err, check.IsNil)
 }
 
+func (s *cliTestSuite) TestExecCommandAddsEnv(c *check.C) {
+	s.helperProcess = "TestHelperProcessEnv"
+	subject := &Executor{Env: []string{"https_proxy=http://proxy:3128"}}
+
+	output, err := subject.ExecCommand(context.Background(), "mycmd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "http://proxy:3128")
+}
+
 func (s *cliTestSuite) TestExecCommandErrWithError(c *check.C) {
 	s.helperProcess = "TestHelperProcessErr"
-	actualOutput, err := s.subject.ExecCommand("mycmd")
+	actualOutput, err := s.subject.ExecCommand(context.Background(), "mycmd")
 
 	c.Assert(actualOutput, check.Equals, execOutput)
 	c.Assert(err, check.NotNil)
 }
+
+func (s *cliTestSuite) TestExecCommandTimeoutKillsProcessGroup(c *check.C) {
+	s.helperProcess = "TestHelperProcessHang"
+	subject := &Executor{Timeout: 500 * time.Millisecond}
+
+	output, err := subject.ExecCommand(context.Background(), "mycmd", "arg")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(strings.HasPrefix(err.Error(), `Command "mycmd arg" timed out after `), check.Equals, true)
+	pid, convErr := strconv.Atoi(output)
+	c.Assert(convErr, check.IsNil)
+	assertProcessGone(c, pid)
+}
+
+func (s *cliTestSuite) TestExecCommandTimeoutKeepsSignalAndStderr(c *check.C) {
+	s.helperProcess = "TestHelperProcessHangStderr"
+	subject := &Executor{Timeout: 500 * time.Millisecond}
+
+	_, _, err := subject.ExecCommandStreams(context.Background(), "mycmd")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(strings.HasSuffix(err.Error(), ", killed by signal terminated, stderr:\nwaiting"), check.Equals, true)
+	c.Assert(err.(*ErrTimeout).Signal(), check.Equals, syscall.SIGTERM)
+	c.Assert(err.(*ErrTimeout).Stderr(), check.DeepEquals, []string{"waiting"})
+}
+
+func (s *cliTestSuite) TestExecCommandContextDeadlineReturnsErrTimeout(c *check.C) {
+	s.helperProcess = "TestHelperProcessHang"
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err := s.subject.ExecCommand(ctx, "mycmd")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+}
+
+func (s *cliTestSuite) TestExecCommandCancel(c *check.C) {
+	s.helperProcess = "TestHelperProcessHang"
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, cancel)
+
+	output, err := s.subject.ExecCommand(ctx, "mycmd")
+
+	c.Assert(err, check.Equals, context.Canceled)
+	pid, convErr := strconv.Atoi(output)
+	c.Assert(convErr, check.IsNil)
+	assertProcessGone(c, pid)
+}
+
+func (s *cliTestSuite) TestExecCommandCancelledContextDoesNotStart(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	execCommand = func(command string, args ...string) *exec.Cmd {
+		calls++
+		return s.fakeExecCommand(command, args...)
+	}
+	defer func() { execCommand = s.fakeExecCommand }()
+
+	_, err := s.subject.ExecCommand(ctx, "mycmd")
+
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(calls, check.Equals, 0)
+}
+
+func (s *cliTestSuite) TestExecCommandKillsAfterGrace(c *check.C) {
+	s.helperProcess = "TestHelperProcessIgnoreTerm"
+	backAfter := after
+	defer func() { after = backAfter }()
+	var graces []time.Duration
+	after = func(d time.Duration) <-chan time.Time {
+		graces = append(graces, d)
+		return time.After(100 * time.Millisecond)
+	}
+
+	_, err := (&Executor{Timeout: 500 * time.Millisecond}).ExecCommand(context.Background(), "mycmd")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(graces, check.DeepEquals, []time.Duration{killGrace})
+}
+
+func (s *cliTestSuite) TestHelperProcessIgnoreTerm(c *check.C) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	signal.Ignore(syscall.SIGTERM)
+	time.Sleep(time.Hour)
+}
+
+func (s *cliTestSuite) TestHelperProcessStreams(c *check.C) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	fmt.Fprintf(os.Stdout, "out1\n")
+	fmt.Fprintf(os.Stderr, "err1\n")
+	fmt.Fprintf(os.Stdout, "out2\n")
+	os.Exit(0)
+}
+
+func (s *cliTestSuite) TestExecCommandStreamsKeepsStreamsApart(c *check.C) {
+	s.helperProcess = "TestHelperProcessStreams"
+
+	stdout, stderr, err := s.subject.(StreamCommander).ExecCommandStreams(context.Background(), "mycmd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "out1\nout2\n")
+	c.Assert(stderr, check.Equals, "err1\n")
+}
+
+func (s *cliTestSuite) TestExecCommandReturnsBothStreams(c *check.C) {
+	s.helperProcess = "TestHelperProcessStreams"
+
+	output, err := s.subject.ExecCommand(context.Background(), "mycmd")
+
+	c.Assert(err, check.IsNil)
+	for _, line := range []string{"out1\n", "out2\n", "err1\n"} {
+		c.Assert(strings.Contains(output, line), check.Equals, true)
+	}
+}
+
+func (s *cliTestSuite) TestExecCommandStreamsCapsOutput(c *check.C) {
+	s.helperProcess = "TestHelperProcessStreams"
+	subject := &Executor{MaxOutput: 3}
+
+	stdout, stderr, err := subject.ExecCommandStreams(context.Background(), "mycmd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "t2\n")
+	c.Assert(stderr, check.Equals, "r1\n")
+}
+
+type fakeCommander struct {
+	output string
+}
+
+func (f *fakeCommander) ExecCommand(ctx context.Context, cmds ...string) (string, error) {
+	return f.output, nil
+}
+
+func (s *cliTestSuite) TestStdoutUsesStreams(c *check.C) {
+	s.helperProcess = "TestHelperProcessStreams"
+
+	stdout, err := Stdout(context.Background(), s.subject, "mycmd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "out1\nout2\n")
+}
+
+func (s *cliTestSuite) TestStdoutFallsBackToOutput(c *check.C) {
+	output, err := Stdout(context.Background(), &fakeCommander{output: "all"}, "mycmd")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "all")
+}
+
+// assertProcessGone waits for the given process to exit, orphans that are
+// not reaped yet count as gone
+func assertProcessGone(c *check.C, pid int) {
+	for i := 0; i < 50; i++ {
+		stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	c.Fatalf("process %d is still running", pid)
+}
@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// stderrTail is the number of lines of the standard error kept in the
+	// errors of the failed commands
+	stderrTail    = 10
+	redacted      = "***"
+	errCommandFmt = "Command %q failed: %s"
+)
+
+// secretPattern matches the names of the flags and variables whose values
+// are redacted from the command lines
+var secretPattern = regexp.MustCompile(`(?i)(password|passwd|token|secret|credential)`)
+
+// CommandError is the error returned when a command fails, with the details
+// of its execution
+type CommandError struct {
+	args     []string
+	exitCode int
+	signal   syscall.Signal
+	duration time.Duration
+	stderr   []string
+	err      error
+}
+
+// NewCommandError returns the CommandError of the given command line and
+// underlying error, the secrets in cmds are redacted
+func NewCommandError(cmds []string, err error) *CommandError {
+	e := &CommandError{args: Redact(cmds), exitCode: -1, err: err}
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+			if status.Signaled() {
+				e.signal = status.Signal()
+			} else {
+				e.exitCode = status.ExitStatus()
+			}
+		}
+	}
+	return e
+}
+
+// WrapError returns err as the CommandError of the given command line. The
+// errors that already name the command, CommandError and ErrTimeout, and the
+// cancellations are returned as they are
+func WrapError(cmds []string, err error) error {
+	switch err.(type) {
+	case nil, *CommandError, *ErrTimeout:
+		return err
+	}
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return NewCommandError(cmds, err)
+}
+
+func (e *CommandError) Error() string {
+	var status string
+	switch {
+	case e.signal != 0:
+		status = "killed by signal " + e.signal.String()
+	case e.exitCode >= 0:
+		status = fmt.Sprintf("exit code %d", e.exitCode)
+	default:
+		status = e.err.Error()
+	}
+	if e.duration > 0 {
+		status += " after " + e.duration.String()
+	}
+	msg := fmt.Sprintf(errCommandFmt, strings.Join(e.args, " "), status)
+	if len(e.stderr) > 0 {
+		msg += ", stderr:\n" + strings.Join(e.stderr, "\n")
+	}
+	return msg
+}
+
+// Args returns the command line, with the secrets redacted
+func (e *CommandError) Args() []string {
+	return e.args
+}
+
+// ExitCode returns the exit code of the command, -1 if it didn't exit
+func (e *CommandError) ExitCode() int {
+	return e.exitCode
+}
+
+// Signal returns the signal that killed the command, 0 if there was none
+func (e *CommandError) Signal() syscall.Signal {
+	return e.signal
+}
+
+// Duration returns the running time of the command, 0 if it is not known
+func (e *CommandError) Duration() time.Duration {
+	return e.duration
+}
+
+// Stderr returns the last lines of the standard error of the command
+func (e *CommandError) Stderr() []string {
+	return e.stderr
+}
+
+// Unwrap returns the underlying error
+func (e *CommandError) Unwrap() error {
+	return e.err
+}
+
+// Redact returns a copy of the command line with the values of the flags and
+// variables named like secrets, and the passwords of the urls, replaced
+func Redact(cmds []string) []string {
+	args := make([]string, len(cmds))
+	secretValue := false
+	for i, arg := range cmds {
+		switch {
+		case secretValue:
+			arg = redacted
+			secretValue = false
+		case strings.HasPrefix(arg, "-") && secretPattern.MatchString(arg):
+			if n := strings.Index(arg, "="); n >= 0 {
+				arg = arg[:n+1] + redacted
+			} else {
+				secretValue = true
+			}
+		case strings.Contains(arg, "=") && secretPattern.MatchString(arg[:strings.Index(arg, "=")]):
+			arg = arg[:strings.Index(arg, "=")+1] + redacted
+		default:
+			arg = redactURL(arg)
+		}
+		args[i] = arg
+	}
+	return args
+}
+
+// redactURL replaces the password of the userinfo of an url
+func redactURL(arg string) string {
+	start := strings.Index(arg, "://")
+	if start < 0 {
+		return arg
+	}
+	start += len("://")
+	end := strings.IndexAny(arg[start:], "/?#")
+	if end < 0 {
+		end = len(arg)
+	} else {
+		end += start
+	}
+	at := strings.LastIndex(arg[start:end], "@")
+	if at < 0 {
+		return arg
+	}
+	colon := strings.Index(arg[start:start+at], ":")
+	if colon < 0 {
+		return arg
+	}
+	return arg[:start+colon+1] + redacted + arg[start+at:]
+}
+
+// lastLines returns the last n non empty lines of output
+func lastLines(output string, n int) (lines []string) {
+	for _, line := range strings.Split(output, "\n") {
+		if line = strings.TrimRight(line, "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return
+}
@@ -0,0 +1,282 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	errUnexpectedCommandFmt = "Unexpected command %q, it is not recorded in %s"
+	errFixtureFmt           = "Error decoding the fixture %s: %s"
+	// timeoutKind is the kind of the invocations that failed with ErrTimeout,
+	// the others failed with CommandError
+	timeoutKind = "timeout"
+)
+
+// Invocation is a command recorded in a fixture file. The arguments of the
+// recorded commands are matched as path.Match patterns when replaying, so
+// that the temporary paths can be replaced by wildcards
+type Invocation struct {
+	Args     []string `json:"args"`
+	Streams  bool     `json:"streams,omitempty"`
+	Output   string   `json:"output,omitempty"`
+	Stdout   string   `json:"stdout,omitempty"`
+	Stderr   string   `json:"stderr,omitempty"`
+	Error    string   `json:"error,omitempty"`
+	Kind     string   `json:"kind,omitempty"`
+	ExitCode int      `json:"exit_code,omitempty"`
+	Signal   int      `json:"signal,omitempty"`
+	// Duration is the running time of the command in milliseconds
+	Duration int64 `json:"duration_ms,omitempty"`
+}
+
+type fixture struct {
+	// Comment describes the fixture, like the hand-written ones that were
+	// not recorded from real commands
+	Comment     string       `json:"comment,omitempty"`
+	Invocations []Invocation `json:"invocations"`
+}
+
+// Recorder is a StreamCommander that runs the commands with another Commander
+// and saves each invocation, with its output and error, to a fixture file
+type Recorder struct {
+	commander Commander
+	path      string
+
+	mu      sync.Mutex
+	fixture fixture
+}
+
+// NewRecorder returns a Recorder running the commands with commander and
+// writing the fixture to path
+func NewRecorder(commander Commander, path string) *Recorder {
+	return &Recorder{commander: commander, path: path}
+}
+
+// ExecCommand runs the command and records its combined output
+func (r *Recorder) ExecCommand(ctx context.Context, cmds ...string) (output string, err error) {
+	output, err = r.commander.ExecCommand(ctx, cmds...)
+	return output, r.record(Invocation{Args: Redact(cmds), Output: output}, err)
+}
+
+// ExecCommandStreams runs the command and records its standard output and
+// error, the wrapped Commander is required to be a StreamCommander
+func (r *Recorder) ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error) {
+	if sc, ok := r.commander.(StreamCommander); ok {
+		stdout, stderr, err = sc.ExecCommandStreams(ctx, cmds...)
+	} else {
+		stdout, err = r.commander.ExecCommand(ctx, cmds...)
+	}
+	return stdout, stderr, r.record(Invocation{Args: Redact(cmds), Streams: true, Stdout: stdout, Stderr: stderr}, err)
+}
+
+// record appends the invocation to the fixture file and returns err, the
+// error writing the file is returned instead if there is one. The
+// cancellations are not recorded, they don't come from the commands
+func (r *Recorder) record(inv Invocation, err error) error {
+	if err == context.Canceled {
+		return err
+	}
+	if err != nil {
+		inv.Error = err.Error()
+		var stderr []string
+		switch e := err.(type) {
+		case *CommandError:
+			inv.ExitCode = e.exitCode
+			inv.Signal = int(e.signal)
+			inv.Duration = int64(e.duration / time.Millisecond)
+			inv.Error = e.err.Error()
+			stderr = e.stderr
+		case *ErrTimeout:
+			inv.Kind = timeoutKind
+			inv.ExitCode = -1
+			inv.Signal = int(e.signal)
+			inv.Duration = int64(e.elapsed / time.Millisecond)
+			stderr = e.stderr
+		default:
+			inv.ExitCode = -1
+		}
+		if inv.Stderr == "" && len(stderr) > 0 {
+			inv.Stderr = strings.Join(stderr, "\n") + "\n"
+		}
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fixture.Invocations = append(r.fixture.Invocations, inv)
+	content, writeErr := json.MarshalIndent(r.fixture, "", "  ")
+	if writeErr == nil {
+		writeErr = ioutil.WriteFile(r.path, append(content, '\n'), 0644)
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	return err
+}
+
+// Replayer is a StreamCommander serving the invocations of a fixture file
+// written by a Recorder instead of running the commands. Each recorded
+// invocation is served once, the first unused one matching the command line
+type Replayer struct {
+	path string
+
+	mu          sync.Mutex
+	invocations []Invocation
+	used        []bool
+}
+
+// ErrUnexpectedCommand is returned by the Replayer for the commands that are
+// not recorded in its fixture, or that were already replayed
+type ErrUnexpectedCommand struct {
+	args []string
+	path string
+}
+
+func (e *ErrUnexpectedCommand) Error() string {
+	return fmt.Sprintf(errUnexpectedCommandFmt, strings.Join(e.args, " "), e.path)
+}
+
+// ErrFixture is returned when a fixture file can't be decoded
+type ErrFixture struct {
+	path string
+	msg  string
+}
+
+func (e *ErrFixture) Error() string {
+	return fmt.Sprintf(errFixtureFmt, e.path, e.msg)
+}
+
+// NewReplayer returns a Replayer serving the invocations recorded in path
+func NewReplayer(path string) (*Replayer, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f fixture
+	if err = json.Unmarshal(content, &f); err != nil {
+		return nil, &ErrFixture{path: path, msg: err.Error()}
+	}
+	return &Replayer{path: path, invocations: f.Invocations, used: make([]bool, len(f.Invocations))}, nil
+}
+
+// ExecCommand returns the recorded combined output of the command
+func (r *Replayer) ExecCommand(ctx context.Context, cmds ...string) (string, error) {
+	inv, err := r.next(ctx, cmds)
+	if err != nil {
+		return "", err
+	}
+	output := inv.Output
+	if inv.Streams {
+		output = inv.Stdout + inv.Stderr
+	}
+	return output, inv.err(cmds)
+}
+
+// ExecCommandStreams returns the recorded standard output and error of the
+// command, the output of the commands recorded by ExecCommand is returned as
+// their standard output
+func (r *Replayer) ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error) {
+	inv, err := r.next(ctx, cmds)
+	if err != nil {
+		return "", "", err
+	}
+	if !inv.Streams {
+		return inv.Output, "", inv.err(cmds)
+	}
+	return inv.Stdout, inv.Stderr, inv.err(cmds)
+}
+
+// Unused returns the command lines of the invocations that were not replayed
+func (r *Replayer) Unused() (unused [][]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, inv := range r.invocations {
+		if !r.used[i] {
+			unused = append(unused, inv.Args)
+		}
+	}
+	return
+}
+
+func (r *Replayer) next(ctx context.Context, cmds []string) (*Invocation, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	args := Redact(cmds)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.invocations {
+		if !r.used[i] && matchArgs(r.invocations[i].Args, args) {
+			r.used[i] = true
+			return &r.invocations[i], nil
+		}
+	}
+	return nil, &ErrUnexpectedCommand{args: args, path: r.path}
+}
+
+// err returns the recorded error of the invocation as an error of cmds of the
+// recorded kind, ErrTimeout or CommandError
+func (inv *Invocation) err(cmds []string) error {
+	if inv.Error == "" {
+		return nil
+	}
+	args := Redact(cmds)
+	duration := time.Duration(inv.Duration) * time.Millisecond
+	if inv.Kind == timeoutKind {
+		return &ErrTimeout{
+			command: strings.Join(args, " "),
+			elapsed: duration,
+			signal:  syscall.Signal(inv.Signal),
+			stderr:  lastLines(inv.Stderr, stderrTail),
+		}
+	}
+	return &CommandError{
+		args:     args,
+		exitCode: inv.ExitCode,
+		signal:   syscall.Signal(inv.Signal),
+		duration: duration,
+		stderr:   lastLines(inv.Stderr, stderrTail),
+		err:      errors.New(inv.Error),
+	}
+}
+
+// matchArgs reports whether args match the recorded patterns
+func matchArgs(patterns, args []string) bool {
+	if len(patterns) != len(args) {
+		return false
+	}
+	for i, pattern := range patterns {
+		if pattern == args[i] {
+			continue
+		}
+		if ok, err := path.Match(pattern, args[i]); err != nil || !ok {
+			return false
+		}
+	}
+	return true
+}
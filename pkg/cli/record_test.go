@@ -0,0 +1,218 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&recordSuite{})
+
+type recordSuite struct {
+	fixture string
+}
+
+// fakeStreamCommander returns the output of the commands from a map indexed
+// by the command line, the commands not in the map fail with exit code 2
+type fakeStreamCommander struct {
+	stdout map[string]string
+	stderr map[string]string
+	errs   map[string]error
+	calls  map[string]int
+}
+
+func newFakeStreamCommander() *fakeStreamCommander {
+	return &fakeStreamCommander{
+		stdout: map[string]string{}, stderr: map[string]string{}, errs: map[string]error{}, calls: map[string]int{}}
+}
+
+func (f *fakeStreamCommander) ExecCommand(ctx context.Context, cmds ...string) (string, error) {
+	stdout, stderr, err := f.ExecCommandStreams(ctx, cmds...)
+	return stdout + stderr, err
+}
+
+func (f *fakeStreamCommander) ExecCommandStreams(ctx context.Context, cmds ...string) (string, string, error) {
+	command := strings.Join(cmds, " ")
+	f.calls[command]++
+	if err, ok := f.errs[command]; ok {
+		return "", f.stderr[command], err
+	}
+	stdout, ok := f.stdout[command]
+	if !ok {
+		return "", "unknown command\n", &CommandError{args: Redact(cmds), exitCode: 2,
+			stderr: []string{"unknown command"}, err: errors.New("exit status 2")}
+	}
+	return stdout, f.stderr[command], nil
+}
+
+func (s *recordSuite) SetUpTest(c *check.C) {
+	s.fixture = filepath.Join(c.MkDir(), "fixture.json")
+}
+
+func (s *recordSuite) record(c *check.C, fake *fakeStreamCommander) *Replayer {
+	recorder := NewRecorder(fake, s.fixture)
+	_, err := recorder.ExecCommand(context.Background(), "openstack", "image", "list")
+	c.Assert(err, check.IsNil)
+	_, _, err = recorder.ExecCommandStreams(context.Background(), "openstack", "--os-password", "hunter2", "image", "show", "x")
+	c.Assert(err, check.IsNil)
+	_, err = recorder.ExecCommand(context.Background(), "openstack", "image", "delete", "y")
+	c.Assert(err, check.NotNil)
+
+	replayer, err := NewReplayer(s.fixture)
+	c.Assert(err, check.IsNil)
+	return replayer
+}
+
+func (s *recordSuite) fake() *fakeStreamCommander {
+	fake := newFakeStreamCommander()
+	fake.stdout["openstack image list"] = "| id | name |\n"
+	fake.stdout["openstack --os-password hunter2 image show x"] = "| name | x |\n"
+	fake.stderr["openstack --os-password hunter2 image show x"] = "deprecated\n"
+	return fake
+}
+
+func (s *recordSuite) TestRecorderRunsTheCommands(c *check.C) {
+	fake := s.fake()
+
+	s.record(c, fake)
+
+	c.Assert(fake.calls["openstack image list"], check.Equals, 1)
+	c.Assert(fake.calls["openstack --os-password hunter2 image show x"], check.Equals, 1)
+	c.Assert(fake.calls["openstack image delete y"], check.Equals, 1)
+}
+
+func (s *recordSuite) TestRecorderRedactsSecrets(c *check.C) {
+	s.record(c, s.fake())
+
+	content, err := ioutil.ReadFile(s.fixture)
+	c.Assert(err, check.IsNil)
+	c.Assert(strings.Contains(string(content), "hunter2"), check.Equals, false)
+}
+
+func (s *recordSuite) TestReplayerServesOutput(c *check.C) {
+	fake := s.fake()
+	replayer := s.record(c, fake)
+
+	output, err := replayer.ExecCommand(context.Background(), "openstack", "image", "list")
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "| id | name |\n")
+
+	stdout, stderr, err := replayer.ExecCommandStreams(context.Background(),
+		"openstack", "--os-password", "other", "image", "show", "x")
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "| name | x |\n")
+	c.Assert(stderr, check.Equals, "deprecated\n")
+
+	c.Assert(replayer.Unused(), check.HasLen, 1)
+	c.Assert(fake.calls["openstack image list"], check.Equals, 1)
+}
+
+func (s *recordSuite) TestReplayerServesErrors(c *check.C) {
+	replayer := s.record(c, s.fake())
+
+	_, err := replayer.ExecCommand(context.Background(), "openstack", "image", "delete", "y")
+
+	cmdErr, ok := err.(*CommandError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cmdErr.ExitCode(), check.Equals, 2)
+	c.Assert(cmdErr.Stderr(), check.DeepEquals, []string{"unknown command"})
+	c.Assert(cmdErr.Args(), check.DeepEquals, []string{"openstack", "image", "delete", "y"})
+}
+
+func (s *recordSuite) TestReplayerServesTimeouts(c *check.C) {
+	fake := s.fake()
+	fake.stderr["openstack image create z"] = "uploading\n"
+	fake.errs["openstack image create z"] = &ErrTimeout{command: "openstack image create z",
+		elapsed: 3 * time.Second, signal: syscall.SIGTERM, stderr: []string{"uploading"}}
+	recorder := NewRecorder(fake, s.fixture)
+	_, err := recorder.ExecCommand(context.Background(), "openstack", "image", "create", "z")
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	replayer, err := NewReplayer(s.fixture)
+	c.Assert(err, check.IsNil)
+
+	_, err = replayer.ExecCommand(context.Background(), "openstack", "image", "create", "z")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(err.Error(), check.Equals,
+		`Command "openstack image create z" timed out after 3s, killed by signal terminated, stderr:`+"\nuploading")
+}
+
+func (s *recordSuite) TestReplayerFailsOnUnexpectedCommand(c *check.C) {
+	replayer := s.record(c, s.fake())
+
+	_, err := replayer.ExecCommand(context.Background(), "openstack", "image", "create", "z")
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnexpectedCommand{})
+	c.Assert(err.Error(), check.Equals,
+		`Unexpected command "openstack image create z", it is not recorded in `+s.fixture)
+}
+
+func (s *recordSuite) TestReplayerServesEachInvocationOnce(c *check.C) {
+	replayer := s.record(c, s.fake())
+
+	_, err := replayer.ExecCommand(context.Background(), "openstack", "image", "list")
+	c.Assert(err, check.IsNil)
+	_, err = replayer.ExecCommand(context.Background(), "openstack", "image", "list")
+
+	c.Assert(err, check.FitsTypeOf, &ErrUnexpectedCommand{})
+}
+
+func (s *recordSuite) TestReplayerMatchesPatterns(c *check.C) {
+	err := ioutil.WriteFile(s.fixture, []byte(`{"invocations": [
+  {"args": ["qemu-img", "convert", "/tmp/*/raw.img", "/tmp/*/image.qcow2"], "output": "done"}
+]}`), 0644)
+	c.Assert(err, check.IsNil)
+	replayer, err := NewReplayer(s.fixture)
+	c.Assert(err, check.IsNil)
+
+	output, err := replayer.ExecCommand(context.Background(),
+		"qemu-img", "convert", "/tmp/work123/raw.img", "/tmp/work123/image.qcow2")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "done")
+	c.Assert(replayer.Unused(), check.HasLen, 0)
+}
+
+func (s *recordSuite) TestReplayerHonoursCancellation(c *check.C) {
+	replayer := s.record(c, s.fake())
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := replayer.ExecCommand(ctx, "openstack", "image", "list")
+
+	c.Assert(err, check.Equals, context.Canceled)
+	c.Assert(replayer.Unused(), check.HasLen, 3)
+}
+
+func (s *recordSuite) TestNewReplayerDecodeError(c *check.C) {
+	err := ioutil.WriteFile(s.fixture, []byte("not json"), 0644)
+	c.Assert(err, check.IsNil)
+
+	_, err = NewReplayer(s.fixture)
+
+	c.Assert(err, check.FitsTypeOf, &ErrFixture{})
+}
@@ -0,0 +1,530 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	defaultSSHPort    = "22"
+	sshConnectTimeout = 30 * time.Second
+	errHostKeyFmt     = "The host key of %s doesn't match the one in %s"
+	errSSHConfigFmt   = "Error in the configuration of the build host: %s"
+)
+
+// safeArg matches the arguments that don't need quoting for the remote shell
+var safeArg = regexp.MustCompile(`^[a-zA-Z0-9_@%+=:,./-]+$`)
+
+// sshSignals are the signals reported by the SSH servers, by name
+var sshSignals = map[ssh.Signal]syscall.Signal{
+	ssh.SIGABRT: syscall.SIGABRT, ssh.SIGALRM: syscall.SIGALRM, ssh.SIGFPE: syscall.SIGFPE,
+	ssh.SIGHUP: syscall.SIGHUP, ssh.SIGILL: syscall.SIGILL, ssh.SIGINT: syscall.SIGINT,
+	ssh.SIGKILL: syscall.SIGKILL, ssh.SIGPIPE: syscall.SIGPIPE, ssh.SIGQUIT: syscall.SIGQUIT,
+	ssh.SIGSEGV: syscall.SIGSEGV, ssh.SIGTERM: syscall.SIGTERM, ssh.SIGUSR1: syscall.SIGUSR1,
+	ssh.SIGUSR2: syscall.SIGUSR2,
+}
+
+// SSHConfig is the configuration of an SSHExecutor
+type SSHConfig struct {
+	// Host is the build host as [user@]host[:port], the user defaults to
+	// the local one and the port to 22
+	Host string
+	// KeyFile is the PEM file of the private key of the user
+	KeyFile string
+	// HostKeyFile has the public key of the build host in authorized_keys
+	// format, like its /etc/ssh/ssh_host_*_key.pub files
+	HostKeyFile string
+	// Dir is the directory of the build host under which the local files
+	// are mirrored, each executor uses its own subdirectory
+	Dir string
+	// Mirror are the local directories whose files are mirrored on the
+	// build host when they are arguments of the commands
+	Mirror []string
+	// Artifacts are the patterns of the names of the files produced by the
+	// commands that are copied back, all of them if it is empty
+	Artifacts []string
+	// Timeout and MaxOutput are the ones of Executor
+	Timeout   time.Duration
+	MaxOutput int
+}
+
+// SSHExecutor is a StreamCommander that runs the commands on a build host
+// over SSH. The arguments that are paths in the mirrored directories are
+// replaced by their copies on the host. The existing files are uploaded
+// before the command runs, and the ones produced by a successful command are
+// copied back when they match the artifacts
+type SSHExecutor struct {
+	config SSHConfig
+	client *ssh.Client
+	// root is the directory of the host with the copies of the local files
+	root string
+
+	mu sync.Mutex
+	// onHost are the local paths with an up to date copy on the host
+	onHost map[string]bool
+	dirs   map[string]bool
+	// runs is the number of commands started, it names their pid files
+	runs int
+}
+
+// ErrHostKey is returned when the build host presents an unexpected key
+type ErrHostKey struct {
+	host, file string
+}
+
+func (e *ErrHostKey) Error() string {
+	return fmt.Sprintf(errHostKeyFmt, e.host, e.file)
+}
+
+// ErrSSHConfig is returned for invalid SSHConfig values
+type ErrSSHConfig struct {
+	msg string
+}
+
+func (e *ErrSSHConfig) Error() string {
+	return fmt.Sprintf(errSSHConfigFmt, e.msg)
+}
+
+// NewSSHExecutor connects to the build host of config and returns an
+// SSHExecutor running the commands there, it must be closed after use
+func NewSSHExecutor(config *SSHConfig) (*SSHExecutor, error) {
+	if config.Dir == "" || !path.IsAbs(config.Dir) {
+		return nil, &ErrSSHConfig{msg: "the directory of the build host must be an absolute path"}
+	}
+	user, addr := splitHost(config.Host)
+	signer, err := readSigner(config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	hostKey, err := readHostKey(config.HostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	clientConfig := &ssh.ClientConfig{
+		User: user,
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if !bytes.Equal(key.Marshal(), hostKey.Marshal()) {
+				return &ErrHostKey{host: hostname, file: config.HostKeyFile}
+			}
+			return nil
+		},
+	}
+	conn, err := net.DialTimeout("tcp", addr, sshConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	sshConn, chans, reqs, err := ssh.NewClientConn(conn, addr, clientConfig)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	id := make([]byte, 8)
+	if _, err = rand.Read(id); err != nil {
+		sshConn.Close()
+		return nil, err
+	}
+	e := &SSHExecutor{config: *config, client: ssh.NewClient(sshConn, chans, reqs),
+		root: path.Join(config.Dir, hex.EncodeToString(id)), onHost: map[string]bool{}, dirs: map[string]bool{}}
+	e.config.Mirror = make([]string, len(config.Mirror))
+	for i, dir := range config.Mirror {
+		e.config.Mirror[i] = filepath.Clean(dir)
+	}
+	return e, nil
+}
+
+// splitHost returns the user and the address of a [user@]host[:port] string
+func splitHost(host string) (user, addr string) {
+	if n := strings.LastIndex(host, "@"); n >= 0 {
+		user, host = host[:n], host[n+1:]
+	} else {
+		user = os.Getenv("USER")
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(host, defaultSSHPort)
+	}
+	return user, host
+}
+
+func readSigner(keyFile string) (ssh.Signer, error) {
+	content, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.ParsePrivateKey(content)
+}
+
+func readHostKey(hostKeyFile string) (ssh.PublicKey, error) {
+	content, err := ioutil.ReadFile(hostKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	key, _, _, _, err := ssh.ParseAuthorizedKey(content)
+	return key, err
+}
+
+// ExecCommand runs the command on the build host and returns its output, with
+// the standard output and error interleaved
+func (e *SSHExecutor) ExecCommand(ctx context.Context, cmds ...string) (output string, err error) {
+	out, err := e.run(ctx, cmds)
+	if out != nil {
+		output = out.combined.String()
+	}
+	return
+}
+
+// ExecCommandStreams runs the command on the build host and returns its
+// standard output and error apart. They are logged and capped like the ones
+// of Executor. The command runs in its own process group, which is sent
+// SIGTERM from another session when ctx is done or the timeout is exceeded,
+// and SIGKILL if it is still running after the grace period
+func (e *SSHExecutor) ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error) {
+	out, err := e.run(ctx, cmds)
+	if out != nil {
+		stdout, stderr = out.stdout.String(), out.stderr.String()
+	}
+	return
+}
+
+// Close removes the copies of the local files from the build host and closes
+// the connection
+func (e *SSHExecutor) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), sshConnectTimeout)
+	defer cancel()
+	err := e.do(ctx, "rm -rf "+shellQuote(e.root), nil, nil)
+	if closeErr := e.client.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (e *SSHExecutor) run(ctx context.Context, cmds []string) (out *output, err error) {
+	if e.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, e.config.Timeout)
+		defer cancel()
+	}
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	args, produced, err := e.prepare(ctx, cmds)
+	if err != nil {
+		return nil, WrapError(cmds, err)
+	}
+	maxOutput := e.config.MaxOutput
+	if maxOutput == 0 {
+		maxOutput = DefaultMaxOutput
+	}
+	out = newOutput(filepath.Base(cmds[0]), maxOutput)
+
+	start := now()
+	pidFile := e.pidFile()
+	session, done, err := e.start(groupCommand(pidFile, remoteCommand(args)), nil, out.stdoutWriter, out.stderrWriter)
+	if err != nil {
+		return out, NewCommandError(cmds, err)
+	}
+	defer session.Close()
+
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = e.killGroup(session, pidFile, done)
+		out.flush()
+		return out, killedError(ctx, newSSHCommandError(cmds, err), now().Sub(start), out)
+	}
+	out.flush()
+	if err != nil {
+		commandErr := newSSHCommandError(cmds, err)
+		commandErr.duration = now().Sub(start).Round(time.Millisecond)
+		commandErr.stderr = lastLines(out.stderr.String(), stderrTail)
+		return out, commandErr
+	}
+	return out, WrapError(cmds, e.fetch(ctx, produced))
+}
+
+// pidFile returns the path of the host where the process group id of a new
+// command is written
+func (e *SSHExecutor) pidFile() string {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.runs++
+	return path.Join(e.root, "pids", strconv.Itoa(e.runs))
+}
+
+// groupCommand returns the shell command running command in a process group
+// of its own, whose id is written to pidFile. sshd neither forwards the signal
+// requests before 7.9 nor kills the commands without a pty when their session
+// is closed, so the group is killed from another session. sshd already makes
+// the shell a group leader, setsid is only run for the servers that don't, as
+// it would fork and hide the signal that killed the command otherwise
+func groupCommand(pidFile, command string) string {
+	return fmt.Sprintf(`mkdir -p %s && if [ "$(ps -o pgid= -p $$)" -eq $$ ]; then echo $$ > %s && exec %s; `+
+		`else exec setsid sh -c 'echo $$ > "$0" && exec "$@"' %s %s; fi`,
+		shellQuote(path.Dir(pidFile)), shellQuote(pidFile), command, shellQuote(pidFile), command)
+}
+
+// killGroup terminates the process group of the command started in session,
+// whose id is in pidFile, and kills it if it is still running after
+// killGrace. The session is closed if the command outlives that by another
+// killGrace. It returns the result of the command
+func (e *SSHExecutor) killGroup(session *ssh.Session, pidFile string, done <-chan error) error {
+	for _, signal := range []string{"TERM", "KILL"} {
+		e.signalGroup(signal, pidFile)
+		select {
+		case err := <-done:
+			return err
+		case <-after(killGrace):
+		}
+	}
+	session.Close()
+	return <-done
+}
+
+// signalGroup sends signal to the process group whose id is in pidFile
+func (e *SSHExecutor) signalGroup(signal, pidFile string) {
+	ctx, cancel := context.WithTimeout(context.Background(), sshConnectTimeout)
+	defer cancel()
+	if err := e.do(ctx, fmt.Sprintf("kill -s %s -- -$(cat %s)", signal, shellQuote(pidFile)), nil, nil); err != nil {
+		log.Debugf("Could not send SIG%s to the command on the build host: %v", signal, err)
+	}
+}
+
+// prepare returns the arguments of the command on the build host, with the
+// mirrored paths replaced, and the local paths that the command may produce.
+// The mirrored files are uploaded and the directories created on the host
+func (e *SSHExecutor) prepare(ctx context.Context, cmds []string) (args, produced []string, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	args = append([]string{}, cmds...)
+	var dirs, uploads []string
+	for i, arg := range cmds {
+		if !e.mirrored(arg) {
+			continue
+		}
+		local := filepath.Clean(arg)
+		args[i] = e.remotePath(local)
+		dir := filepath.Dir(local)
+		info, statErr := os.Stat(local)
+		switch {
+		case statErr == nil && info.IsDir():
+			dir = local
+		case statErr == nil && !e.onHost[local]:
+			uploads = append(uploads, local)
+		case os.IsNotExist(statErr) && !e.onHost[local]:
+			produced = append(produced, local)
+		}
+		if !e.dirs[dir] {
+			dirs = append(dirs, dir)
+		}
+	}
+	if len(dirs) > 0 {
+		mkdir := []string{"mkdir", "-p"}
+		for _, dir := range dirs {
+			mkdir = append(mkdir, e.remotePath(dir))
+		}
+		if err = e.do(ctx, remoteCommand(mkdir), nil, nil); err != nil {
+			return nil, nil, err
+		}
+		for _, dir := range dirs {
+			e.dirs[dir] = true
+		}
+	}
+	for _, local := range uploads {
+		if err = e.upload(ctx, local); err != nil {
+			return nil, nil, err
+		}
+		e.onHost[local] = true
+	}
+	return args, produced, nil
+}
+
+// fetch copies back the files produced on the host that match the artifacts,
+// the others are only used by the following commands
+func (e *SSHExecutor) fetch(ctx context.Context, produced []string) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, local := range produced {
+		if err := e.do(ctx, "test -f "+shellQuote(e.remotePath(local)), nil, nil); err != nil {
+			if _, ok := err.(*ssh.ExitError); ok {
+				continue
+			}
+			return err
+		}
+		e.onHost[local] = true
+		if !e.isArtifact(local) {
+			continue
+		}
+		log.Debugf("Copying %s back from the build host", local)
+		if err := e.download(ctx, local); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *SSHExecutor) upload(ctx context.Context, local string) error {
+	log.Debugf("Copying %s to the build host", local)
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return e.do(ctx, "cat > "+shellQuote(e.remotePath(local)), f, nil)
+}
+
+// download writes the copy of the host to a partial file first, so that an
+// interrupted copy doesn't leave a truncated artifact
+func (e *SSHExecutor) download(ctx context.Context, local string) error {
+	partial := local + ".partial"
+	f, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	err = e.do(ctx, "cat "+shellQuote(e.remotePath(local)), nil, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(partial)
+		return err
+	}
+	return os.Rename(partial, local)
+}
+
+// do runs an auxiliary command on the host, its session is closed when ctx is
+// done
+func (e *SSHExecutor) do(ctx context.Context, command string, stdin io.Reader, stdout io.Writer) error {
+	var stderr bytes.Buffer
+	session, done, err := e.start(command, stdin, stdout, &stderr)
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		session.Close()
+		<-done
+		return ctx.Err()
+	}
+	if err != nil && stderr.Len() > 0 {
+		log.Debugf("%s: %s", command, strings.TrimSpace(stderr.String()))
+	}
+	return err
+}
+
+// start opens a session running command and returns a channel receiving the
+// result of the command
+func (e *SSHExecutor) start(command string, stdin io.Reader, stdout, stderr io.Writer) (*ssh.Session, <-chan error, error) {
+	session, err := e.client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	session.Stdin, session.Stdout, session.Stderr = stdin, stdout, stderr
+	if err = session.Start(command); err != nil {
+		session.Close()
+		return nil, nil, err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Wait()
+	}()
+	return session, done, nil
+}
+
+// mirrored reports whether arg is a path in one of the mirrored directories
+func (e *SSHExecutor) mirrored(arg string) bool {
+	if !filepath.IsAbs(arg) {
+		return false
+	}
+	arg = filepath.Clean(arg)
+	for _, dir := range e.config.Mirror {
+		if arg == dir || strings.HasPrefix(arg, dir+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *SSHExecutor) isArtifact(local string) bool {
+	if len(e.config.Artifacts) == 0 {
+		return true
+	}
+	for _, pattern := range e.config.Artifacts {
+		if ok, _ := filepath.Match(pattern, filepath.Base(local)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *SSHExecutor) remotePath(local string) string {
+	return path.Join(e.root, filepath.ToSlash(local))
+}
+
+// newSSHCommandError returns the CommandError of a command that failed on
+// the build host
+func newSSHCommandError(cmds []string, err error) *CommandError {
+	e := &CommandError{args: Redact(cmds), exitCode: -1, err: err}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		if exitErr.Signal() == "" {
+			e.exitCode = exitErr.ExitStatus()
+		} else {
+			e.signal = sshSignals[ssh.Signal(exitErr.Signal())]
+		}
+	}
+	return e
+}
+
+// remoteCommand returns the command line for the shell of the host
+func remoteCommand(cmds []string) string {
+	quoted := make([]string, len(cmds))
+	for i, arg := range cmds {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes arg for a POSIX shell
+func shellQuote(arg string) string {
+	if safeArg.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.Replace(arg, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,410 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&sshSuite{})
+
+// sshSuite runs the commands against an in-process SSH server, which runs
+// them locally with sh. Like stock sshd, it runs the shell in a new session,
+// ignores the signal requests and doesn't kill the commands when their
+// session is closed
+type sshSuite struct {
+	listener    net.Listener
+	keyFile     string
+	hostKeyFile string
+	wrongKey    string
+	mu          sync.Mutex
+	commands    []string
+	// noSetsid makes the server run the shell in its own process group
+	noSetsid bool
+	mirror   string
+	hostDir  string
+}
+
+func (s *sshSuite) SetUpSuite(c *check.C) {
+	dir := c.MkDir()
+	hostSigner, hostPub := s.newKey(c, filepath.Join(dir, "host"))
+	_, clientPub := s.newKey(c, filepath.Join(dir, "client"))
+	s.keyFile = filepath.Join(dir, "client")
+	s.hostKeyFile = filepath.Join(dir, "host.pub")
+	s.newKey(c, filepath.Join(dir, "wrong"))
+	s.wrongKey = filepath.Join(dir, "wrong.pub")
+	c.Assert(ioutil.WriteFile(s.hostKeyFile, ssh.MarshalAuthorizedKey(hostPub), 0644), check.IsNil)
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "builder" && bytes.Equal(key.Marshal(), clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	go s.serve(config)
+}
+
+func (s *sshSuite) TearDownSuite(c *check.C) {
+	s.listener.Close()
+}
+
+func (s *sshSuite) SetUpTest(c *check.C) {
+	s.mu.Lock()
+	s.commands = nil
+	s.noSetsid = false
+	s.mu.Unlock()
+	s.mirror = c.MkDir()
+	s.hostDir = c.MkDir()
+}
+
+// newKey writes a new private key to path and its public key to path.pub
+func (s *sshSuite) newKey(c *check.C, path string) (ssh.Signer, ssh.PublicKey) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	c.Assert(err, check.IsNil)
+	content := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	c.Assert(ioutil.WriteFile(path, content, 0600), check.IsNil)
+	signer, err := ssh.ParsePrivateKey(content)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(path+".pub", ssh.MarshalAuthorizedKey(signer.PublicKey()), 0644), check.IsNil)
+	return signer, signer.PublicKey()
+}
+
+func (s *sshSuite) serve(config *ssh.ServerConfig) {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			_, chans, reqs, err := ssh.NewServerConn(conn, config)
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(reqs)
+			for newChannel := range chans {
+				if newChannel.ChannelType() != "session" {
+					newChannel.Reject(ssh.UnknownChannelType, "only sessions")
+					continue
+				}
+				channel, requests, err := newChannel.Accept()
+				if err != nil {
+					continue
+				}
+				go s.session(channel, requests)
+			}
+		}()
+	}
+}
+
+// session runs the command of an exec request
+func (s *sshSuite) session(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+	for req := range requests {
+		switch req.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(req.Payload, &payload)
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			setsid := !s.noSetsid
+			s.mu.Unlock()
+			cmd := exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin, cmd.Stdout, cmd.Stderr = channel, channel, channel.Stderr()
+			cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: setsid}
+			req.Reply(cmd.Start() == nil, nil)
+			go func() {
+				cmd.Wait()
+				status := cmd.ProcessState.Sys().(syscall.WaitStatus)
+				if status.Signaled() {
+					name := strings.TrimPrefix(signalNames[status.Signal()], "SIG")
+					channel.SendRequest("exit-signal", false, ssh.Marshal(&struct {
+						Signal     string
+						CoreDumped bool
+						Error      string
+						Lang       string
+					}{Signal: name}))
+				} else {
+					channel.SendRequest("exit-status", false, ssh.Marshal(&struct{ Status uint32 }{uint32(status.ExitStatus())}))
+				}
+				channel.Close()
+			}()
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+var signalNames = map[syscall.Signal]string{syscall.SIGTERM: "SIGTERM", syscall.SIGKILL: "SIGKILL"}
+
+// received returns the commands received by the server
+func (s *sshSuite) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.commands...)
+}
+
+func (s *sshSuite) newExecutor(c *check.C, config *SSHConfig) *SSHExecutor {
+	if config == nil {
+		config = &SSHConfig{}
+	}
+	config.Host = "builder@" + s.listener.Addr().String()
+	config.KeyFile = s.keyFile
+	if config.HostKeyFile == "" {
+		config.HostKeyFile = s.hostKeyFile
+	}
+	config.Dir = s.hostDir
+	config.Mirror = []string{s.mirror}
+	e, err := NewSSHExecutor(config)
+	c.Assert(err, check.IsNil)
+	return e
+}
+
+func (s *sshSuite) TestExecCommandRunsOnHost(c *check.C) {
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	output, err := e.ExecCommand(context.Background(), "echo", "it's", "remote")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "it's remote\n")
+	c.Assert(strings.Contains(s.received()[0], `exec echo 'it'\''s' remote;`), check.Equals, true)
+}
+
+func (s *sshSuite) TestExecCommandStreamsKeepsStreamsApart(c *check.C) {
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	stdout, stderr, err := e.ExecCommandStreams(context.Background(), "sh", "-c", "echo out; echo err >&2")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(stdout, check.Equals, "out\n")
+	c.Assert(stderr, check.Equals, "err\n")
+}
+
+func (s *sshSuite) TestExecCommandReturnsCommandError(c *check.C) {
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "sh", "-c", "echo failed >&2; exit 3", "--password", "hunter2")
+
+	cmdErr, ok := err.(*CommandError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cmdErr.ExitCode(), check.Equals, 3)
+	c.Assert(cmdErr.Stderr(), check.DeepEquals, []string{"failed"})
+	c.Assert(strings.Contains(cmdErr.Error(), "hunter2"), check.Equals, false)
+}
+
+func (s *sshSuite) TestExecCommandReturnsSignal(c *check.C) {
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "sh", "-c", "kill -KILL $$")
+
+	cmdErr, ok := err.(*CommandError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cmdErr.Signal(), check.Equals, syscall.SIGKILL)
+	c.Assert(cmdErr.ExitCode(), check.Equals, -1)
+}
+
+func (s *sshSuite) TestExecCommandTimeout(c *check.C) {
+	e := s.newExecutor(c, &SSHConfig{Timeout: 100 * time.Millisecond})
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "sleep", "10")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+}
+
+func (s *sshSuite) TestExecCommandTimeoutKillsProcessGroup(c *check.C) {
+	e := s.newExecutor(c, &SSHConfig{Timeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	output, err := e.ExecCommand(context.Background(), "sh", "-c", "sleep 3600 & echo $!; wait")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	pid, convErr := strconv.Atoi(strings.TrimSpace(output))
+	c.Assert(convErr, check.IsNil)
+	assertProcessGone(c, pid)
+}
+
+func (s *sshSuite) TestExecCommandTimeoutKillsProcessGroupWithoutSetsid(c *check.C) {
+	s.mu.Lock()
+	s.noSetsid = true
+	s.mu.Unlock()
+	e := s.newExecutor(c, &SSHConfig{Timeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	output, err := e.ExecCommand(context.Background(), "sh", "-c", "sleep 3600 & echo $!; wait")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	pid, convErr := strconv.Atoi(strings.TrimSpace(output))
+	c.Assert(convErr, check.IsNil)
+	assertProcessGone(c, pid)
+}
+
+func (s *sshSuite) TestExecCommandKillsAfterGrace(c *check.C) {
+	backAfter := after
+	defer func() { after = backAfter }()
+	after = func(time.Duration) <-chan time.Time { return time.After(100 * time.Millisecond) }
+	e := s.newExecutor(c, &SSHConfig{Timeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "sh", "-c", "trap '' TERM; sleep 3600")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(err.(*ErrTimeout).Signal(), check.Equals, syscall.SIGKILL)
+}
+
+func (s *sshSuite) TestExecCommandTimeoutKeepsStderr(c *check.C) {
+	e := s.newExecutor(c, &SSHConfig{Timeout: 500 * time.Millisecond})
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "sh", "-c", "echo waiting >&2; sleep 10")
+
+	c.Assert(err, check.FitsTypeOf, &ErrTimeout{})
+	c.Assert(err.(*ErrTimeout).Stderr(), check.DeepEquals, []string{"waiting"})
+}
+
+func (s *sshSuite) TestExecCommandUploadsMirroredFiles(c *check.C) {
+	input := filepath.Join(s.mirror, "in", "input.snap")
+	c.Assert(os.MkdirAll(filepath.Dir(input), 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(input, []byte("snap"), 0644), check.IsNil)
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	output, err := e.ExecCommand(context.Background(), "cat", input)
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, "snap")
+	_, err = e.ExecCommand(context.Background(), "cat", input)
+	c.Assert(err, check.IsNil)
+
+	content, err := ioutil.ReadFile(filepath.Join(e.root, input))
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "snap")
+	uploads := 0
+	for _, command := range s.received() {
+		if strings.HasPrefix(command, "cat > ") {
+			uploads++
+		}
+	}
+	c.Assert(uploads, check.Equals, 1)
+}
+
+func (s *sshSuite) TestExecCommandCopiesArtifactsBack(c *check.C) {
+	input := filepath.Join(s.mirror, "input.snap")
+	raw := filepath.Join(s.mirror, "udf.raw")
+	img := filepath.Join(s.mirror, "udf.img")
+	c.Assert(ioutil.WriteFile(input, []byte("snap"), 0644), check.IsNil)
+	e := s.newExecutor(c, &SSHConfig{Artifacts: []string{"*.img"}})
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "cp", input, raw)
+	c.Assert(err, check.IsNil)
+	_, err = e.ExecCommand(context.Background(), "cp", raw, img)
+	c.Assert(err, check.IsNil)
+
+	_, err = os.Stat(raw)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	content, err := ioutil.ReadFile(img)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "snap")
+}
+
+func (s *sshSuite) TestExecCommandDoesNotMirrorOtherPaths(c *check.C) {
+	e := s.newExecutor(c, nil)
+	defer e.Close()
+
+	_, err := e.ExecCommand(context.Background(), "test", "-d", s.hostDir)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.received(), check.HasLen, 1)
+}
+
+func (s *sshSuite) TestCloseRemovesHostFiles(c *check.C) {
+	input := filepath.Join(s.mirror, "input.snap")
+	c.Assert(ioutil.WriteFile(input, []byte("snap"), 0644), check.IsNil)
+	e := s.newExecutor(c, nil)
+	_, err := e.ExecCommand(context.Background(), "cat", input)
+	c.Assert(err, check.IsNil)
+
+	c.Assert(e.Close(), check.IsNil)
+
+	_, err = os.Stat(e.root)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *sshSuite) TestNewSSHExecutorRejectsUnknownHostKey(c *check.C) {
+	_, err := NewSSHExecutor(&SSHConfig{Host: "builder@" + s.listener.Addr().String(),
+		KeyFile: s.keyFile, HostKeyFile: s.wrongKey, Dir: s.hostDir})
+
+	c.Assert(err, check.ErrorMatches, ".*The host key of .* doesn't match the one in "+s.wrongKey)
+}
+
+func (s *sshSuite) TestNewSSHExecutorRequiresAbsoluteDir(c *check.C) {
+	_, err := NewSSHExecutor(&SSHConfig{Host: "builder@" + s.listener.Addr().String(),
+		KeyFile: s.keyFile, HostKeyFile: s.hostKeyFile, Dir: "relative"})
+
+	c.Assert(err, check.FitsTypeOf, &ErrSSHConfig{})
+}
+
+func (s *sshSuite) TestSplitHost(c *check.C) {
+	os.Setenv("USER", "local")
+	for _, t := range []struct{ host, user, addr string }{
+		{"builder@example.com", "builder", "example.com:22"},
+		{"builder@example.com:2222", "builder", "example.com:2222"},
+		{"example.com", "local", "example.com:22"},
+	} {
+		user, addr := splitHost(t.host)
+		c.Check(user, check.Equals, t.user)
+		c.Check(addr, check.Equals, t.addr)
+	}
+}
+
+func (s *sshSuite) TestShellQuote(c *check.C) {
+	c.Assert(remoteCommand([]string{"qemu-img", "-o", "compat=1.1", "/tmp/a b", "it's", ""}),
+		check.Equals, `qemu-img -o compat=1.1 '/tmp/a b' 'it'\''s' ''`)
+}
@@ -0,0 +1,119 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"bytes"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// maxLine is the length after which a line without end is logged anyway
+const maxLine = 4096
+
+var debugf = log.Debugf
+
+// cappedBuffer keeps the last max bytes written to it, all of them if max is
+// negative
+type cappedBuffer struct {
+	max       int
+	buf       []byte
+	truncated bool
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if over := len(b.buf) - b.max; b.max >= 0 && over > 0 {
+		b.buf = b.buf[:copy(b.buf, b.buf[over:])]
+		b.truncated = true
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) String() string {
+	return string(b.buf)
+}
+
+// output collects the standard output and error of a command, written from
+// different goroutines
+type output struct {
+	mu                         sync.Mutex
+	name                       string
+	stdout, stderr, combined   *cappedBuffer
+	stdoutWriter, stderrWriter *lineWriter
+}
+
+func newOutput(name string, max int) *output {
+	o := &output{name: name, stdout: &cappedBuffer{max: max}, stderr: &cappedBuffer{max: max},
+		combined: &cappedBuffer{max: max}}
+	o.stdoutWriter = &lineWriter{out: o, stream: "stdout", kept: o.stdout}
+	o.stderrWriter = &lineWriter{out: o, stream: "stderr", kept: o.stderr}
+	return o
+}
+
+// flush logs the last lines without end and warns about truncated streams
+func (o *output) flush() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for _, w := range []*lineWriter{o.stdoutWriter, o.stderrWriter} {
+		w.logLine()
+		if w.kept.truncated {
+			log.Warnf("The %s of %s exceeded %d bytes, only the last ones are kept", w.stream, o.name, w.kept.max)
+		}
+	}
+}
+
+// lineWriter is the writer of one stream of a command, it logs each line as
+// it is completed
+type lineWriter struct {
+	out    *output
+	stream string
+	kept   *cappedBuffer
+	line   []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.out.mu.Lock()
+	defer w.out.mu.Unlock()
+	n := len(p)
+	w.kept.Write(p)
+	w.out.combined.Write(p)
+	for len(p) > 0 {
+		end := bytes.IndexByte(p, '\n')
+		if end < 0 {
+			w.line = append(w.line, p...)
+			if len(w.line) >= maxLine {
+				w.logLine()
+			}
+			break
+		}
+		w.line = append(w.line, p[:end]...)
+		w.logLine()
+		p = p[end+1:]
+	}
+	return n, nil
+}
+
+func (w *lineWriter) logLine() {
+	if len(w.line) > 0 {
+		debugf("%s %s: %s", w.out.name, w.stream, bytes.TrimRight(w.line, "\r"))
+	}
+	w.line = w.line[:0]
+}
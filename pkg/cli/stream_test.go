@@ -0,0 +1,109 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2015 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&streamSuite{})
+
+type streamSuite struct {
+	backDebugf func(string, ...interface{})
+	lines      []string
+}
+
+func (s *streamSuite) SetUpSuite(c *check.C) {
+	s.backDebugf = debugf
+	debugf = s.fakeDebugf
+}
+
+func (s *streamSuite) TearDownSuite(c *check.C) {
+	debugf = s.backDebugf
+}
+
+func (s *streamSuite) SetUpTest(c *check.C) {
+	s.lines = nil
+}
+
+func (s *streamSuite) fakeDebugf(format string, args ...interface{}) {
+	s.lines = append(s.lines, fmt.Sprintf(format, args...))
+}
+
+func (s *streamSuite) TestCappedBufferKeepsLastBytes(c *check.C) {
+	b := &cappedBuffer{max: 5}
+
+	b.Write([]byte("abc"))
+	c.Assert(b.String(), check.Equals, "abc")
+	c.Assert(b.truncated, check.Equals, false)
+
+	b.Write([]byte("defg"))
+	c.Assert(b.String(), check.Equals, "cdefg")
+	c.Assert(b.truncated, check.Equals, true)
+
+	b.Write([]byte("0123456789"))
+	c.Assert(b.String(), check.Equals, "56789")
+}
+
+func (s *streamSuite) TestCappedBufferWithoutLimit(c *check.C) {
+	b := &cappedBuffer{max: -1}
+
+	b.Write([]byte(strings.Repeat("a", 10000)))
+
+	c.Assert(len(b.String()), check.Equals, 10000)
+	c.Assert(b.truncated, check.Equals, false)
+}
+
+func (s *streamSuite) TestOutputLogsLinesOfEachStream(c *check.C) {
+	out := newOutput("udf", 100)
+
+	out.stdoutWriter.Write([]byte("first li"))
+	out.stderrWriter.Write([]byte("warning\r\n"))
+	out.stdoutWriter.Write([]byte("ne\nsecond line\n\nlast"))
+	out.flush()
+
+	c.Assert(s.lines, check.DeepEquals, []string{
+		"udf stderr: warning",
+		"udf stdout: first line",
+		"udf stdout: second line",
+		"udf stdout: last",
+	})
+	c.Assert(out.stdout.String(), check.Equals, "first line\nsecond line\n\nlast")
+	c.Assert(out.stderr.String(), check.Equals, "warning\r\n")
+	c.Assert(out.combined.String(), check.Equals, "first liwarning\r\nne\nsecond line\n\nlast")
+}
+
+func (s *streamSuite) TestOutputLogsLongLinesInPieces(c *check.C) {
+	out := newOutput("udf", -1)
+
+	out.stdoutWriter.Write([]byte(strings.Repeat("a", maxLine+10)))
+	out.flush()
+
+	c.Assert(s.lines, check.DeepEquals, []string{"udf stdout: " + strings.Repeat("a", maxLine+10)})
+
+	s.lines = nil
+	out = newOutput("udf", -1)
+	out.stdoutWriter.Write([]byte(strings.Repeat("a", maxLine)))
+	out.stdoutWriter.Write([]byte("bc\n"))
+
+	c.Assert(s.lines, check.DeepEquals, []string{"udf stdout: " + strings.Repeat("a", maxLine), "udf stdout: bc"})
+}
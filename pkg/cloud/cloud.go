@@ -24,7 +24,9 @@ package cloud
 
 import (
 	"bufio"
+	"context"
 	"fmt"
+	"path/filepath"
 	"sort"
 	"strconv"
 	"strings"
@@ -32,9 +34,11 @@ import (
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/manifest"
 )
 
 const (
@@ -43,6 +47,19 @@ const (
 	imageNameSufix         = "disk1.img"
 	errVerNotFoundPattern  = "Version not found for release %s, channel %s and arch %s"
 	imageListCmd           = "openstack image list --property status=active"
+	checksumProperty       = "sha256"
+	manifestProperty       = "manifest"
+	archProperty           = "architecture"
+	machineTypeProperty    = "hw_machine_type"
+	contentIDProperty      = "content_id"
+	revisionPropertyFmt    = "%s_revision"
+	manifestContainer      = "snappy-cloud-image-manifests"
+	manifestObjectSufix    = ".manifest.json"
+)
+
+var (
+	verifyChecksum = image.VerifyChecksum
+	readManifest   = manifest.Read
 )
 
 // Client is the implementation of Clouder that interacts with the provider
@@ -71,8 +88,8 @@ func (e *ErrVersionNotFound) Error() string {
 
 // GetLatestVersion returns the highest version of the custom images for the given
 // release, channel and arch, -1 if none is found, and the eventual error
-func (c *Client) GetLatestVersion(options *flags.Options) (ver int, err error) {
-	imageIDs, err := c.extractVersionsFromList(*options)
+func (c *Client) GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error) {
+	imageIDs, err := c.extractVersionsFromList(ctx, *options)
 	if err != nil {
 		return 0, err
 	}
@@ -84,22 +101,103 @@ func (c *Client) GetLatestVersion(options *flags.Options) (ver int, err error) {
 }
 
 // Create makes the call to create the new image given a file path with the local image
-// and the required bits for making up the image name
-func (c *Client) Create(path string, options *flags.Options, version int) (err error) {
+// and the required bits for making up the image name. The checksum of the file is
+// verified before the upload and stored as a property of the image. The build manifest
+// next to the file is uploaded to the object store, and its location stored as another
+// property. The architecture and machine type properties come from the arch profile,
+// and the revisions of the os, kernel and gadget snaps are stored as <type>_revision
+func (c *Client) Create(ctx context.Context, path string, options *flags.Options, version int) (err error) {
+	profile, err := arch.Get(options.Arch)
+	if err != nil {
+		return
+	}
+	digest, err := verifyChecksum(path)
+	if err != nil {
+		return
+	}
+	manifestPath := filepath.Join(filepath.Dir(path), manifest.FileName)
+	m, err := readManifest(manifestPath)
+	if err != nil {
+		return
+	}
 	imageID := GetImageID(options, version)
 
-	log.Debugf("Creating image %s from file %s", imageID, path)
+	object := manifestObject(imageID)
+	log.Debugf("Uploading manifest %s to %s/%s", manifestPath, manifestContainer, object)
+	if err = c.exec(ctx, "openstack", "container", "create", manifestContainer); err != nil {
+		return
+	}
+	if err = c.exec(ctx, "openstack", "object", "create", "--name", object, manifestContainer, manifestPath); err != nil {
+		return
+	}
 
-	_, err = c.cli.ExecCommand("openstack", "image", "create", "--disk-format", "qcow2", "--file", path, imageID)
+	log.Debugf("Creating image %s from file %s with %s %s", imageID, path, checksumProperty, digest)
+
+	cmds := []string{"openstack", "image", "create", "--disk-format", "qcow2", "--file", path,
+		"--property", checksumProperty + "=" + digest,
+		"--property", manifestProperty + "=" + manifestContainer + "/" + object,
+		"--property", archProperty + "=" + profile.CloudArch,
+		"--property", machineTypeProperty + "=" + profile.QemuMachine}
+	if m.ContentID != "" {
+		cmds = append(cmds, "--property", contentIDProperty+"="+m.ContentID)
+	}
+	for _, snap := range m.Snaps {
+		if snap.Type != manifest.TypeExtra {
+			cmds = append(cmds, "--property", fmt.Sprintf(revisionPropertyFmt, snap.Type)+"="+strconv.Itoa(snap.Revision))
+		}
+	}
+	if options.DiskSize > 0 {
+		cmds = append(cmds, "--min-disk", strconv.Itoa(options.DiskSize))
+	}
+	err = c.exec(ctx, append(cmds, imageID)...)
+	if err != nil {
+		// the manifest is removed even when ctx was cancelled
+		c.deleteManifest(context.Background(), imageID)
+	}
 	return
 }
 
+// FindContent returns the newest image for the given release, channel and arch
+// with the given content identity, or an empty string if there is none
+func (c *Client) FindContent(ctx context.Context, options *flags.Options, contentID string) (imageID string, err error) {
+	opts := *options
+	opts.Release = removeDot(opts.Release)
+	var imageIDs sort.StringSlice
+	imageIDs, err = c.getImageList(ctx, imgTemplate(&opts), "--property", contentIDProperty+"="+contentID)
+	if err != nil || len(imageIDs) == 0 {
+		return
+	}
+	sort.Sort(sort.Reverse(imageIDs[:]))
+	return imageIDs[0], nil
+}
+
+// GetManifest saves to path the build manifest of the given image
+func (c *Client) GetManifest(ctx context.Context, imageID, path string) (err error) {
+	return c.exec(ctx, "openstack", "object", "save", "--file", path, manifestContainer, manifestObject(imageID))
+}
+
+func (c *Client) deleteManifest(ctx context.Context, imageID string) {
+	if err := c.exec(ctx, "openstack", "object", "delete", manifestContainer, manifestObject(imageID)); err != nil {
+		log.Warnf("Could not delete the manifest of %s: %v", imageID, err)
+	}
+}
+
+// exec runs the given command, its failures are returned as cli.CommandError
+func (c *Client) exec(ctx context.Context, cmds ...string) error {
+	_, err := c.cli.ExecCommand(ctx, cmds...)
+	return cli.WrapError(cmds, err)
+}
+
+func manifestObject(imageID string) string {
+	return imageID + manifestObjectSufix
+}
+
 // extractVersionsFromList returns a list of image names that match the given
 // release, channel and arch sorted in descendant version number order
-func (c *Client) extractVersionsFromList(options flags.Options) ([]string, error) {
+func (c *Client) extractVersionsFromList(ctx context.Context, options flags.Options) ([]string, error) {
 	options.Release = removeDot(options.Release)
 	var imageIDs sort.StringSlice
-	imageIDs, err := c.getImageList(imgTemplate(&options))
+	imageIDs, err := c.getImageList(ctx, imgTemplate(&options))
 	if err != nil {
 		return imageIDs, err
 	}
@@ -110,16 +208,18 @@ func (c *Client) extractVersionsFromList(options flags.Options) ([]string, error
 	return []string{}, NewErrVersionNotFound(&options)
 }
 
-// getImageList returns a list of image IDs that match a given pattern
-func (c *Client) getImageList(pattern string) (imagelist []string, err error) {
+// getImageList returns a list of image IDs that match a given pattern, filters are
+// extra arguments for the image list command
+func (c *Client) getImageList(ctx context.Context, pattern string, filters ...string) (imagelist []string, err error) {
 	/* list is of the form:
 	| 08763be0-3b3d-41e3-b5b0-08b9006fc1d7 | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-build0-loader |
 	| 842949c6-225b-4ad0-81b7-98de2b818eed | smoser-lucid-loader/lucid-amd64-linux-image-2.6.32-34-virtual-v-2.6.32-34.77~smloader0-kernel        |
 	| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/custom/ubuntu-1504-snappy-core-amd64-edge-202-disk1.img                                  |
 	*/
-	list, err := c.cli.ExecCommand(strings.Fields(imageListCmd)...)
+	cmds := append(strings.Fields(imageListCmd), filters...)
+	list, err := cli.Stdout(ctx, c.cli, cmds...)
 	if err != nil {
-		return []string{}, err
+		return []string{}, cli.WrapError(cmds, err)
 	}
 
 	reader := strings.NewReader(list)
@@ -167,28 +267,33 @@ func GetImageID(options *flags.Options, version int) (name string) {
 	return fmt.Sprintf("%s-%s-%s", imageNamePrefix, finalVersion, imageNameSufix)
 }
 
-// Delete calls the cli command to remove the given images
-func (c *Client) Delete(images ...string) (err error) {
-	_, err = c.cli.ExecCommand(append([]string{"openstack", "image", "delete"}, images...)...)
+// Delete calls the cli command to remove the given images, and their manifests
+func (c *Client) Delete(ctx context.Context, images ...string) (err error) {
+	if err = c.exec(ctx, append([]string{"openstack", "image", "delete"}, images...)...); err != nil {
+		return
+	}
+	for _, imageID := range images {
+		c.deleteManifest(ctx, imageID)
+	}
 	return
 }
 
 // GetVersions returns a descending ordered list (newer first) of image names for the given parameters
-func (c *Client) GetVersions(options *flags.Options) (imageNames []string, err error) {
-	return c.extractVersionsFromList(*options)
+func (c *Client) GetVersions(ctx context.Context, options *flags.Options) (imageNames []string, err error) {
+	return c.extractVersionsFromList(ctx, *options)
 }
 
 // Purge asks the glance endpoint to remove all the custom images present.
 // Use with care! For example it can be useful when deploying a new jenkins,
 // the instances from images created with the previous one won't be accessible
 // any more
-func (c *Client) Purge(options *flags.Options) error {
+func (c *Client) Purge(ctx context.Context, options *flags.Options) error {
 	imageName := fmt.Sprintf(baseImageName, options.ImageType)
-	images, err := c.getImageList(imageName)
+	images, err := c.getImageList(ctx, imageName)
 	if err != nil {
 		return err
 	}
-	return c.Delete(images...)
+	return c.Delete(ctx, images...)
 }
 
 func removeDot(in string) string {
@@ -20,14 +20,19 @@
 package cloud
 
 import (
+	"context"
 	"fmt"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
 
 	"gopkg.in/check.v1"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/manifest"
 )
 
 const (
@@ -36,6 +41,7 @@ const (
 	testDefaultArch      = "amd64"
 	testDefaultImageType = "custom"
 	testImageVersion     = 198
+	testDigest           = "mydigest"
 	baseCompleteResponse = `| 06c12690-08ef-4a9b-aaa6-6e8249bcfef8 | ubuntu-released/ubuntu-oneiric-11.10-amd64-server-20130509-disk1.img                                 |
 | 8fa0213b-e598-473f-bb33-901281063395 | smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003                                          |
 | 56e4a037-887f-4e8c-8e9f-edad2060232b | smoser-cloud-images/ubuntu-hardy-8.04-amd64-server-20121003-ramdisk                                  |
@@ -58,25 +64,52 @@ const (
 )
 
 type cloudSuite struct {
-	subject        *Client
-	cli            *fakeCliCommander
-	defaultOptions *flags.Options
+	subject             *Client
+	cli                 *fakeCliCommander
+	defaultOptions      *flags.Options
+	backVerifyChecksum  func(string) (string, error)
+	backReadManifest    func(string) (*manifest.Manifest, error)
+	verifyChecksumCalls map[string]int
+	readManifestCalls   map[string]int
+	checksumErr         bool
+	manifestErr         bool
+	contentID           string
+	snaps               []manifest.Snap
 }
 
 type fakeCliCommander struct {
 	execCommandCalls map[string]int
 	output           string
+	outputs          map[string]string
 	err              bool
 }
 
-func (f *fakeCliCommander) ExecCommand(cmds ...string) (output string, err error) {
-	f.execCommandCalls[strings.Join(cmds, " ")]++
+func (f *fakeCliCommander) ExecCommand(ctx context.Context, cmds ...string) (output string, err error) {
+	call := strings.Join(cmds, " ")
+	f.execCommandCalls[call]++
+	if err = ctx.Err(); err != nil {
+		return
+	}
 	if f.err {
 		err = fmt.Errorf("exec error")
 	}
+	if output, ok := f.outputs[call]; ok {
+		return output, err
+	}
 	return f.output, err
 }
 
+// fakeStreamCommander keeps the standard error of the commands apart
+type fakeStreamCommander struct {
+	*fakeCliCommander
+	stderr string
+}
+
+func (f *fakeStreamCommander) ExecCommandStreams(ctx context.Context, cmds ...string) (stdout, stderr string, err error) {
+	stdout, err = f.ExecCommand(ctx, cmds...)
+	return stdout, f.stderr, err
+}
+
 var _ = check.Suite(&cloudSuite{})
 
 func Test(t *testing.T) { check.TestingT(t) }
@@ -84,6 +117,31 @@ func Test(t *testing.T) { check.TestingT(t) }
 func (s *cloudSuite) SetUpSuite(c *check.C) {
 	s.cli = &fakeCliCommander{}
 	s.subject = NewClient(s.cli)
+	s.backVerifyChecksum = verifyChecksum
+	verifyChecksum = s.fakeVerifyChecksum
+	s.backReadManifest = readManifest
+	readManifest = s.fakeReadManifest
+}
+
+func (s *cloudSuite) TearDownSuite(c *check.C) {
+	verifyChecksum = s.backVerifyChecksum
+	readManifest = s.backReadManifest
+}
+
+func (s *cloudSuite) fakeReadManifest(path string) (*manifest.Manifest, error) {
+	s.readManifestCalls[path]++
+	if s.manifestErr {
+		return nil, fmt.Errorf("manifest error")
+	}
+	return &manifest.Manifest{ContentID: s.contentID, Snaps: s.snaps}, nil
+}
+
+func (s *cloudSuite) fakeVerifyChecksum(path string) (string, error) {
+	s.verifyChecksumCalls[path]++
+	if s.checksumErr {
+		return "", fmt.Errorf("checksum error")
+	}
+	return testDigest, nil
 }
 
 func (s *cloudSuite) SetUpTest(c *check.C) {
@@ -97,11 +155,18 @@ func (s *cloudSuite) SetUpTest(c *check.C) {
 	}
 	s.cli.execCommandCalls = make(map[string]int)
 	s.cli.output = fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, testImageVersion))
+	s.cli.outputs = make(map[string]string)
 	s.cli.err = false
+	s.snaps = nil
+	s.verifyChecksumCalls = make(map[string]int)
+	s.checksumErr = false
+	s.readManifestCalls = make(map[string]int)
+	s.manifestErr = false
+	s.contentID = ""
 }
 
 func (s *cloudSuite) TestGetLatestVersionQueriesGlance(c *check.C) {
-	s.subject.GetLatestVersion(s.defaultOptions)
+	s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(s.cli.execCommandCalls["openstack image list --property status=active"], check.Equals, 1)
 }
@@ -131,7 +196,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsTheLatestVersion(c *check.C) {
 	}
 	for _, item := range testCases {
 		s.cli.output = item.glanceOutput
-		ver, _ := s.subject.GetLatestVersion(s.defaultOptions)
+		ver, _ := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 		c.Check(ver, check.Equals, item.expectedVersion)
 	}
@@ -140,7 +205,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsTheLatestVersion(c *check.C) {
 func (s *cloudSuite) TestGetLatestVersionReturnsGlanceError(c *check.C) {
 	s.cli.err = true
 
-	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.NotNil)
 }
@@ -148,7 +213,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsGlanceError(c *check.C) {
 func (s *cloudSuite) TestGetLatestVersionReturnsVersionNumberError(c *check.C) {
 	s.cli.output = "| 762d5ce2-fbc2-4685-8d6c-71249d19df9e | ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-10f-disk1.img |"
 
-	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err, check.FitsTypeOf, &strconv.NumError{})
@@ -157,7 +222,7 @@ func (s *cloudSuite) TestGetLatestVersionReturnsVersionNumberError(c *check.C) {
 func (s *cloudSuite) TestGetLatestVersionReturnsVersionNotFoundError(c *check.C) {
 	s.cli.output = fmt.Sprintf(baseCompleteResponse, "", "", "", "")
 
-	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.FitsTypeOf, &ErrVersionNotFound{})
 	c.Assert(err.Error(), check.Equals,
@@ -169,7 +234,7 @@ func (s *cloudSuite) TestGetLatestVersionRemovesDotFromRelease(c *check.C) {
 	s.defaultOptions.Release = "1604"
 	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, expectedVersion))
 	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
-	version, _ := s.subject.GetLatestVersion(s.defaultOptions)
+	version, _ := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(version, check.Equals, expectedVersion)
 }
@@ -177,24 +242,189 @@ func (s *cloudSuite) TestGetLatestVersionRemovesDotFromRelease(c *check.C) {
 func (s *cloudSuite) TestCreateCallsGlance(c *check.C) {
 	path := "mypath"
 	version := 100
-	err := s.subject.Create(path, s.defaultOptions, version)
+	err := s.subject.Create(context.Background(), path, s.defaultOptions, version)
 
 	c.Assert(err, check.IsNil)
 
 	imageName := getImageID(s.defaultOptions, version)
-	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file %s %s", path, imageName)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file %s --property sha256=%s --property manifest=%s/%s --property architecture=x86_64 --property hw_machine_type=pc %s",
+		path, testDigest, manifestContainer, manifestObject(imageName), imageName)
+
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateHonoursContext(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := s.subject.Create(ctx, "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.Equals, context.Canceled)
+	imageName := getImageID(s.defaultOptions, 100)
+	for call := range s.cli.execCommandCalls {
+		c.Assert(strings.HasSuffix(call, imageName), check.Equals, false)
+	}
+}
+
+func (s *cloudSuite) TestCreateSetsArchProperties(c *check.C) {
+	s.defaultOptions.Arch = "arm64"
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
 
+	c.Assert(err, check.IsNil)
+	imageName := getImageID(s.defaultOptions, 100)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file mypath --property sha256=%s --property manifest=%s/%s --property architecture=aarch64 --property hw_machine_type=virt %s",
+		testDigest, manifestContainer, manifestObject(imageName), imageName)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateSetsMinDisk(c *check.C) {
+	s.defaultOptions.DiskSize = 10
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.IsNil)
+	imageName := getImageID(s.defaultOptions, 100)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file mypath --property sha256=%s --property manifest=%s/%s --property architecture=x86_64 --property hw_machine_type=pc --min-disk 10 %s",
+		testDigest, manifestContainer, manifestObject(imageName), imageName)
 	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
 }
 
+func (s *cloudSuite) TestCreateSetsContentID(c *check.C) {
+	s.contentID = "mycontentid"
+
+	err := s.subject.Create(context.Background(), filepath.Join("mydir", "mypath"), s.defaultOptions, 100)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.readManifestCalls[filepath.Join("mydir", manifest.FileName)], check.Equals, 1)
+	imageName := getImageID(s.defaultOptions, 100)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file mydir/mypath --property sha256=%s --property manifest=%s/%s --property architecture=x86_64 --property hw_machine_type=pc --property content_id=mycontentid %s",
+		testDigest, manifestContainer, manifestObject(imageName), imageName)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateSetsSnapRevisions(c *check.C) {
+	s.snaps = []manifest.Snap{
+		{Name: "ubuntu-core", Type: manifest.TypeOS, Revision: 10},
+		{Name: "canonical-pc-linux", Type: manifest.TypeKernel, Revision: 20},
+		{Name: "canonical-pc", Type: manifest.TypeGadget, Revision: 30},
+		{Name: "hello", Type: manifest.TypeExtra, Revision: 40},
+	}
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.IsNil)
+	imageName := getImageID(s.defaultOptions, 100)
+	expectedCall := fmt.Sprintf("openstack image create --disk-format qcow2 --file mypath --property sha256=%s --property manifest=%s/%s --property architecture=x86_64 --property hw_machine_type=pc --property os_revision=10 --property kernel_revision=20 --property gadget_revision=30 %s",
+		testDigest, manifestContainer, manifestObject(imageName), imageName)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateReturnsManifestReadError(c *check.C) {
+	s.manifestErr = true
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(len(s.cli.execCommandCalls), check.Equals, 0)
+}
+
+func (s *cloudSuite) TestFindContentQueriesGlanceByContentID(c *check.C) {
+	olderLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, 100))
+	newerLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, 101))
+	otherArchOptions := *s.defaultOptions
+	otherArchOptions.Arch = "arm64"
+	otherArchLine := fmt.Sprintf(baseResponse, getImageID(&otherArchOptions, 102))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, olderLine, newerLine, otherArchLine, "")
+
+	imageID, err := s.subject.FindContent(context.Background(), s.defaultOptions, "mycontentid")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(imageID, check.Equals, getImageID(s.defaultOptions, 101))
+	c.Assert(s.cli.execCommandCalls["openstack image list --property status=active --property content_id=mycontentid"], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestFindContentReturnsEmptyWithoutMatches(c *check.C) {
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, "", "", "", "")
+
+	imageID, err := s.subject.FindContent(context.Background(), s.defaultOptions, "mycontentid")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(imageID, check.Equals, "")
+}
+
+func (s *cloudSuite) TestFindContentReturnsGlanceError(c *check.C) {
+	s.cli.err = true
+
+	_, err := s.subject.FindContent(context.Background(), s.defaultOptions, "mycontentid")
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cloudSuite) TestCreateReturnsUnknownArchError(c *check.C) {
+	s.defaultOptions.Arch = "myarch"
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.FitsTypeOf, &arch.ErrUnknown{})
+	c.Assert(len(s.cli.execCommandCalls), check.Equals, 0)
+}
+
+func (s *cloudSuite) TestCreateUploadsManifest(c *check.C) {
+	path := filepath.Join("mydir", "mypath")
+	version := 100
+
+	err := s.subject.Create(context.Background(), path, s.defaultOptions, version)
+
+	c.Assert(err, check.IsNil)
+	imageName := getImageID(s.defaultOptions, version)
+	expectedCall := fmt.Sprintf("openstack object create --name %s %s %s",
+		manifestObject(imageName), manifestContainer, filepath.Join("mydir", manifest.FileName))
+	c.Assert(s.cli.execCommandCalls["openstack container create "+manifestContainer], check.Equals, 1)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestGetManifestSavesObject(c *check.C) {
+	err := s.subject.GetManifest(context.Background(), "myimage", "mypath")
+
+	c.Assert(err, check.IsNil)
+	expectedCall := fmt.Sprintf("openstack object save --file mypath %s myimage%s", manifestContainer, manifestObjectSufix)
+	c.Assert(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestGetManifestReturnsCliError(c *check.C) {
+	s.cli.err = true
+
+	err := s.subject.GetManifest(context.Background(), "myimage", "mypath")
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *cloudSuite) TestCreateVerifiesChecksum(c *check.C) {
+	path := "mypath"
+
+	s.subject.Create(context.Background(), path, s.defaultOptions, 100)
+
+	c.Assert(s.verifyChecksumCalls[path], check.Equals, 1)
+}
+
+func (s *cloudSuite) TestCreateDoesNotCallGlanceOnChecksumError(c *check.C) {
+	s.checksumErr = true
+
+	err := s.subject.Create(context.Background(), "mypath", s.defaultOptions, 100)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(len(s.cli.execCommandCalls), check.Equals, 0)
+}
+
 func (s *cloudSuite) TestCreateReturnsError(c *check.C) {
 	s.cli.err = true
 
 	path := "mypath"
 	version := 100
-	err := s.subject.Create(path, s.defaultOptions, version)
+	err := s.subject.Create(context.Background(), path, s.defaultOptions, version)
 
-	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, &cli.CommandError{})
 }
 
 func (s *cloudSuite) TestGetImageID(c *check.C) {
@@ -247,17 +477,28 @@ func (s *cloudSuite) TestDeleteCallsCli(c *check.C) {
 		{[]string{"version2", "version1", "version3", "version4"}, "openstack image delete version2 version1 version3 version4"},
 	}
 	for _, item := range testCases {
-		s.subject.Delete(item.images...)
+		s.subject.Delete(context.Background(), item.images...)
 		c.Assert(s.cli.execCommandCalls[item.expectedCall], check.Equals, 1)
 	}
 }
 
+func (s *cloudSuite) TestDeleteRemovesManifests(c *check.C) {
+	err := s.subject.Delete(context.Background(), "image1", "image2")
+
+	c.Assert(err, check.IsNil)
+	for _, image := range []string{"image1", "image2"} {
+		expectedCall := fmt.Sprintf("openstack object delete %s %s", manifestContainer, manifestObject(image))
+		c.Check(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
+	}
+}
+
 func (s *cloudSuite) TestDeleteReturnsCliError(c *check.C) {
 	s.cli.err = true
 
-	err := s.subject.Delete("image1", "image2")
+	err := s.subject.Delete(context.Background(), "image1", "image2")
 
-	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, &cli.CommandError{})
+	c.Assert(err.(*cli.CommandError).Args(), check.DeepEquals, []string{"openstack", "image", "delete", "image1", "image2"})
 }
 
 func (s *cloudSuite) TestGetVersionsReturnsImageNames(c *check.C) {
@@ -288,25 +529,38 @@ func (s *cloudSuite) TestGetVersionsReturnsImageNames(c *check.C) {
 	}
 	for _, item := range testCases {
 		s.cli.output = item.glanceOutput
-		imageList, _ := s.subject.GetVersions(s.defaultOptions)
+		imageList, _ := s.subject.GetVersions(context.Background(), s.defaultOptions)
 
 		c.Check(testEq(imageList, item.expectedImageNames), check.Equals, true)
 	}
 }
 
 func (s *cloudSuite) TestGetVersionsQueriesGlance(c *check.C) {
-	_, err := s.subject.GetVersions(s.defaultOptions)
+	_, err := s.subject.GetVersions(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.IsNil)
 	c.Assert(s.cli.execCommandCalls[imageListCmd], check.Equals, 1)
 }
 
+func (s *cloudSuite) TestGetVersionsIgnoresStandardError(c *check.C) {
+	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, 100))
+	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
+	warningLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, 200))
+	subject := NewClient(&fakeStreamCommander{fakeCliCommander: s.cli, stderr: warningLine})
+
+	list, err := subject.GetVersions(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(list, check.DeepEquals, []string{getIDFromGlanceResponse(versionLine)})
+}
+
 func (s *cloudSuite) TestGetVersionsReturnsGlanceError(c *check.C) {
 	s.cli.err = true
 
-	_, err := s.subject.GetVersions(s.defaultOptions)
+	_, err := s.subject.GetVersions(context.Background(), s.defaultOptions)
 
-	c.Assert(err, check.NotNil)
+	c.Assert(err, check.FitsTypeOf, &cli.CommandError{})
+	c.Assert(err.Error(), check.Equals, `Command "`+imageListCmd+`" failed: exec error`)
 }
 
 func (s *cloudSuite) TestGetLatestVersionsRemovesDotFromRelease(c *check.C) {
@@ -314,7 +568,7 @@ func (s *cloudSuite) TestGetLatestVersionsRemovesDotFromRelease(c *check.C) {
 	s.defaultOptions.Release = "1604"
 	versionLine := fmt.Sprintf(baseResponse, getImageID(s.defaultOptions, version))
 	s.cli.output = fmt.Sprintf(baseCompleteResponse, versionLine, "", "", "")
-	list, _ := s.subject.GetVersions(s.defaultOptions)
+	list, _ := s.subject.GetVersions(context.Background(), s.defaultOptions)
 
 	expected := getIDFromGlanceResponse(versionLine)
 
@@ -322,14 +576,14 @@ func (s *cloudSuite) TestGetLatestVersionsRemovesDotFromRelease(c *check.C) {
 }
 
 func (s *cloudSuite) TestPurgeCallsCliForListing(c *check.C) {
-	s.subject.Purge(s.defaultOptions)
+	s.subject.Purge(context.Background(), s.defaultOptions)
 
 	c.Assert(s.cli.execCommandCalls[imageListCmd], check.Equals, 1)
 }
 
 func (s *cloudSuite) TestPurgeReturnsListingError(c *check.C) {
 	s.cli.err = true
-	err := s.subject.Purge(s.defaultOptions)
+	err := s.subject.Purge(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.NotNil)
 }
@@ -371,7 +625,7 @@ func (s *cloudSuite) TestPurgeCallsCliForDeleting(c *check.C) {
 	for _, item := range testCases {
 		s.cli.output = item.glanceOutput
 
-		s.subject.Purge(s.defaultOptions)
+		s.subject.Purge(context.Background(), s.defaultOptions)
 
 		expectedCall := strings.Join(append([]string{"openstack image delete"}, item.expectedImageNames...), " ")
 		c.Check(s.cli.execCommandCalls[expectedCall], check.Equals, 1)
@@ -383,7 +637,7 @@ func (s *cloudSuite) TestPurgeReturnsCliError(c *check.C) {
 
 	imgID := getImageID(s.defaultOptions, testImageVersion)
 	unexpectedCall := "openstack image delete " + imgID
-	err := s.subject.Purge(s.defaultOptions)
+	err := s.subject.Purge(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(s.cli.execCommandCalls[unexpectedCall], check.Equals, 0)
@@ -393,7 +647,7 @@ func (s *cloudSuite) TestExtractVersionsFromListDoNotModifyRelease(c *check.C) {
 	expectedRelease := "15.04"
 	s.defaultOptions.Release = expectedRelease
 
-	s.subject.extractVersionsFromList(*s.defaultOptions)
+	s.subject.extractVersionsFromList(context.Background(), *s.defaultOptions)
 
 	c.Assert(s.defaultOptions.Release, check.Equals, expectedRelease)
 }
@@ -436,3 +690,29 @@ func getVersionFromImageID(imageID string) string {
 	parts := strings.Split(imageID, "-")
 	return parts[7]
 }
+
+func (s *cloudSuite) TestPurgeReplaysRecordedSession(c *check.C) {
+	replayer, err := cli.NewReplayer(filepath.Join("testdata", "purge.json"))
+	c.Assert(err, check.IsNil)
+	subject := NewClient(replayer)
+
+	err = subject.Purge(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(replayer.Unused(), check.HasLen, 0)
+}
+
+func (s *cloudSuite) TestGetManifestReplaysRecordedError(c *check.C) {
+	replayer, err := cli.NewReplayer(filepath.Join("testdata", "get-manifest-error.json"))
+	c.Assert(err, check.IsNil)
+	subject := NewClient(replayer)
+	imageID := "ubuntu-core/custom/ubuntu-rolling-snappy-core-amd64-edge-202-disk1.img"
+
+	err = subject.GetManifest(context.Background(), imageID, "/tmp/workspace123/manifest.json")
+
+	cmdErr, ok := err.(*cli.CommandError)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(cmdErr.ExitCode(), check.Equals, 1)
+	c.Assert(cmdErr.Stderr(), check.DeepEquals, []string{"Not Found (HTTP 404)"})
+	c.Assert(replayer.Unused(), check.HasLen, 0)
+}
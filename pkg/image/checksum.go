@@ -0,0 +1,201 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	// ChecksumFileName is the name of the file written next to each built
+	// image with its SHA256 digest
+	ChecksumFileName = "SHA256SUMS"
+	// SignatureFileName is the name of the detached signature of ChecksumFileName
+	SignatureFileName = ChecksumFileName + ".gpg"
+
+	errChecksumMismatchFmt = "Checksum mismatch for %s, expected %s, got %s"
+	errChecksumNotFoundFmt = "No checksum found for %s in %s"
+	errNoSigningKeyFmt     = "No usable private key found in %s"
+)
+
+// ErrChecksumMismatch is the error returned when the digest of a file doesn't
+// match the one recorded in its checksum file
+type ErrChecksumMismatch struct {
+	path, expected, actual string
+}
+
+func (e *ErrChecksumMismatch) Error() string {
+	return fmt.Sprintf(errChecksumMismatchFmt, e.path, e.expected, e.actual)
+}
+
+// ErrChecksumNotFound is the error returned when the checksum file doesn't
+// have an entry for a given file
+type ErrChecksumNotFound struct {
+	path, sumsPath string
+}
+
+func (e *ErrChecksumNotFound) Error() string {
+	return fmt.Sprintf(errChecksumNotFoundFmt, e.path, e.sumsPath)
+}
+
+// ErrNoSigningKey is the error returned when the given keyring doesn't contain
+// an unencrypted private key
+type ErrNoSigningKey struct {
+	keyPath string
+}
+
+func (e *ErrNoSigningKey) Error() string {
+	return fmt.Sprintf(errNoSigningKeyFmt, e.keyPath)
+}
+
+// WriteChecksum computes the SHA256 digest of the file in path and writes it to
+// a SHA256SUMS file in the same directory, returning the path of the checksum file
+func WriteChecksum(path string) (sumsPath string, err error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return
+	}
+	sumsPath = filepath.Join(filepath.Dir(path), ChecksumFileName)
+	content := fmt.Sprintf("%s *%s\n", digest, filepath.Base(path))
+	return sumsPath, ioutil.WriteFile(sumsPath, []byte(content), 0644)
+}
+
+// VerifyChecksum computes again the SHA256 digest of the file in path and checks it
+// against the one recorded in the SHA256SUMS file of the same directory, the digest
+// is returned when both match
+func VerifyChecksum(path string) (digest string, err error) {
+	sumsPath := filepath.Join(filepath.Dir(path), ChecksumFileName)
+	expected, err := readChecksum(sumsPath, filepath.Base(path))
+	if err != nil {
+		return
+	}
+	digest, err = fileDigest(path)
+	if err != nil {
+		return
+	}
+	if digest != expected {
+		return "", &ErrChecksumMismatch{path: path, expected: expected, actual: digest}
+	}
+	return
+}
+
+// SignChecksum makes a detached armored OpenPGP signature of the checksum file in
+// sumsPath with the first private key found in the armored keyring at keyPath, and
+// returns the path of the signature file
+func SignChecksum(sumsPath, keyPath string) (sigPath string, err error) {
+	signer, err := readSigningKey(keyPath)
+	if err != nil {
+		return
+	}
+	sums, err := os.Open(sumsPath)
+	if err != nil {
+		return
+	}
+	defer sums.Close()
+
+	sigPath = filepath.Join(filepath.Dir(sumsPath), SignatureFileName)
+	sig, err := os.Create(sigPath)
+	if err != nil {
+		return
+	}
+	defer sig.Close()
+
+	return sigPath, openpgp.ArmoredDetachSign(sig, signer, sums, nil)
+}
+
+func readSigningKey(keyPath string) (*openpgp.Entity, error) {
+	keyFile, err := os.Open(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	defer keyFile.Close()
+
+	entities, err := openpgp.ReadArmoredKeyRing(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, entity := range entities {
+		if entity.PrivateKey != nil && !entity.PrivateKey.Encrypted {
+			return entity, nil
+		}
+	}
+	return nil, &ErrNoSigningKey{keyPath: keyPath}
+}
+
+func readChecksum(sumsPath, fileName string) (digest string, err error) {
+	sums, err := os.Open(sumsPath)
+	if err != nil {
+		return
+	}
+	defer sums.Close()
+
+	scanner := bufio.NewScanner(sums)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == fileName {
+			return fields[0], nil
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	return "", &ErrChecksumNotFound{path: fileName, sumsPath: sumsPath}
+}
+
+func fileDigest(path string) (digest string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// snapFileDigest returns the SHA512 digest of the given snap file, the same one
+// reported by the store, and its size
+func snapFileDigest(path string) (digest string, size int64, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	hash := sha512.New()
+	if size, err = io.Copy(hash, file); err != nil {
+		return
+	}
+	return hex.EncodeToString(hash.Sum(nil)), size, nil
+}
@@ -0,0 +1,166 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/check.v1"
+)
+
+const testImageContent = "this is the image content"
+
+var _ = check.Suite(&checksumSuite{})
+
+type checksumSuite struct {
+	dir, imagePath string
+}
+
+func (s *checksumSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.imagePath = filepath.Join(s.dir, outputFileName)
+	err := ioutil.WriteFile(s.imagePath, []byte(testImageContent), 0644)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *checksumSuite) TestWriteChecksumWritesSumsFile(c *check.C) {
+	sumsPath, err := WriteChecksum(s.imagePath)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(sumsPath, check.Equals, filepath.Join(s.dir, ChecksumFileName))
+
+	content, err := ioutil.ReadFile(sumsPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, testDigest(testImageContent)+" *"+outputFileName+"\n")
+}
+
+func (s *checksumSuite) TestWriteChecksumReturnsMissingFileError(c *check.C) {
+	_, err := WriteChecksum(filepath.Join(s.dir, "missing"))
+
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *checksumSuite) TestSnapFileDigestReturnsSHA512AndSize(c *check.C) {
+	digest, size, err := snapFileDigest(s.imagePath)
+
+	c.Assert(err, check.IsNil)
+	expected := sha512.Sum512([]byte(testImageContent))
+	c.Assert(digest, check.Equals, hex.EncodeToString(expected[:]))
+	c.Assert(size, check.Equals, int64(len(testImageContent)))
+}
+
+func (s *checksumSuite) TestVerifyChecksumReturnsDigest(c *check.C) {
+	_, err := WriteChecksum(s.imagePath)
+	c.Assert(err, check.IsNil)
+
+	digest, err := VerifyChecksum(s.imagePath)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(digest, check.Equals, testDigest(testImageContent))
+}
+
+func (s *checksumSuite) TestVerifyChecksumReturnsMismatchError(c *check.C) {
+	_, err := WriteChecksum(s.imagePath)
+	c.Assert(err, check.IsNil)
+	err = ioutil.WriteFile(s.imagePath, []byte("tampered"), 0644)
+	c.Assert(err, check.IsNil)
+
+	_, err = VerifyChecksum(s.imagePath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrChecksumMismatch{})
+}
+
+func (s *checksumSuite) TestVerifyChecksumReturnsNotFoundError(c *check.C) {
+	sumsPath := filepath.Join(s.dir, ChecksumFileName)
+	err := ioutil.WriteFile(sumsPath, []byte(testDigest("")+" *another.img\n"), 0644)
+	c.Assert(err, check.IsNil)
+
+	_, err = VerifyChecksum(s.imagePath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrChecksumNotFound{})
+}
+
+func (s *checksumSuite) TestSignChecksumMakesVerifiableSignature(c *check.C) {
+	entity, keyPath := s.writeTestKey(c)
+	sumsPath, err := WriteChecksum(s.imagePath)
+	c.Assert(err, check.IsNil)
+
+	sigPath, err := SignChecksum(sumsPath, keyPath)
+	c.Assert(err, check.IsNil)
+	c.Assert(sigPath, check.Equals, filepath.Join(s.dir, SignatureFileName))
+
+	sums, err := os.Open(sumsPath)
+	c.Assert(err, check.IsNil)
+	defer sums.Close()
+	sig, err := os.Open(sigPath)
+	c.Assert(err, check.IsNil)
+	defer sig.Close()
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{entity}, sums, sig)
+	c.Assert(err, check.IsNil)
+	c.Assert(signer.PrimaryKey.KeyId, check.Equals, entity.PrimaryKey.KeyId)
+}
+
+func (s *checksumSuite) TestSignChecksumReturnsNoSigningKeyError(c *check.C) {
+	entity, _ := s.writeTestKey(c)
+	keyPath := filepath.Join(s.dir, "public.asc")
+	keyFile, err := os.Create(keyPath)
+	c.Assert(err, check.IsNil)
+	w, err := armor.Encode(keyFile, openpgp.PublicKeyType, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(entity.Serialize(w), check.IsNil)
+	w.Close()
+	keyFile.Close()
+	sumsPath, err := WriteChecksum(s.imagePath)
+	c.Assert(err, check.IsNil)
+
+	_, err = SignChecksum(sumsPath, keyPath)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoSigningKey{})
+}
+
+func (s *checksumSuite) writeTestKey(c *check.C) (*openpgp.Entity, string) {
+	entity, err := openpgp.NewEntity("test", "", "test@example.com", nil)
+	c.Assert(err, check.IsNil)
+
+	keyPath := filepath.Join(s.dir, "private.asc")
+	keyFile, err := os.Create(keyPath)
+	c.Assert(err, check.IsNil)
+	defer keyFile.Close()
+
+	w, err := armor.Encode(keyFile, openpgp.PrivateKeyType, nil)
+	c.Assert(err, check.IsNil)
+	c.Assert(entity.SerializePrivate(w, nil), check.IsNil)
+	c.Assert(w.Close(), check.IsNil)
+
+	return entity, keyPath
+}
+
+func testDigest(content string) string {
+	digest := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(digest[:])
+}
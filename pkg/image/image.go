@@ -23,19 +23,23 @@
 package image
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
-	"github.com/ubuntu-core/snappy/progress"
 	"github.com/ubuntu-core/snappy/snap"
-	"github.com/ubuntu-core/snappy/store"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/manifest"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
 )
 
 const (
@@ -43,35 +47,67 @@ const (
 	outputFileName     = "udf.img"
 	errRepoDetailFmt   = "Could not get details of snap with name %s, developer %s and channel %s"
 	errRepoDownloadFmt = "Could not download snap with name %s, developer %s and channel %s"
+	errRepoVerifyFmt   = "Could not verify snap with name %s, developer %s and channel %s: %s"
+	errRepoPinFmt      = "Could not pin snap with name %s and channel %s to revision %d"
+	errReleasePinFmt   = "The snap revisions can't be pinned on release %s"
+	errExtraSnapFmt    = "Invalid extra snap %s, expected name[=channel][@revision]"
+	errDiskSizeFmt     = "Disk size of %dGB is smaller than the %d bytes required by the image contents"
+)
+
+// DefaultDiskSize is the size in GB of the images made by ubuntu-device-flash
+// when no size is given
+const DefaultDiskSize = 4
+
+// Artifacts are the patterns of the names of the files written by the commands
+// of UDFQcow2 that are used after them, the others are intermediate
+var Artifacts = []string{outputFileName}
+
+var (
+	writeChecksum = WriteChecksum
+	signChecksum  = SignChecksum
+	readLock      = manifest.ReadLock
+	snapDigest    = snapFileDigest
+	writeManifest = func(m *manifest.Manifest, path string) error { return m.Write(path) }
+	// diskOverhead is the space taken by the partition table, the boot partition
+	// and the filesystem metadata, on top of the snaps
+	diskOverhead int64 = 512 << 20
 )
 
 // Pollster holds the methods for querying an image backend
 type Pollster interface {
-	GetLatestVersion(options *flags.Options) (ver int, err error)
+	GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error)
 }
 
 // FullPollster is a Pollster that knows how to get a list of Versions too
 type FullPollster interface {
 	Pollster
-	GetVersions(options *flags.Options) (images []string, err error)
+	GetVersions(ctx context.Context, options *flags.Options) (images []string, err error)
 }
 
 // PollsterWriter is a Pollster that can also create and delete images
 type PollsterWriter interface {
 	FullPollster
-	Create(filePath string, options *flags.Options, version int) (err error)
-	Delete(images ...string) (err error)
-	Purge(options *flags.Options) (err error)
+	Create(ctx context.Context, filePath string, options *flags.Options, version int) (err error)
+	Delete(ctx context.Context, images ...string) (err error)
+	Purge(ctx context.Context, options *flags.Options) (err error)
+	GetManifest(ctx context.Context, imageID, path string) (err error)
+	FindContent(ctx context.Context, options *flags.Options, contentID string) (imageID string, err error)
 }
 
 // Driver defines the methods required for creating images
 type Driver interface {
-	Create(options *flags.Options, ver int) (path string, err error)
+	Create(ctx context.Context, options *flags.Options, ver int, dir string) (path string, err error)
+	GetContentID(ctx context.Context, options *flags.Options) (id string, err error)
 }
 
 type storeClient interface {
-	Download(*snap.Info, progress.Meter, store.Authenticator) (path string, err error)
-	Snap(name, channel string, sa store.Authenticator) (r *snap.Info, err error)
+	Download(ctx context.Context, remoteSnap *snap.Info, dir string, meter web.Meter) (path string, err error)
+	Snap(ctx context.Context, name, channel string) (r *snap.Info, err error)
+	SnapRevision(ctx context.Context, name, channel string, revision int) (r *snap.Info, err error)
+}
+
+type snapVerifier interface {
+	Verify(ctx context.Context, name string, revision int, path string) (err error)
 }
 
 // ErrRepoDetail is the error returned when the repo fails to retrive details of a specific snap
@@ -92,32 +128,90 @@ func (e *ErrRepoDownload) Error() string {
 	return fmt.Sprintf(errRepoDownloadFmt, e.name, e.developer, e.channel)
 }
 
+// ErrRepoVerify is the error returned when a downloaded snap doesn't match its
+// store assertions
+type ErrRepoVerify struct {
+	name, developer, channel, reason string
+}
+
+func (e *ErrRepoVerify) Error() string {
+	return fmt.Sprintf(errRepoVerifyFmt, e.name, e.developer, e.channel, e.reason)
+}
+
+// ErrRepoPin is the error returned when a snap can't be pinned to the requested
+// revision
+type ErrRepoPin struct {
+	name, channel string
+	revision      int
+}
+
+func (e *ErrRepoPin) Error() string {
+	return fmt.Sprintf(errRepoPinFmt, e.name, e.channel, e.revision)
+}
+
+// ErrReleasePin is the error returned when snap revisions are pinned for a
+// release whose images are not built from store snaps
+type ErrReleasePin struct {
+	release string
+}
+
+func (e *ErrReleasePin) Error() string {
+	return fmt.Sprintf(errReleasePinFmt, e.release)
+}
+
+// ErrExtraSnap is the error returned when an extra snap is not properly specified
+type ErrExtraSnap struct {
+	item string
+}
+
+func (e *ErrExtraSnap) Error() string {
+	return fmt.Sprintf(errExtraSnapFmt, e.item)
+}
+
+// ErrDiskSizeTooSmall is the error returned when the requested disk size can't
+// hold the contents of the image
+type ErrDiskSizeTooSmall struct {
+	size     int
+	required int64
+}
+
+func (e *ErrDiskSizeTooSmall) Error() string {
+	return fmt.Sprintf(errDiskSizeFmt, e.size, e.required)
+}
+
 // UDFQcow2 is a concrete implementation of Driver
 type UDFQcow2 struct {
-	cli cli.Commander
-	sc  storeClient
+	cli      cli.Commander
+	sc       storeClient
+	verifier snapVerifier
+	// Env are the variables set in the environment of ubuntu-device-flash,
+	// as key=value
+	Env []string
 }
 
 // NewUDFQcow2 is the UDFQcow2 constructor
-func NewUDFQcow2(cli cli.Commander, sc storeClient) *UDFQcow2 {
-	return &UDFQcow2{cli: cli, sc: sc}
+func NewUDFQcow2(cli cli.Commander, sc storeClient, verifier snapVerifier) *UDFQcow2 {
+	return &UDFQcow2{cli: cli, sc: sc, verifier: verifier}
 }
 
-// Create makes the required call to UDF to create the raw image, and then transforms
-// it to the QCOW2 format
-func (u *UDFQcow2) Create(options *flags.Options, ver int) (path string, err error) {
-	tmpDirName, err := u.cli.ExecCommand("mktemp", "-d")
+// Create makes the required call to UDF to create the raw image in dir, and then
+// transforms it to the QCOW2 format. The manifest of the build is written next to
+// the image
+func (u *UDFQcow2) Create(ctx context.Context, options *flags.Options, ver int, dir string) (path string, err error) {
+	profile, err := arch.Get(options.Arch)
 	if err != nil {
 		return
 	}
-	rawTmpFileName := filepath.Join(strings.TrimSpace(tmpDirName), rawOutputFileName)
+	rawTmpFileName := filepath.Join(dir, rawOutputFileName)
 	log.Debug("Target image filename: ", rawTmpFileName)
+	m := newManifest(options, ver)
 
-	var archFlag string
-	if options.Arch == "arm" {
-		archFlag = "--oem beagleblack"
+	// sudo resets the environment, env sets it for ubuntu-device-flash
+	cmds := []string{"sudo"}
+	if len(u.Env) > 0 {
+		cmds = append(append(cmds, "env"), u.Env...)
 	}
-	cmds := []string{"sudo", "ubuntu-device-flash"}
+	cmds = append(cmds, "ubuntu-device-flash")
 
 	if options.Release == "15.04" {
 		cmds = append(cmds, "--revision="+strconv.Itoa(ver))
@@ -126,87 +220,384 @@ func (u *UDFQcow2) Create(options *flags.Options, ver int) (path string, err err
 		"core", options.Release,
 	}...)
 
-	snapFlags, err := u.getSnapFlags(options)
+	start := time.Now()
+	snapFlags, snaps, downloaded, err := u.getSnapFlags(ctx, options, dir)
 	if err != nil {
 		return
 	}
+	m.Snaps = snaps
+	m.ContentID = m.Identity()
+	m.AddTiming("snaps", start)
 	cmds = append(cmds,
 		snapFlags...,
 	)
 	defer func() {
-		for _, item := range snapFlags {
-			os.RemoveAll(item)
+		for _, item := range downloaded {
+			os.Remove(item)
 		}
 	}()
 
-	cmds = append(cmds, []string{
-		"--developer-mode",
-		archFlag, "-o", rawTmpFileName}...)
+	if options.DiskSize > 0 {
+		if err = checkDiskSize(options.DiskSize, snaps); err != nil {
+			return
+		}
+		cmds = append(cmds, "--size", strconv.Itoa(options.DiskSize))
+	}
+	cmds = append(cmds, "--developer-mode")
+	if profile.OEM != "" {
+		cmds = append(cmds, "--oem", profile.OEM)
+	}
+	cmds = append(cmds, "-o", rawTmpFileName)
 
-	log.Debug("Executing command ", strings.Join(cmds, " "))
-	output, err := u.cli.ExecCommand(cmds...)
-	log.Debug(output)
-	if err != nil {
-		return
+	log.Debug("Executing command ", strings.Join(cli.Redact(cmds), " "))
+	start = time.Now()
+	// the executor logs the output as the command runs
+	if _, err = u.cli.ExecCommand(ctx, cmds...); err != nil {
+		return "", cli.WrapError(cmds, err)
 	}
+	m.Commands = append(m.Commands, strings.Join(cli.Redact(cmds), " "))
+	m.AddTiming("udf", start)
 
 	log.Debug("Converting to QCOW2 format")
-	tmpFileName := filepath.Join(strings.TrimSpace(tmpDirName), outputFileName)
+	tmpFileName := filepath.Join(dir, outputFileName)
 	cmds = []string{"/usr/bin/qemu-img",
 		"convert", "-O", "qcow2",
 		"-o", "compat=" + options.Qcow2compat,
 		rawTmpFileName, tmpFileName}
-	output, err = u.cli.ExecCommand(cmds...)
-	log.Debug(output)
+	start = time.Now()
+	if _, err = u.cli.ExecCommand(ctx, cmds...); err != nil {
+		return tmpFileName, cli.WrapError(cmds, err)
+	}
+	m.Commands = append(m.Commands, strings.Join(cli.Redact(cmds), " "))
+	m.AddTiming("convert", start)
+
+	log.Debug("Writing checksums of ", tmpFileName)
+	start = time.Now()
+	sumsPath, err := writeChecksum(tmpFileName)
+	if err != nil {
+		return tmpFileName, err
+	}
+	if options.SigningKey != "" {
+		log.Debug("Signing ", sumsPath)
+		if _, err = signChecksum(sumsPath, options.SigningKey); err != nil {
+			return tmpFileName, err
+		}
+	}
+	m.AddTiming("checksum", start)
 
-	return tmpFileName, err
+	m.Tools = u.toolVersions(ctx)
+	log.Debug("Writing manifest of ", tmpFileName)
+	return tmpFileName, writeManifest(m, filepath.Join(dir, manifest.FileName))
 }
 
-func (u *UDFQcow2) getSnapFile(name, channel string) (path string, err error) {
-	remoteSnap, err := u.sc.Snap(name, channel, nil)
+// GetContentID returns the content identity of the image that Create would build
+// with the given options, the snap revisions are resolved without downloading them
+func (u *UDFQcow2) GetContentID(ctx context.Context, options *flags.Options) (id string, err error) {
+	channel := GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
+	requests, err := snapRequests(options, channel)
 	if err != nil {
-		return "", &ErrRepoDetail{name, "", channel}
+		return
+	}
+	m := newManifest(options, 0)
+	for _, request := range requests {
+		if request.revision == 0 {
+			if err = resolveSnap(ctx, u.sc, request); err != nil {
+				return
+			}
+		}
+		m.Snaps = append(m.Snaps, manifest.Snap{Name: request.name, Type: request.snapType,
+			Channel: request.channel, Revision: request.revision})
+	}
+	return m.Identity(), nil
+}
+
+func newManifest(options *flags.Options, ver int) *manifest.Manifest {
+	return &manifest.Manifest{Release: options.Release, Arch: options.Arch, Version: ver,
+		DiskSize: options.DiskSize, Qcow2compat: options.Qcow2compat}
+}
+
+// checkDiskSize returns an error if a disk of size GB can't hold the given snaps
+func checkDiskSize(size int, snaps []manifest.Snap) error {
+	required := diskOverhead
+	for _, snap := range snaps {
+		required += snap.Size
+	}
+	if int64(size)<<30 < required {
+		return &ErrDiskSizeTooSmall{size: size, required: required}
+	}
+	return nil
+}
+
+// toolVersions returns the versions of the packages of the tools used in the
+// build, a failed query is not fatal
+func (u *UDFQcow2) toolVersions(ctx context.Context) map[string]string {
+	versions := make(map[string]string)
+	for _, pkg := range []string{"ubuntu-device-flash", "qemu-utils"} {
+		output, err := cli.Stdout(ctx, u.cli, "dpkg-query", "-W", "-f=${Version}", pkg)
+		if err != nil {
+			log.Warnf("Could not get the version of %s: %v", pkg, err)
+			output = "unknown"
+		}
+		versions[pkg] = strings.TrimSpace(output)
 	}
+	return versions
+}
 
-	log.Debugf("Downloading %s", name)
-	path, err = u.sc.Download(remoteSnap, nil, nil)
+// snapRequest is a snap to be passed to UDF with the given flag, it is only downloaded
+// when its channel differs from the one of the image or its revision is pinned
+type snapRequest struct {
+	flag, snapType, name, channel string
+	revision                      int
+	download                      bool
+	path, digest                  string
+	size                          int64
+}
+
+// getSnapFile downloads and verifies the requested snap, filling its path and the
+// details of the revision retrieved. Its progress is shown with a bar if showBar
+// is set, otherwise it is only logged. The download is aborted when ctx is done
+func (u *UDFQcow2) getSnapFile(ctx context.Context, request *snapRequest, dir string, showBar bool) (err error) {
+	name, channel := request.name, request.channel
+	var remoteSnap *snap.Info
+	if request.revision != 0 {
+		remoteSnap, err = u.sc.SnapRevision(ctx, name, channel, request.revision)
+		if err != nil {
+			log.Debugf("Getting %s revision %d failed: %v", name, request.revision, err)
+			return &ErrRepoPin{name, channel, request.revision}
+		}
+	} else if remoteSnap, err = u.sc.Snap(ctx, name, channel); err != nil {
+		return &ErrRepoDetail{name, "", channel}
+	}
+
+	log.Debugf("Downloading %s revision %d", name, remoteSnap.Revision)
+	path, err := u.sc.Download(ctx, remoteSnap, dir, newProgressMeter(name, showBar))
 	if err != nil {
-		return "", &ErrRepoDownload{name, "", channel}
+		return &ErrRepoDownload{name, "", channel}
 	}
 	log.Debugf("Downloaded %s to %s", name, path)
+
+	if err = u.verifier.Verify(ctx, name, remoteSnap.Revision, path); err != nil {
+		os.Remove(path)
+		return &ErrRepoVerify{name, "", channel, err.Error()}
+	}
+	digest, size, err := snapDigest(path)
+	if err != nil {
+		os.Remove(path)
+		return
+	}
+	request.path, request.revision, request.digest, request.size = path, remoteSnap.Revision, digest, size
 	return
 }
 
-func (u *UDFQcow2) getSnapFlags(options *flags.Options) ([]string, error) {
+// resolveSnap fills the details of the latest revision of a snap that is not
+// downloaded, as reported by the store
+func resolveSnap(ctx context.Context, sc storeClient, request *snapRequest) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	remoteSnap, err := sc.Snap(ctx, request.name, request.channel)
+	if err != nil {
+		return &ErrRepoDetail{request.name, "", request.channel}
+	}
+	request.revision, request.digest, request.size = remoteSnap.Revision, remoteSnap.Sha512, remoteSnap.Size
+	return nil
+}
+
+// getSnapFlags returns the ubuntu-device-flash flags of the requested snaps, their
+// manifest entries and the paths of the snaps downloaded for them to dir
+func (u *UDFQcow2) getSnapFlags(ctx context.Context, options *flags.Options, dir string) ([]string, []manifest.Snap, []string, error) {
 	channel := GetChannel(options.OSChannel, options.KernelChannel, options.GadgetChannel)
 
 	output := []string{
 		"--channel", channel,
 	}
+	requests, err := snapRequests(options, channel)
+	if err != nil {
+		return nil, nil, nil, err
+	}
 	if options.Release != "15.04" {
-		var err error
-		paths := []string{}
-		snaps := []string{options.OS, options.Kernel, options.Gadget}
-		channels := []string{options.OSChannel, options.KernelChannel, options.GadgetChannel}
-		for i := 0; i < len(snaps); i++ {
-			var path string
-			if channels[i] != channel {
-				path, err = u.getSnapFile(snaps[i], channels[i])
-				if err != nil {
-					return nil, err
+		if err := u.downloadSnaps(ctx, requests, options.ParallelDownloads, dir); err != nil {
+			return nil, nil, nil, err
+		}
+		var (
+			snaps      []manifest.Snap
+			downloaded []string
+		)
+		for _, request := range requests {
+			path := request.name
+			if request.download {
+				path = request.path
+				downloaded = append(downloaded, path)
+			} else if err := resolveSnap(ctx, u.sc, request); err != nil {
+				removeSnapFiles(requests)
+				return nil, nil, nil, err
+			}
+			output = append(output, request.flag, path)
+			snaps = append(snaps, manifest.Snap{Name: request.name, Type: request.snapType, Channel: request.channel,
+				Revision: request.revision, Digest: request.digest, Size: request.size})
+		}
+		return output, snaps, downloaded, nil
+	}
+	// UDF installs the snaps of the system-image of 15.04, it can't pin them
+	for _, request := range requests {
+		if request.revision != 0 {
+			return nil, nil, nil, &ErrReleasePin{options.Release}
+		}
+	}
+	return output, nil, nil, nil
+}
+
+// snapRequests returns the snaps to be included in the image, with the pinned
+// revisions and the lock file applied
+func snapRequests(options *flags.Options, channel string) ([]*snapRequest, error) {
+	requests := []*snapRequest{
+		{flag: "--os", snapType: manifest.TypeOS, name: options.OS, channel: options.OSChannel, revision: options.OSRevision},
+		{flag: "--kernel", snapType: manifest.TypeKernel, name: options.Kernel, channel: options.KernelChannel, revision: options.KernelRevision},
+		{flag: "--gadget", snapType: manifest.TypeGadget, name: options.Gadget, channel: options.GadgetChannel, revision: options.GadgetRevision},
+	}
+	extras, err := extraSnapRequests(options.ExtraSnaps, channel)
+	if err != nil {
+		return nil, err
+	}
+	requests = append(requests, extras...)
+	if options.LockFile != "" {
+		lock, err := readLock(options.LockFile)
+		if err != nil {
+			return nil, err
+		}
+		requests = applyLock(requests, lock)
+	}
+	for _, request := range requests {
+		request.download = request.download || request.channel != channel || request.revision != 0
+	}
+	return requests, nil
+}
+
+func removeSnapFiles(requests []*snapRequest) {
+	for _, request := range requests {
+		if request.path != "" {
+			os.Remove(request.path)
+		}
+	}
+}
+
+// applyLock pins the requested snaps to the locked revisions, the locked os, kernel
+// and gadget snaps replace the requested ones and the locked extra snaps not
+// requested are added
+func applyLock(requests []*snapRequest, lock *manifest.Lock) []*snapRequest {
+	for _, request := range requests {
+		if locked, ok := lock.Find(request.snapType, request.name); ok {
+			request.name, request.channel, request.revision = locked.Name, locked.Channel, locked.Revision
+		}
+	}
+	for _, locked := range lock.Snaps {
+		if locked.Type != manifest.TypeExtra {
+			continue
+		}
+		found := false
+		for _, request := range requests {
+			if request.snapType == manifest.TypeExtra && request.name == locked.Name {
+				found = true
+			}
+		}
+		if !found {
+			requests = append(requests, &snapRequest{flag: "--install", snapType: manifest.TypeExtra,
+				name: locked.Name, channel: locked.Channel, revision: locked.Revision, download: true})
+		}
+	}
+	return requests
+}
+
+// downloadSnaps fetches the requested snaps to dir using at most parallel concurrent
+// downloads. When one of them fails, or ctx is done, the rest are cancelled, the
+// snaps already downloaded are removed and the first error is returned. The
+// progress bars are only shown when the snaps are downloaded one at a time
+func (u *UDFQcow2) downloadSnaps(ctx context.Context, requests []*snapRequest, parallel int, dir string) (err error) {
+	if parallel < 1 {
+		parallel = 1
+	}
+	downloads := 0
+	for _, request := range requests {
+		if request.download {
+			downloads++
+		}
+	}
+	showBar := parallel == 1 || downloads <= 1
+	jobs := make(chan *snapRequest)
+	cancelCtx, stop := context.WithCancel(ctx)
+	defer stop()
+	cancel := cancelCtx.Done()
+	var (
+		once sync.Once
+		wg   sync.WaitGroup
+	)
+	for i := 0; i < parallel; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for request := range jobs {
+				select {
+				case <-cancel:
+					continue
+				default:
+				}
+				if downloadErr := u.getSnapFile(cancelCtx, request, dir, showBar); downloadErr != nil {
+					once.Do(func() {
+						err = downloadErr
+						stop()
+					})
 				}
-			} else {
-				path = snaps[i]
 			}
-			paths = append(paths, path)
+		}()
+	}
+
+feed:
+	for _, request := range requests {
+		if !request.download {
+			continue
+		}
+		select {
+		case jobs <- request:
+		case <-cancel:
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		removeSnapFiles(requests)
+	}
+	return
+}
+
+// extraSnapRequests parses a comma separated list of snaps given as name, name=channel,
+// name@revision or name=channel@revision. The snaps without channel use the given
+// default one
+func extraSnapRequests(extraSnaps, defaultChannel string) (requests []*snapRequest, err error) {
+	for _, item := range strings.Split(extraSnaps, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		request := &snapRequest{flag: "--install", snapType: manifest.TypeExtra, channel: defaultChannel, download: true}
+		if i := strings.LastIndex(item, "@"); i != -1 {
+			if request.revision, err = strconv.Atoi(item[i+1:]); err != nil {
+				return nil, &ErrExtraSnap{item}
+			}
+			item = item[:i]
+		}
+		parts := strings.SplitN(item, "=", 2)
+		request.name = parts[0]
+		if len(parts) == 2 && parts[1] != "" {
+			request.channel = parts[1]
 		}
-		output = append(output, []string{
-			"--os", paths[0],
-			"--kernel", paths[1],
-			"--gadget", paths[2],
-		}...)
+		requests = append(requests, request)
 	}
-	return output, nil
+	return
 }
 
 // GetChannel returns the most frequent channel, if all are different it returns
@@ -0,0 +1,78 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/cheggaaa/pb"
+)
+
+// progressMeter is the web.Meter handed to the store client for each download.
+// It shows a progress bar with the name of the snap, or only logs the start and
+// the end of the download when showBar is not set, as the bars of concurrent
+// downloads would overwrite each other. A resumed download starts the meter
+// again, the bar is only created on the first Set, seeded with the resumed
+// offset, and the start is logged once
+type progressMeter struct {
+	name    string
+	showBar bool
+	started bool
+	total   float64
+	bar     *pb.ProgressBar
+}
+
+func newProgressMeter(name string, showBar bool) *progressMeter {
+	return &progressMeter{name: name, showBar: showBar}
+}
+
+func (p *progressMeter) Start(pkg string, total float64) {
+	p.total = total
+	if p.bar != nil {
+		p.bar.Total = int64(total)
+	}
+	if p.started {
+		return
+	}
+	p.started = true
+	if !p.showBar {
+		log.Infof("Downloading %s, %.1f MB", p.name, total/(1<<20))
+	}
+}
+
+func (p *progressMeter) Set(current float64) {
+	if !p.showBar {
+		return
+	}
+	if p.bar == nil {
+		p.bar = pb.New(int(p.total)).SetUnits(pb.U_BYTES).Prefix(p.name + " ")
+		p.bar.Set(int(current))
+		p.bar.Start()
+		return
+	}
+	p.bar.Set(int(current))
+}
+
+func (p *progressMeter) Finished() {
+	if p.bar != nil {
+		p.bar.Finish()
+		return
+	}
+	log.Infof("Downloaded %s", p.name)
+}
@@ -0,0 +1,145 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"context"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+
+	"github.com/ubuntu-core/snappy/snap"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	storeDetailsURL    = "https://search.apps.ubuntu.com/api/v1/snaps/details/"
+	storeSeries        = "16"
+	errStoreDetailsFmt = "Invalid details of snap %s revision %d: %s"
+)
+
+// ErrStoreDetails is the error returned when the store answers with the details
+// of another revision, or with details that can't be decoded
+type ErrStoreDetails struct {
+	name     string
+	revision int
+	msg      string
+}
+
+func (e *ErrStoreDetails) Error() string {
+	return fmt.Sprintf(errStoreDetailsFmt, e.name, e.revision, e.msg)
+}
+
+// StoreHeader returns the headers the store needs to answer with the details of
+// the snaps of the given arch
+func StoreHeader(arch string) http.Header {
+	return http.Header{
+		"Accept":                {"application/hal+json"},
+		"X-Ubuntu-Series":       {storeSeries},
+		"X-Ubuntu-Architecture": {arch},
+	}
+}
+
+// storeHTTPClient is the web client used to query and download the snaps
+type storeHTTPClient interface {
+	web.ContextGetter
+	web.Downloader
+}
+
+// SnapStore is the store client of the images. It queries the details API of the
+// store for the latest or the pinned revisions of the snaps and downloads them
+// with a web client, so that both go through its transport
+type SnapStore struct {
+	httpClient storeHTTPClient
+}
+
+// NewSnapStore is the SnapStore constructor, httpClient must send the headers
+// returned by StoreHeader
+func NewSnapStore(httpClient storeHTTPClient) *SnapStore {
+	return &SnapStore{httpClient: httpClient}
+}
+
+// storeDetails are the fields of the answers of the details API that are used
+type storeDetails struct {
+	Name            string `json:"package_name"`
+	Developer       string `json:"origin"`
+	Version         string `json:"version"`
+	Revision        int    `json:"revision"`
+	Size            int64  `json:"binary_filesize"`
+	Sha512          string `json:"download_sha512"`
+	AnonDownloadURL string `json:"anon_download_url"`
+	DownloadURL     string `json:"download_url"`
+}
+
+// Snap returns the details of the latest revision of the snap in channel
+func (s *SnapStore) Snap(ctx context.Context, name, channel string) (*snap.Info, error) {
+	return s.details(ctx, name, channel, 0)
+}
+
+// SnapRevision returns the details of the given revision of the snap, with its
+// own size, digest and download URLs
+func (s *SnapStore) SnapRevision(ctx context.Context, name, channel string, revision int) (*snap.Info, error) {
+	return s.details(ctx, name, channel, revision)
+}
+
+// Download writes the snap to dir and returns its path, the file is checked
+// against the size and sha512 digest given by the store. Each build downloads
+// to its own workspace, so concurrent builds don't share partial files
+func (s *SnapStore) Download(ctx context.Context, remoteSnap *snap.Info, dir string, meter web.Meter) (path string, err error) {
+	path = filepath.Join(dir, fmt.Sprintf("%s_%d.snap", remoteSnap.Name(), remoteSnap.Revision))
+	expected := web.Expected{Size: remoteSnap.Size, Digest: remoteSnap.Sha512, Hash: crypto.SHA512}
+	if err = s.httpClient.Download(ctx, remoteSnap.AnonDownloadURL, path, expected, meter); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// details returns the details of the given revision of the snap, the latest
+// one in channel when revision is 0
+func (s *SnapStore) details(ctx context.Context, name, channel string, revision int) (*snap.Info, error) {
+	query := url.Values{"channel": {channel}}
+	if revision != 0 {
+		query.Set("revision", strconv.Itoa(revision))
+	}
+	content, err := s.httpClient.GetContext(ctx, storeDetailsURL+name+"?"+query.Encode())
+	if err != nil {
+		return nil, err
+	}
+	var details storeDetails
+	if err = json.Unmarshal(content, &details); err != nil {
+		return nil, &ErrStoreDetails{name: name, revision: revision, msg: err.Error()}
+	}
+	if revision != 0 && details.Revision != revision {
+		return nil, &ErrStoreDetails{name: name, revision: revision,
+			msg: fmt.Sprintf("got revision %d", details.Revision)}
+	}
+	return &snap.Info{
+		Version: details.Version,
+		SideInfo: snap.SideInfo{OfficialName: details.Name, Developer: details.Developer, Revision: details.Revision,
+			Channel: channel, Size: details.Size, Sha512: details.Sha512},
+		AnonDownloadURL: details.AnonDownloadURL,
+		DownloadURL:     details.DownloadURL,
+	}, nil
+}
@@ -0,0 +1,193 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package image
+
+import (
+	"context"
+	"crypto"
+	"crypto/sha512"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+
+	"github.com/ubuntu-core/snappy/snap"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const testDetailsURL = storeDetailsURL + "mykernel?channel=edge&revision=12"
+
+var _ = check.Suite(&snapStoreSuite{})
+
+type snapStoreSuite struct {
+	getter  *fakeDetailsGetter
+	subject *SnapStore
+}
+
+type fakeDetailsGetter struct {
+	outputs      map[string]string
+	downloadURL  string
+	downloadPath string
+	expected     web.Expected
+	downloadErr  error
+}
+
+func (f *fakeDetailsGetter) Download(ctx context.Context, url, path string, expected web.Expected, meter web.Meter) error {
+	f.downloadURL, f.downloadPath, f.expected = url, path, expected
+	return f.downloadErr
+}
+
+func (f *fakeDetailsGetter) Get(url string) ([]byte, error) {
+	return f.GetContext(context.Background(), url)
+}
+
+func (f *fakeDetailsGetter) GetContext(ctx context.Context, url string) ([]byte, error) {
+	output, ok := f.outputs[url]
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	return []byte(output), nil
+}
+
+func (s *snapStoreSuite) SetUpTest(c *check.C) {
+	s.getter = &fakeDetailsGetter{outputs: map[string]string{}}
+	s.subject = NewSnapStore(s.getter)
+}
+
+func (s *snapStoreSuite) TestSnapRevisionReturnsDetailsOfTheRevision(c *check.C) {
+	s.getter.outputs[testDetailsURL] = `{"package_name": "mykernel", "origin": "canonical", "version": "4.4.0-21",
+"revision": 12, "binary_filesize": 1024, "download_sha512": "abc",
+"anon_download_url": "https://store/download/mykernel_12.snap", "download_url": "https://store/auth/mykernel_12.snap"}`
+
+	info, err := s.subject.SnapRevision(context.Background(), "mykernel", "edge", 12)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Name(), check.Equals, "mykernel")
+	c.Assert(info.Developer, check.Equals, "canonical")
+	c.Assert(info.Version, check.Equals, "4.4.0-21")
+	c.Assert(info.Revision, check.Equals, 12)
+	c.Assert(info.Channel, check.Equals, "edge")
+	c.Assert(info.Size, check.Equals, int64(1024))
+	c.Assert(info.Sha512, check.Equals, "abc")
+	c.Assert(info.AnonDownloadURL, check.Equals, "https://store/download/mykernel_12.snap")
+	c.Assert(info.DownloadURL, check.Equals, "https://store/auth/mykernel_12.snap")
+}
+
+func (s *snapStoreSuite) TestSnapRevisionRejectsOtherRevision(c *check.C) {
+	s.getter.outputs[testDetailsURL] = `{"package_name": "mykernel", "revision": 13}`
+
+	_, err := s.subject.SnapRevision(context.Background(), "mykernel", "edge", 12)
+
+	c.Assert(err, check.FitsTypeOf, &ErrStoreDetails{})
+	c.Assert(err.Error(), check.Equals, "Invalid details of snap mykernel revision 12: got revision 13")
+}
+
+func (s *snapStoreSuite) TestSnapRevisionReturnsDecodeError(c *check.C) {
+	s.getter.outputs[testDetailsURL] = "not json"
+
+	_, err := s.subject.SnapRevision(context.Background(), "mykernel", "edge", 12)
+
+	c.Assert(err, check.FitsTypeOf, &ErrStoreDetails{})
+}
+
+func (s *snapStoreSuite) TestSnapRevisionReturnsGetError(c *check.C) {
+	_, err := s.subject.SnapRevision(context.Background(), "mykernel", "edge", 12)
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *snapStoreSuite) TestSnapReturnsDetailsOfTheLatestRevision(c *check.C) {
+	s.getter.outputs[storeDetailsURL+"mykernel?channel=edge"] = `{"package_name": "mykernel", "revision": 13,
+"binary_filesize": 1024, "download_sha512": "abc", "anon_download_url": "https://store/download/mykernel_13.snap"}`
+
+	info, err := s.subject.Snap(context.Background(), "mykernel", "edge")
+
+	c.Assert(err, check.IsNil)
+	c.Assert(info.Name(), check.Equals, "mykernel")
+	c.Assert(info.Revision, check.Equals, 13)
+	c.Assert(info.Channel, check.Equals, "edge")
+	c.Assert(info.AnonDownloadURL, check.Equals, "https://store/download/mykernel_13.snap")
+}
+
+func (s *snapStoreSuite) TestDownloadChecksSizeAndDigest(c *check.C) {
+	info := &snap.Info{SideInfo: snap.SideInfo{OfficialName: "mykernel", Revision: 13, Size: 1024, Sha512: "abc"},
+		AnonDownloadURL: "https://store/download/mykernel_13.snap"}
+
+	dir := c.MkDir()
+
+	path, err := s.subject.Download(context.Background(), info, dir, nil)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(path, check.Equals, filepath.Join(dir, "mykernel_13.snap"))
+	c.Assert(s.getter.downloadURL, check.Equals, info.AnonDownloadURL)
+	c.Assert(s.getter.downloadPath, check.Equals, path)
+	c.Assert(s.getter.expected, check.DeepEquals, web.Expected{Size: 1024, Digest: "abc", Hash: crypto.SHA512})
+}
+
+func (s *snapStoreSuite) TestDownloadReturnsError(c *check.C) {
+	s.getter.downloadErr = errors.New("download error")
+
+	_, err := s.subject.Download(context.Background(), &snap.Info{}, c.MkDir(), nil)
+
+	c.Assert(err, check.Equals, s.getter.downloadErr)
+}
+
+func (s *snapStoreSuite) TestConcurrentDownloadsOfTheSameSnapDontCollide(c *check.C) {
+	content := []byte("snap content")
+	sum := sha512.Sum512(content)
+	// both requests are answered once they have arrived
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived.Done()
+		arrived.Wait()
+		w.Write(content)
+	}))
+	defer server.Close()
+	subject := NewSnapStore(web.NewClient(web.DefaultConfig()))
+	info := &snap.Info{SideInfo: snap.SideInfo{OfficialName: "mykernel", Revision: 13, Size: int64(len(content)),
+		Sha512: hex.EncodeToString(sum[:])}, AnonDownloadURL: server.URL + "/mykernel_13.snap"}
+	dirs := []string{c.MkDir(), c.MkDir()}
+	paths := make([]string, len(dirs))
+	errs := make([]error, len(dirs))
+
+	var wg sync.WaitGroup
+	for i := range dirs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			paths[i], errs[i] = subject.Download(context.Background(), info, dirs[i], nil)
+		}(i)
+	}
+	wg.Wait()
+
+	c.Assert(paths[0], check.Not(check.Equals), paths[1])
+	for i := range dirs {
+		c.Assert(errs[i], check.IsNil)
+		downloaded, err := ioutil.ReadFile(paths[i])
+		c.Assert(err, check.IsNil)
+		c.Assert(downloaded, check.DeepEquals, content)
+	}
+}
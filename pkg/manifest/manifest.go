@@ -0,0 +1,183 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package manifest defines the records of the contents of the built images,
+// and the lock files used to pin those contents in later builds
+package manifest
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Types of the snaps included in an image
+const (
+	TypeOS     = "os"
+	TypeKernel = "kernel"
+	TypeGadget = "gadget"
+	TypeExtra  = "extra"
+)
+
+const (
+	// FileName is the name of the manifest written next to the built image
+	FileName     = "manifest.json"
+	errDecodeFmt = "Could not decode %s: %s"
+)
+
+// Snap holds the details of one of the snaps of an image
+type Snap struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Channel  string `json:"channel"`
+	Revision int    `json:"revision"`
+	Digest   string `json:"digest,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+// Timing holds the duration of one of the phases of a build
+type Timing struct {
+	Phase   string  `json:"phase"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Manifest describes the contents of a built image and how it was built
+type Manifest struct {
+	Release     string            `json:"release"`
+	Arch        string            `json:"arch"`
+	Version     int               `json:"version,omitempty"`
+	DiskSize    int               `json:"disk-size,omitempty"`
+	Qcow2compat string            `json:"qcow2compat,omitempty"`
+	ContentID   string            `json:"content-id,omitempty"`
+	Snaps       []Snap            `json:"snaps"`
+	Tools       map[string]string `json:"tools,omitempty"`
+	Commands    []string          `json:"commands,omitempty"`
+	Timings     []Timing          `json:"timings,omitempty"`
+}
+
+// Identity returns the content identity of the image, a digest of the build
+// parameters and the snap revisions, which is the same for all the images built
+// from them regardless of the channels or the order of the extra snaps
+func (m *Manifest) Identity() string {
+	var snaps []string
+	for _, snap := range m.Snaps {
+		snaps = append(snaps, fmt.Sprintf("snap %s %s %d", snap.Type, snap.Name, snap.Revision))
+	}
+	sort.Strings(snaps)
+	lines := append([]string{
+		"release " + m.Release,
+		"arch " + m.Arch,
+		fmt.Sprintf("version %d", m.Version),
+		fmt.Sprintf("disk-size %d", m.DiskSize),
+		"qcow2compat " + m.Qcow2compat,
+	}, snaps...)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// AddTiming records the duration of the given phase, that began at start
+func (m *Manifest) AddTiming(phase string, start time.Time) {
+	m.Timings = append(m.Timings, Timing{Phase: phase, Seconds: time.Since(start).Seconds()})
+}
+
+// Lock holds the exact snap revisions to be used in a build
+type Lock struct {
+	Snaps []Snap `json:"snaps"`
+}
+
+// ErrDecode is the error returned when a manifest or lock file can't be parsed
+type ErrDecode struct {
+	path, msg string
+}
+
+func (e *ErrDecode) Error() string {
+	return fmt.Sprintf(errDecodeFmt, e.path, e.msg)
+}
+
+// Read loads the manifest in path
+func Read(path string) (*Manifest, error) {
+	m := &Manifest{}
+	if err := readJSON(path, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Write stores the manifest in path
+func (m *Manifest) Write(path string) error {
+	return writeJSON(path, m)
+}
+
+// ReadLock loads the lock file in path
+func ReadLock(path string) (*Lock, error) {
+	l := &Lock{}
+	if err := readJSON(path, l); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Write stores the lock in path
+func (l *Lock) Write(path string) error {
+	return writeJSON(path, l)
+}
+
+// Find returns the locked snap of the given type and, for extra snaps, name
+func (l *Lock) Find(snapType, name string) (Snap, bool) {
+	for _, snap := range l.Snaps {
+		if snap.Type == snapType && (snapType != TypeExtra || snap.Name == name) {
+			return snap, true
+		}
+	}
+	return Snap{}, false
+}
+
+// LockFromManifest returns a lock that pins the snaps of the given manifest
+func LockFromManifest(m *Manifest) *Lock {
+	l := &Lock{}
+	for _, snap := range m.Snaps {
+		l.Snaps = append(l.Snaps, Snap{
+			Name: snap.Name, Type: snap.Type, Channel: snap.Channel, Revision: snap.Revision})
+	}
+	return l
+}
+
+func readJSON(path string, v interface{}) error {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(content, v); err != nil {
+		return &ErrDecode{path: path, msg: err.Error()}
+	}
+	return nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	content, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(content, '\n'), 0644)
+}
@@ -0,0 +1,156 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package manifest
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&manifestSuite{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type manifestSuite struct {
+	dir      string
+	manifest *Manifest
+}
+
+func (s *manifestSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.manifest = &Manifest{
+		Release: "16.04",
+		Arch:    "amd64",
+		Snaps: []Snap{
+			{Name: "myos", Type: TypeOS, Channel: "edge", Revision: 10, Digest: "osdigest", Size: 100},
+			{Name: "mykernel", Type: TypeKernel, Channel: "beta", Revision: 20, Digest: "kerneldigest", Size: 200},
+			{Name: "myextra", Type: TypeExtra, Channel: "stable", Revision: 30},
+		},
+		Tools:    map[string]string{"qemu-utils": "1.0"},
+		Commands: []string{"mycommand --flag"},
+		Timings:  []Timing{{Phase: "myphase", Seconds: 1.5}},
+	}
+}
+
+func (s *manifestSuite) TestWrittenManifestCanBeRead(c *check.C) {
+	path := filepath.Join(s.dir, "manifest.json")
+	c.Assert(s.manifest.Write(path), check.IsNil)
+
+	m, err := Read(path)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(m, check.DeepEquals, s.manifest)
+}
+
+func (s *manifestSuite) TestAddTimingAppendsPhase(c *check.C) {
+	m := &Manifest{}
+
+	m.AddTiming("myphase", time.Now().Add(-time.Minute))
+
+	c.Assert(len(m.Timings), check.Equals, 1)
+	c.Assert(m.Timings[0].Phase, check.Equals, "myphase")
+	c.Assert(m.Timings[0].Seconds >= 60, check.Equals, true)
+}
+
+func (s *manifestSuite) TestIdentityIgnoresChannelsAndSnapOrder(c *check.C) {
+	other := *s.manifest
+	other.Snaps = []Snap{
+		{Name: "myextra", Type: TypeExtra, Channel: "edge", Revision: 30},
+		{Name: "myos", Type: TypeOS, Channel: "stable", Revision: 10},
+		{Name: "mykernel", Type: TypeKernel, Channel: "stable", Revision: 20},
+	}
+	other.Tools = nil
+	other.Timings = nil
+
+	c.Assert(other.Identity(), check.Equals, s.manifest.Identity())
+}
+
+func (s *manifestSuite) TestIdentityChangesWithContents(c *check.C) {
+	id := s.manifest.Identity()
+	changes := []func(m *Manifest){
+		func(m *Manifest) { m.Release = "rolling" },
+		func(m *Manifest) { m.Arch = "arm64" },
+		func(m *Manifest) { m.Version = 2 },
+		func(m *Manifest) { m.DiskSize = 10 },
+		func(m *Manifest) { m.Qcow2compat = "0.10" },
+		func(m *Manifest) { m.Snaps = m.Snaps[:2] },
+		func(m *Manifest) {
+			m.Snaps = append([]Snap{}, m.Snaps...)
+			m.Snaps[1].Revision = 21
+		},
+	}
+	for _, change := range changes {
+		other := *s.manifest
+		change(&other)
+		c.Check(other.Identity(), check.Not(check.Equals), id)
+	}
+}
+
+func (s *manifestSuite) TestReadReturnsDecodeError(c *check.C) {
+	path := filepath.Join(s.dir, "manifest.json")
+	c.Assert(ioutil.WriteFile(path, []byte("not json"), 0644), check.IsNil)
+
+	_, err := Read(path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrDecode{})
+}
+
+func (s *manifestSuite) TestLockFromManifestKeepsOnlyPinningDetails(c *check.C) {
+	lock := LockFromManifest(s.manifest)
+
+	c.Assert(lock.Snaps, check.DeepEquals, []Snap{
+		{Name: "myos", Type: TypeOS, Channel: "edge", Revision: 10},
+		{Name: "mykernel", Type: TypeKernel, Channel: "beta", Revision: 20},
+		{Name: "myextra", Type: TypeExtra, Channel: "stable", Revision: 30},
+	})
+}
+
+func (s *manifestSuite) TestWrittenLockCanBeRead(c *check.C) {
+	path := filepath.Join(s.dir, "snaps.lock")
+	lock := LockFromManifest(s.manifest)
+	c.Assert(lock.Write(path), check.IsNil)
+
+	l, err := ReadLock(path)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(l, check.DeepEquals, lock)
+}
+
+func (s *manifestSuite) TestFindMatchesByTypeAndExtraName(c *check.C) {
+	lock := LockFromManifest(s.manifest)
+
+	snap, ok := lock.Find(TypeKernel, "anykernel")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(snap.Revision, check.Equals, 20)
+
+	_, ok = lock.Find(TypeGadget, "mygadget")
+	c.Assert(ok, check.Equals, false)
+
+	_, ok = lock.Find(TypeExtra, "anotherextra")
+	c.Assert(ok, check.Equals, false)
+
+	snap, ok = lock.Find(TypeExtra, "myextra")
+	c.Assert(ok, check.Equals, true)
+	c.Assert(snap.Revision, check.Equals, 30)
+}
@@ -20,29 +20,66 @@
 package runner
 
 import (
+	"context"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	log "github.com/Sirupsen/logrus"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cache"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/manifest"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/si"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/workspace"
 )
 
 const imagesToKeep = 3
 
+var (
+	newWorkspace = workspace.New
+	// workspaceMinFree returns the space required to hold the raw image of a
+	// disk of the given size in GB and its QCOW2 conversion, which is at most as
+	// big. A size of 0 is the default one of ubuntu-device-flash
+	workspaceMinFree = func(diskSize int) uint64 {
+		if diskSize <= 0 {
+			diskSize = image.DefaultDiskSize
+		}
+		return 2 * uint64(diskSize) << 30
+	}
+)
+
+// SnapCache holds the methods for inspecting and pruning the local snap cache
+type SnapCache interface {
+	List() (entries []cache.Entry, err error)
+	Prune() (evicted []cache.Entry, err error)
+}
+
+// ChannelLister holds the methods for listing the releases and channels of an
+// image origin
+type ChannelLister interface {
+	GetChannels(ctx context.Context) (channels []si.Channel, err error)
+}
+
 // Runner is the main type of the package
 type Runner struct {
 	imgDataOrigin image.Pollster
 	imgDataTarget image.PollsterWriter
 	imgDriver     image.Driver
+	snapCache     SnapCache
+	builder       cli.Commander
+	remoteBuild   bool
 }
 
-// NewRunner is the Runner constructor
-func NewRunner(imgDataOrigin image.Pollster, imgDataTarget image.PollsterWriter, imgDriver image.Driver) *Runner {
-	return &Runner{imgDataOrigin: imgDataOrigin, imgDataTarget: imgDataTarget, imgDriver: imgDriver}
+// NewRunner is the Runner constructor, snapCache can be nil if the local
+// snap cache is not enabled.
+// builder runs the commands of imgDriver, on the build host if remoteBuild is set
+func NewRunner(imgDataOrigin image.Pollster, imgDataTarget image.PollsterWriter, imgDriver image.Driver, snapCache SnapCache, builder cli.Commander, remoteBuild bool) *Runner {
+	return &Runner{imgDataOrigin: imgDataOrigin, imgDataTarget: imgDataTarget, imgDriver: imgDriver,
+		snapCache: snapCache, builder: builder, remoteBuild: remoteBuild}
 }
 
 // ErrVersion is the type of the error returned by Exec when the version
@@ -55,6 +92,16 @@ func (e *ErrVersion) Error() string {
 	return fmt.Sprintf("error SI version %d is not greater than cloud version %d", e.siVersion, e.cloudVersion)
 }
 
+// ErrContentExists is the type of the error returned by Exec when the
+// target already has an image with the contents that would be built
+type ErrContentExists struct {
+	imageID, contentID string
+}
+
+func (e *ErrContentExists) Error() string {
+	return fmt.Sprintf("error image %s already has the content %s", e.imageID, e.contentID)
+}
+
 // ErrActionUnknown is the type of the error returned by Exec when the
 // action given is not recognized
 type ErrActionUnknown struct {
@@ -65,43 +112,101 @@ func (e *ErrActionUnknown) Error() string {
 	return fmt.Sprintf("error unknown action %s", e.action)
 }
 
+// ErrCacheDisabled is the type of the error returned by Exec when the
+// cache action is given and there is no snap cache configured
+type ErrCacheDisabled struct{}
+
+func (e *ErrCacheDisabled) Error() string {
+	return "error the snap cache is not enabled, set -snap-cache-dir"
+}
+
+// ErrLockPaths is the type of the error returned by Exec when the lock
+// action is given without the manifest or lock file paths
+type ErrLockPaths struct{}
+
+func (e *ErrLockPaths) Error() string {
+	return "error the lock action needs -manifest and -lock-file"
+}
+
+// ErrManifestPath is the type of the error returned by Exec when the manifest
+// action is given without the path to save the manifest
+type ErrManifestPath struct{}
+
+func (e *ErrManifestPath) Error() string {
+	return "error the manifest action needs -manifest"
+}
+
+// ErrChannelsUnsupported is the type of the error returned by Exec when the
+// channels action is given and the image origin can't list its channels
+type ErrChannelsUnsupported struct{}
+
+func (e *ErrChannelsUnsupported) Error() string {
+	return "error the image origin can't list its channels"
+}
+
 // Exec is the main entry point, it interprets the given options and
-// handles the logic of the utility
-func (r *Runner) Exec(options *flags.Options) (err error) {
+// handles the logic of the utility. The commands and requests made are
+// abandoned when ctx is done
+func (r *Runner) Exec(ctx context.Context, options *flags.Options) (err error) {
 	if options.Action == "create" {
-		return r.create(options)
+		return r.create(ctx, options)
 	} else if options.Action == "cleanup" {
-		return r.cleanup(options)
+		return r.cleanup(ctx, options)
 	} else if options.Action == "purge" {
-		return r.purge(options)
+		return r.purge(ctx, options)
+	} else if options.Action == "cache" {
+		return r.inspectCache()
+	} else if options.Action == "lock" {
+		return r.lock(options)
+	} else if options.Action == "manifest" {
+		return r.getManifest(ctx, options)
+	} else if options.Action == "channels" {
+		return r.listChannels(ctx)
 	}
 	return &ErrActionUnknown{action: options.Action}
 }
 
-func (r *Runner) create(options *flags.Options) (err error) {
+func (r *Runner) create(ctx context.Context, options *flags.Options) (err error) {
 	log.Infof("Checking current versions for release %s, os channel %s, kernel channel %s, gadget channel %s and arch %s",
 		options.Release, options.OSChannel, options.KernelChannel, options.GadgetChannel, options.Arch)
 	var siVersion, cloudVersion int
 
 	if options.Release == "15.04" {
-		siVersion, cloudVersion, err = r.getVersions(options)
+		siVersion, cloudVersion, err = r.getVersions(ctx, options)
 		if err != nil {
 			return
 		}
 		if siVersion <= cloudVersion {
 			return &ErrVersion{siVersion, cloudVersion}
 		}
+	} else {
+		var contentID string
+		if contentID, err = r.imgDriver.GetContentID(ctx, options); err != nil {
+			return
+		}
+		if err = r.checkContent(ctx, options, contentID); err != nil {
+			return
+		}
+	}
+	ws, err := newWorkspace(options.WorkspaceRoot, workspaceMinFree(options.DiskSize), options.KeepWorkspace, r.builder, r.remoteBuild)
+	if err != nil {
+		return
 	}
+	defer func() {
+		if err := ws.Cleanup(); err != nil {
+			log.Warnf("Could not clean up workspace %s: %v", ws.Dir(), err)
+		}
+	}()
+
 	var path string
-	path, err = r.imgDriver.Create(options, siVersion)
-	defer os.Remove(path)
+	path, err = r.imgDriver.Create(ctx, options, siVersion, ws.Dir())
 	log.Infof("Creating image file in %s", path)
 	if err != nil {
 		return
 	}
 
 	log.Infof("Uploading %s", path)
-	err = r.imgDataTarget.Create(path, options, siVersion)
+	err = r.imgDataTarget.Create(ctx, path, options, siVersion)
 	if err != nil {
 		return
 	}
@@ -110,18 +215,34 @@ func (r *Runner) create(options *flags.Options) (err error) {
 
 }
 
-func (r *Runner) getVersions(options *flags.Options) (siVersion, cloudVersion int, err error) {
+// checkContent returns ErrContentExists if there is already an image in the
+// target with the given content, equivalent to the one that would be built.
+// The content includes the snap revisions, so an all-snaps image is only built
+// again when one of its snaps changes or the options that shape it do
+func (r *Runner) checkContent(ctx context.Context, options *flags.Options, contentID string) (err error) {
+	log.Infof("Looking for images with content %s", contentID)
+	imageID, err := r.imgDataTarget.FindContent(ctx, options, contentID)
+	if err != nil {
+		return
+	}
+	if imageID != "" {
+		return &ErrContentExists{imageID: imageID, contentID: contentID}
+	}
+	return
+}
+
+func (r *Runner) getVersions(ctx context.Context, options *flags.Options) (siVersion, cloudVersion int, err error) {
 	var siError, cloudError error
 	versionChan := make(chan struct{}, 2)
 
 	go func() {
-		siVersion, siError = r.imgDataOrigin.GetLatestVersion(options)
+		siVersion, siError = r.imgDataOrigin.GetLatestVersion(ctx, options)
 		log.Info("siVersion: ", siVersion)
 		versionChan <- struct{}{}
 	}()
 
 	go func() {
-		cloudVersion, cloudError = r.imgDataTarget.GetLatestVersion(options)
+		cloudVersion, cloudError = r.imgDataTarget.GetLatestVersion(ctx, options)
 		log.Info("cloudVersion: ", cloudVersion)
 		versionChan <- struct{}{}
 	}()
@@ -141,9 +262,9 @@ func (r *Runner) getVersions(options *flags.Options) (siVersion, cloudVersion in
 	return
 }
 
-func (r *Runner) cleanup(options *flags.Options) (err error) {
+func (r *Runner) cleanup(ctx context.Context, options *flags.Options) (err error) {
 	options.Release = strings.Replace(options.Release, ".", "", 1)
-	imageList, err := r.imgDataTarget.GetVersions(options)
+	imageList, err := r.imgDataTarget.GetVersions(ctx, options)
 	if err != nil {
 		log.Info("Error getting image list")
 		return
@@ -152,11 +273,91 @@ func (r *Runner) cleanup(options *flags.Options) (err error) {
 		// assumes that imageList is sorted in descending order,
 		// the last items in the list will be the older ones
 		log.Infof("Removing images %s", imageList[imagesToKeep:])
-		err = r.imgDataTarget.Delete(imageList[imagesToKeep:]...)
+		err = r.imgDataTarget.Delete(ctx, imageList[imagesToKeep:]...)
+	}
+	return
+}
+
+func (r *Runner) purge(ctx context.Context, options *flags.Options) (err error) {
+	return r.imgDataTarget.Purge(ctx, options)
+}
+
+func (r *Runner) inspectCache() (err error) {
+	if r.snapCache == nil {
+		return &ErrCacheDisabled{}
+	}
+	evicted, err := r.snapCache.Prune()
+	if err != nil {
+		return
 	}
+	for _, entry := range evicted {
+		log.Infof("Evicted %s revision %d", entry.Name, entry.Revision)
+	}
+	entries, err := r.snapCache.List()
+	if err != nil {
+		return
+	}
+	var total int64
+	for _, entry := range entries {
+		log.Infof("%s revision %d, %d bytes, sha512 %s, last used %s",
+			entry.Name, entry.Revision, entry.Size, entry.Digest, entry.LastUsed.Format(time.RFC3339))
+		total += entry.Size
+	}
+	log.Infof("%d snaps cached, %d bytes", len(entries), total)
 	return
 }
 
-func (r *Runner) purge(options *flags.Options) (err error) {
-	return r.imgDataTarget.Purge(options)
+func (r *Runner) lock(options *flags.Options) (err error) {
+	if options.ManifestFile == "" || options.LockFile == "" {
+		return &ErrLockPaths{}
+	}
+	m, err := manifest.Read(options.ManifestFile)
+	if err != nil {
+		return
+	}
+	lock := manifest.LockFromManifest(m)
+	for _, snap := range lock.Snaps {
+		log.Infof("Pinning %s snap %s to revision %d", snap.Type, snap.Name, snap.Revision)
+	}
+	if err = lock.Write(options.LockFile); err != nil {
+		return
+	}
+	log.Infof("Lock file for release %s and arch %s written to %s", m.Release, m.Arch, options.LockFile)
+	return
+}
+
+func (r *Runner) getManifest(ctx context.Context, options *flags.Options) (err error) {
+	if options.ManifestFile == "" {
+		return &ErrManifestPath{}
+	}
+	imageID := options.ImageID
+	if imageID == "" {
+		imageList, err := r.imgDataTarget.GetVersions(ctx, options)
+		if err != nil {
+			return err
+		}
+		if len(imageList) == 0 {
+			return cloud.NewErrVersionNotFound(options)
+		}
+		imageID = imageList[0]
+	}
+	log.Infof("Saving manifest of %s to %s", imageID, options.ManifestFile)
+	return r.imgDataTarget.GetManifest(ctx, imageID, options.ManifestFile)
+}
+
+func (r *Runner) listChannels(ctx context.Context) (err error) {
+	lister, ok := r.imgDataOrigin.(ChannelLister)
+	if !ok {
+		return &ErrChannelsUnsupported{}
+	}
+	channels, err := lister.GetChannels(ctx)
+	if err != nil {
+		return
+	}
+	for _, channel := range channels {
+		for _, archName := range channel.Archs {
+			log.Infof("release %s, channel %s, arch %s", channel.Release, channel.Name, archName)
+		}
+	}
+	return
 }
@@ -19,62 +19,122 @@
 package runner
 
 import (
+	"context"
 	"fmt"
-	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cache"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/cloud"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/image"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/manifest"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/si"
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/workspace"
 
 	"gopkg.in/check.v1"
 )
 
 const (
 	siVersionError          = "error getting si version"
+	siChannelsError         = "error getting si channels"
 	cloudLatestVersionError = "error getting latest cloud version"
 	cloudVersionsError      = "error getting cloud versions"
 	cloudCreateError        = "error creating cloud image"
 	cloudDeleteError        = "error deleting cloud images"
 	cloudPurgeError         = "error purging cloud images"
+	cloudManifestError      = "error getting image manifest"
+	cloudFindContentError   = "error finding image content"
+	udfContentIDError       = "error getting content id"
 	udfCreateError          = "error creating image"
+	testContentID           = "mycontentid"
+	cacheListError          = "error listing cache"
+	cachePruneError         = "error pruning cache"
 )
 
 var _ = check.Suite(&runnerCreateSuite{})
 var _ = check.Suite(&runnerCleanupSuite{})
 var _ = check.Suite(&runnerPurgeSuite{})
+var _ = check.Suite(&runnerCacheSuite{})
+var _ = check.Suite(&runnerLockSuite{})
+var _ = check.Suite(&runnerManifestSuite{})
+var _ = check.Suite(&runnerChannelsSuite{})
 
 func Test(t *testing.T) { check.TestingT(t) }
 
 type runnerCreateSuite struct {
+	subject       *Runner
+	options       *flags.Options
+	siClient      *fakeSiClient
+	cloudClient   *fakeCloudClient
+	udfDriver     *fakeImgDriver
+	backupMinFree func(int) uint64
+}
+
+type runnerCleanupSuite struct {
 	subject     *Runner
 	options     *flags.Options
-	siClient    *fakeSiClient
 	cloudClient *fakeCloudClient
-	udfDriver   *fakeImgDriver
 }
 
-type runnerCleanupSuite struct {
+type runnerPurgeSuite struct {
 	subject     *Runner
 	options     *flags.Options
 	cloudClient *fakeCloudClient
 }
 
-type runnerPurgeSuite struct {
+type runnerCacheSuite struct {
+	subject   *Runner
+	options   *flags.Options
+	snapCache *fakeSnapCache
+}
+
+type runnerLockSuite struct {
+	subject *Runner
+	options *flags.Options
+}
+
+type runnerManifestSuite struct {
 	subject     *Runner
 	options     *flags.Options
 	cloudClient *fakeCloudClient
 }
 
+type runnerChannelsSuite struct {
+	subject  *Runner
+	options  *flags.Options
+	siClient *fakeSiClient
+}
+
 type fakeSiClient struct {
-	getVersionCalls map[string]int
-	doErr           bool
-	version         int
+	getVersionCalls  map[string]int
+	getChannelsCalls int
+	doErr            bool
+	doChannelsErr    bool
+	version          int
+	channels         []si.Channel
+}
+
+func (s *fakeSiClient) GetChannels(ctx context.Context) (channels []si.Channel, err error) {
+	s.getChannelsCalls++
+	if s.doChannelsErr {
+		err = fmt.Errorf(siChannelsError)
+	}
+	return s.channels, err
 }
 
-func (s *fakeSiClient) GetLatestVersion(options *flags.Options) (ver int, err error) {
+// fakePollster is an image origin that can't list its channels
+type fakePollster struct{}
+
+func (s *fakePollster) GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error) {
+	return
+}
+
+func (s *fakeSiClient) GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error) {
 	key := getFakeKey(options)
 	s.getVersionCalls[key]++
 	if s.doErr {
@@ -88,17 +148,22 @@ type fakeCloudClient struct {
 	getVersionsCalls      map[string]int
 	createCalls           map[string]int
 	deleteCalls           map[string]int
+	getManifestCalls      map[string]int
+	findContentCalls      map[string]int
 	purgeCalls            int
 	doVerErr              bool
 	doVerNotFoundErr      bool
 	doCreateErr           bool
 	doDeleteErr           bool
 	doPurgeErr            bool
+	doManifestErr         bool
+	doFindContentErr      bool
+	contentImage          string
 	version               int
 	versions              []string
 }
 
-func (s *fakeCloudClient) GetLatestVersion(options *flags.Options) (ver int, err error) {
+func (s *fakeCloudClient) GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error) {
 	key := getFakeKey(options)
 	s.getLatestVersionCalls[key]++
 	if s.doVerErr {
@@ -110,7 +175,7 @@ func (s *fakeCloudClient) GetLatestVersion(options *flags.Options) (ver int, err
 	return s.version, err
 }
 
-func (s *fakeCloudClient) GetVersions(options *flags.Options) (images []string, err error) {
+func (s *fakeCloudClient) GetVersions(ctx context.Context, options *flags.Options) (images []string, err error) {
 	key := getFakeKey(options)
 	s.getVersionsCalls[key]++
 	if s.doVerErr {
@@ -119,7 +184,7 @@ func (s *fakeCloudClient) GetVersions(options *flags.Options) (images []string,
 	return s.versions, err
 }
 
-func (s *fakeCloudClient) Create(filePath string, options *flags.Options, version int) (err error) {
+func (s *fakeCloudClient) Create(ctx context.Context, filePath string, options *flags.Options, version int) (err error) {
 	key := getFullCreateKey(filePath, options, version)
 	s.createCalls[key]++
 	if s.doCreateErr {
@@ -128,7 +193,7 @@ func (s *fakeCloudClient) Create(filePath string, options *flags.Options, versio
 	return
 }
 
-func (s *fakeCloudClient) Delete(versions ...string) (err error) {
+func (s *fakeCloudClient) Delete(ctx context.Context, versions ...string) (err error) {
 	key := getDeleteKey(versions)
 	s.deleteCalls[key]++
 	if s.doDeleteErr {
@@ -137,7 +202,7 @@ func (s *fakeCloudClient) Delete(versions ...string) (err error) {
 	return
 }
 
-func (s *fakeCloudClient) Purge(options *flags.Options) (err error) {
+func (s *fakeCloudClient) Purge(ctx context.Context, options *flags.Options) (err error) {
 	s.purgeCalls++
 	if s.doPurgeErr {
 		err = fmt.Errorf(cloudPurgeError)
@@ -145,26 +210,83 @@ func (s *fakeCloudClient) Purge(options *flags.Options) (err error) {
 	return
 }
 
+func (s *fakeCloudClient) GetManifest(ctx context.Context, imageID, path string) (err error) {
+	s.getManifestCalls[imageID+" - "+path]++
+	if s.doManifestErr {
+		err = fmt.Errorf(cloudManifestError)
+	}
+	return
+}
+
 type fakeImgDriver struct {
-	createCalls map[string]int
-	path        string
-	doErr       bool
+	createCalls    map[string]int
+	contentIDCalls map[string]int
+	path, dir      string
+	doErr          bool
+	doContentIDErr bool
+	// wait makes Create wait for its context to be cancelled
+	wait bool
+	ctx  context.Context
+}
+
+func (s *fakeImgDriver) GetContentID(ctx context.Context, options *flags.Options) (id string, err error) {
+	s.contentIDCalls[getFakeKey(options)]++
+	if s.doContentIDErr {
+		err = fmt.Errorf(udfContentIDError)
+	}
+	return testContentID, err
 }
 
-func (s *fakeImgDriver) Create(options *flags.Options, version int) (path string, err error) {
+func (s *fakeImgDriver) Create(ctx context.Context, options *flags.Options, version int, dir string) (path string, err error) {
 	key := getCreateKey(options, version)
 	s.createCalls[key]++
+	s.dir = dir
+	s.ctx = ctx
+	if s.wait {
+		<-ctx.Done()
+		return "", ctx.Err()
+	}
 	if s.doErr {
 		err = fmt.Errorf(udfCreateError)
 	}
 	return s.path, err
 }
 
+func (s *fakeCloudClient) FindContent(ctx context.Context, options *flags.Options, contentID string) (imageID string, err error) {
+	s.findContentCalls[getFakeKey(options)+" - "+contentID]++
+	if s.doFindContentErr {
+		err = fmt.Errorf(cloudFindContentError)
+	}
+	return s.contentImage, err
+}
+
+type fakeSnapCache struct {
+	listCalls, pruneCalls int
+	doListErr, doPruneErr bool
+	entries               []cache.Entry
+}
+
+func (s *fakeSnapCache) List() (entries []cache.Entry, err error) {
+	s.listCalls++
+	if s.doListErr {
+		err = fmt.Errorf(cacheListError)
+	}
+	return s.entries, err
+}
+
+func (s *fakeSnapCache) Prune() (evicted []cache.Entry, err error) {
+	s.pruneCalls++
+	if s.doPruneErr {
+		err = fmt.Errorf(cachePruneError)
+	}
+	return
+}
+
 func (s *runnerCreateSuite) SetUpSuite(c *check.C) {
 	s.siClient = &fakeSiClient{}
 	s.cloudClient = &fakeCloudClient{}
 	s.udfDriver = &fakeImgDriver{}
-	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver)
+	s.subject = NewRunner(s.siClient, s.cloudClient, s.udfDriver, nil, &fakeBuildHost{}, false)
 	s.options = &flags.Options{
 		Action:        "create",
 		Release:       "15.04",
@@ -172,6 +294,12 @@ func (s *runnerCreateSuite) SetUpSuite(c *check.C) {
 		KernelChannel: "edge",
 		GadgetChannel: "edge",
 		Arch:          "amd64"}
+	s.backupMinFree = workspaceMinFree
+	workspaceMinFree = func(int) uint64 { return 0 }
+}
+
+func (s *runnerCreateSuite) TearDownSuite(c *check.C) {
+	workspaceMinFree = s.backupMinFree
 }
 
 func (s *runnerCreateSuite) SetUpTest(c *check.C) {
@@ -184,16 +312,25 @@ func (s *runnerCreateSuite) SetUpTest(c *check.C) {
 	s.cloudClient.doVerNotFoundErr = false
 	s.cloudClient.doCreateErr = false
 	s.cloudClient.version = 1
+	s.cloudClient.findContentCalls = make(map[string]int)
+	s.cloudClient.doFindContentErr = false
+	s.cloudClient.contentImage = ""
 	s.udfDriver.createCalls = make(map[string]int)
+	s.udfDriver.contentIDCalls = make(map[string]int)
+	s.udfDriver.doContentIDErr = false
 	s.udfDriver.doErr = false
+	s.udfDriver.wait = false
 	s.udfDriver.path = "path"
+	s.udfDriver.dir = ""
 	s.options.Action = "create"
 	s.options.Release = "15.04"
+	s.options.WorkspaceRoot = c.MkDir()
+	s.options.KeepWorkspace = false
 }
 
 func (s *runnerCleanupSuite) SetUpSuite(c *check.C) {
 	s.cloudClient = &fakeCloudClient{}
-	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{})
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
 	s.options = &flags.Options{
 		Action:        "cleanup",
 		Release:       "15.04",
@@ -214,7 +351,7 @@ func (s *runnerCleanupSuite) SetUpTest(c *check.C) {
 
 func (s *runnerPurgeSuite) SetUpSuite(c *check.C) {
 	s.cloudClient = &fakeCloudClient{}
-	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{})
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
 	s.options = &flags.Options{
 		Action:        "purge",
 		Release:       "15.04",
@@ -230,9 +367,54 @@ func (s *runnerPurgeSuite) SetUpTest(c *check.C) {
 	s.options.Action = "purge"
 }
 
+func (s *runnerCacheSuite) SetUpSuite(c *check.C) {
+	s.snapCache = &fakeSnapCache{}
+	s.subject = NewRunner(&fakeSiClient{}, &fakeCloudClient{}, &fakeImgDriver{}, s.snapCache, &fakeBuildHost{}, false)
+	s.options = &flags.Options{Action: "cache"}
+}
+
+func (s *runnerCacheSuite) SetUpTest(c *check.C) {
+	s.snapCache.listCalls = 0
+	s.snapCache.pruneCalls = 0
+	s.snapCache.doListErr = false
+	s.snapCache.doPruneErr = false
+	s.snapCache.entries = []cache.Entry{
+		{Name: "mykernel", Revision: 3, Digest: "mydigest", Size: 100, LastUsed: time.Now()}}
+}
+
+func (s *runnerLockSuite) SetUpSuite(c *check.C) {
+	s.subject = NewRunner(&fakeSiClient{}, &fakeCloudClient{}, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
+}
+
+func (s *runnerLockSuite) SetUpTest(c *check.C) {
+	dir := c.MkDir()
+	s.options = &flags.Options{
+		Action:       "lock",
+		ManifestFile: filepath.Join(dir, "manifest.json"),
+		LockFile:     filepath.Join(dir, "snaps.lock"),
+	}
+	m := &manifest.Manifest{Release: "16.04", Arch: "amd64", Snaps: []manifest.Snap{
+		{Name: "mykernel", Type: manifest.TypeKernel, Channel: "edge", Revision: 3, Digest: "mydigest", Size: 100}}}
+	c.Assert(m.Write(s.options.ManifestFile), check.IsNil)
+}
+
+func (s *runnerManifestSuite) SetUpSuite(c *check.C) {
+	s.cloudClient = &fakeCloudClient{}
+	s.subject = NewRunner(&fakeSiClient{}, s.cloudClient, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
+}
+
+func (s *runnerManifestSuite) SetUpTest(c *check.C) {
+	s.options = &flags.Options{Action: "manifest", ManifestFile: "mymanifest", ImageID: "myimage"}
+	s.cloudClient.getVersionsCalls = make(map[string]int)
+	s.cloudClient.getManifestCalls = make(map[string]int)
+	s.cloudClient.versions = []string{"newimage", "oldimage"}
+	s.cloudClient.doVerErr = false
+	s.cloudClient.doManifestErr = false
+}
+
 func (s *runnerCreateSuite) TestExecCreateGetsSIVersionFor1504(c *check.C) {
 	s.options.Release = "15.04"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -242,7 +424,7 @@ func (s *runnerCreateSuite) TestExecCreateGetsSIVersionFor1504(c *check.C) {
 
 func (s *runnerCreateSuite) TestExecCreateDoesNotGetSIVersionForNon1504(c *check.C) {
 	s.options.Release = "non-15.04"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -252,7 +434,7 @@ func (s *runnerCreateSuite) TestExecCreateDoesNotGetSIVersionForNon1504(c *check
 
 func (s *runnerCreateSuite) TestExecDoesNotGetSIVersionOnNonCreateAction(c *check.C) {
 	s.options.Action = "non-create"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 
@@ -261,14 +443,14 @@ func (s *runnerCreateSuite) TestExecDoesNotGetSIVersionOnNonCreateAction(c *chec
 
 func (s *runnerCreateSuite) TestExecReturnsGetSIVersionError(c *check.C) {
 	s.siClient.doErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, siVersionError)
 }
 
 func (s *runnerCreateSuite) TestExecGetsCloudLatestVersionFor1504(c *check.C) {
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -278,7 +460,7 @@ func (s *runnerCreateSuite) TestExecGetsCloudLatestVersionFor1504(c *check.C) {
 
 func (s *runnerCreateSuite) TestExecDoesNotGetCloudLatestVersionForNon1504(c *check.C) {
 	s.options.Release = "non15.04"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -286,9 +468,19 @@ func (s *runnerCreateSuite) TestExecDoesNotGetCloudLatestVersionForNon1504(c *ch
 	c.Assert(s.cloudClient.getLatestVersionCalls[key], check.Equals, 0)
 }
 
+func (s *runnerCreateSuite) TestExecCreatePassesContextToDriver(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	err := s.subject.Exec(ctx, s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.udfDriver.ctx, check.Equals, ctx)
+}
+
 func (s *runnerCreateSuite) TestExecDoesNotGetCloudVersionOnNonCreateAction(c *check.C) {
 	s.options.Action = "non-create"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 
@@ -297,7 +489,7 @@ func (s *runnerCreateSuite) TestExecDoesNotGetCloudVersionOnNonCreateAction(c *c
 
 func (s *runnerCreateSuite) TestExecReturnsGetCloudVersionError(c *check.C) {
 	s.cloudClient.doVerErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, cloudLatestVersionError)
@@ -305,7 +497,7 @@ func (s *runnerCreateSuite) TestExecReturnsGetCloudVersionError(c *check.C) {
 
 func (s *runnerCreateSuite) TestExecDoesNotReturnGetCloudVersionNotFoundError(c *check.C) {
 	s.cloudClient.doVerNotFoundErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 }
@@ -322,7 +514,7 @@ func (s *runnerCreateSuite) TestExecReturnsErrVersionIfCloudVersionNotLessThanSI
 		s.siClient.version = item.siVersion
 		s.cloudClient.version = item.cloudVersion
 
-		err := s.subject.Exec(s.options)
+		err := s.subject.Exec(context.Background(), s.options)
 
 		c.Assert(err, check.FitsTypeOf, item.expectedError)
 		c.Assert(err.Error(), check.Equals, item.expectedError.Error())
@@ -330,7 +522,7 @@ func (s *runnerCreateSuite) TestExecReturnsErrVersionIfCloudVersionNotLessThanSI
 }
 
 func (s *runnerCreateSuite) TestExecCallsDriverCreateWithSIVersionFor1504(c *check.C) {
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -340,7 +532,7 @@ func (s *runnerCreateSuite) TestExecCallsDriverCreateWithSIVersionFor1504(c *che
 
 func (s *runnerCreateSuite) TestExecCallsDriverCreateWithZeroForNon1504(c *check.C) {
 	s.options.Release = "non15.04"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -350,7 +542,7 @@ func (s *runnerCreateSuite) TestExecCallsDriverCreateWithZeroForNon1504(c *check
 
 func (s *runnerCreateSuite) TestExecDoesNotCallDriverCreateOnNonCreateAction(c *check.C) {
 	s.options.Action = "non-create"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 
@@ -359,7 +551,7 @@ func (s *runnerCreateSuite) TestExecDoesNotCallDriverCreateOnNonCreateAction(c *
 
 func (s *runnerCreateSuite) TestExecReturnsDriverCreateError(c *check.C) {
 	s.udfDriver.doErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, udfCreateError)
@@ -367,7 +559,7 @@ func (s *runnerCreateSuite) TestExecReturnsDriverCreateError(c *check.C) {
 
 func (s *runnerCreateSuite) TestExecCallsCloudCreate(c *check.C) {
 	s.udfDriver.path = "mypath"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -378,7 +570,7 @@ func (s *runnerCreateSuite) TestExecCallsCloudCreate(c *check.C) {
 func (s *runnerCreateSuite) TestExecCallsCloudCreateWithZeroVersionForNon1504(c *check.C) {
 	s.options.Release = "non15.04"
 	s.udfDriver.path = "mypath"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -388,7 +580,7 @@ func (s *runnerCreateSuite) TestExecCallsCloudCreateWithZeroVersionForNon1504(c
 
 func (s *runnerCreateSuite) TestExecDoesNotCallCloudCreateOnNonCreateAction(c *check.C) {
 	s.options.Action = "non-create"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 
@@ -397,29 +589,152 @@ func (s *runnerCreateSuite) TestExecDoesNotCallCloudCreateOnNonCreateAction(c *c
 
 func (s *runnerCreateSuite) TestExecReturnsCloudCreateError(c *check.C) {
 	s.cloudClient.doCreateErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, cloudCreateError)
 }
 
-func (s *runnerCreateSuite) TestExecRemovesImageFile(c *check.C) {
-	tmpFile, err := ioutil.TempFile("", "")
-	defer os.Remove(tmpFile.Name())
+func (s *runnerCreateSuite) TestExecCreatesImageInWorkspace(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
 	c.Assert(err, check.IsNil)
+	c.Assert(filepath.Dir(s.udfDriver.dir), check.Equals, s.options.WorkspaceRoot)
+}
 
-	s.udfDriver.path = tmpFile.Name()
+func (s *runnerCreateSuite) TestExecRemovesWorkspace(c *check.C) {
+	s.subject.Exec(context.Background(), s.options)
 
-	s.subject.Exec(s.options)
+	_, err := os.Stat(s.udfDriver.dir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
 
-	_, err = os.Stat(tmpFile.Name())
+func (s *runnerCreateSuite) TestExecRemovesWorkspaceOnDriverError(c *check.C) {
+	s.udfDriver.doErr = true
+
+	s.subject.Exec(context.Background(), s.options)
+
+	_, err := os.Stat(s.udfDriver.dir)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerCreateSuite) TestExecRemovesWorkspaceWhenCancelled(c *check.C) {
+	s.udfDriver.wait = true
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(10*time.Millisecond, cancel)
 
+	err := s.subject.Exec(ctx, s.options)
+
+	c.Assert(err, check.Equals, context.Canceled)
+	_, err = os.Stat(s.udfDriver.dir)
 	c.Assert(os.IsNotExist(err), check.Equals, true)
 }
 
+func (s *runnerCreateSuite) TestExecKeepsWorkspace(c *check.C) {
+	s.options.KeepWorkspace = true
+
+	s.subject.Exec(context.Background(), s.options)
+
+	_, err := os.Stat(s.udfDriver.dir)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsWorkspaceError(c *check.C) {
+	workspaceMinFree = func(int) uint64 { return 1 << 62 }
+	defer func() { workspaceMinFree = func(int) uint64 { return 0 } }()
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &workspace.ErrNoSpace{})
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+// fakeBuildHost is the builder of the runner, it answers the free space
+// queries of the workspace
+type fakeBuildHost struct {
+	calls []string
+}
+
+func (f *fakeBuildHost) ExecCommand(ctx context.Context, cmds ...string) (string, error) {
+	f.calls = append(f.calls, strings.Join(cmds, " "))
+	return "Avail\n0\n", nil
+}
+
+func (s *runnerCreateSuite) TestExecChecksWorkspaceOfBuildHost(c *check.C) {
+	workspaceMinFree = func(int) uint64 { return 1 }
+	defer func() { workspaceMinFree = func(int) uint64 { return 0 } }()
+	host := &fakeBuildHost{}
+	subject := NewRunner(s.siClient, s.cloudClient, s.udfDriver, nil, host, true)
+
+	err := subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &workspace.ErrNoSpace{})
+	c.Assert(host.calls, check.DeepEquals, []string{"df --output=avail -B1 " + s.options.WorkspaceRoot})
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestWorkspaceMinFreeDependsOnDiskSize(c *check.C) {
+	c.Assert(s.backupMinFree(0), check.Equals, uint64(2*image.DefaultDiskSize)<<30)
+	c.Assert(s.backupMinFree(10), check.Equals, uint64(20)<<30)
+}
+
+func (s *runnerCreateSuite) TestExecChecksContentForNon1504(c *check.C) {
+	s.options.Release = "non15.04"
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	key := getFakeKey(s.options)
+	c.Assert(s.udfDriver.contentIDCalls[key], check.Equals, 1)
+	c.Assert(s.cloudClient.findContentCalls[key+" - "+testContentID], check.Equals, 1)
+	c.Assert(s.udfDriver.createCalls[getCreateKey(s.options, 0)], check.Equals, 1)
+}
+
+func (s *runnerCreateSuite) TestExecDoesNotCheckContentFor1504(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(s.udfDriver.contentIDCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.findContentCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecSkipsExistingContent(c *check.C) {
+	s.options.Release = "non15.04"
+	s.cloudClient.contentImage = "myimage"
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrContentExists{})
+	c.Assert(err.Error(), check.Equals, "error image myimage already has the content "+testContentID)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+	c.Assert(len(s.cloudClient.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsContentIDError(c *check.C) {
+	s.options.Release = "non15.04"
+	s.udfDriver.doContentIDErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, udfContentIDError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
+func (s *runnerCreateSuite) TestExecReturnsFindContentError(c *check.C) {
+	s.options.Release = "non15.04"
+	s.cloudClient.doFindContentErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudFindContentError)
+	c.Assert(len(s.udfDriver.createCalls), check.Equals, 0)
+}
+
 func (s *runnerCreateSuite) TestExecReturnsErrorOnInvalidAction(c *check.C) {
 	s.options.Action = "invalid-action"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 	expectedError := &ErrActionUnknown{action: s.options.Action}
 
 	c.Assert(err, check.FitsTypeOf, expectedError)
@@ -428,7 +743,7 @@ func (s *runnerCreateSuite) TestExecReturnsErrorOnInvalidAction(c *check.C) {
 
 func (s *runnerCleanupSuite) TestExecGetsCloudVersions(c *check.C) {
 	s.options.Release = "1504"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.IsNil)
 
@@ -438,7 +753,7 @@ func (s *runnerCleanupSuite) TestExecGetsCloudVersions(c *check.C) {
 
 func (s *runnerCreateSuite) TestExecDoesNotGetCloudVersionsOnNonCleanupAction(c *check.C) {
 	s.options.Action = "non-cleanup"
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 
@@ -447,7 +762,7 @@ func (s *runnerCreateSuite) TestExecDoesNotGetCloudVersionsOnNonCleanupAction(c
 
 func (s *runnerCleanupSuite) TestExecGetVersionsReceivesReleaseWithoutDots(c *check.C) {
 	s.options.Release = "15.04"
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	key := getFakeKey(s.options)
 	fmt.Println(s.cloudClient.getVersionsCalls)
@@ -456,7 +771,7 @@ func (s *runnerCleanupSuite) TestExecGetVersionsReceivesReleaseWithoutDots(c *ch
 
 func (s *runnerCleanupSuite) TestExecReturnsGetVersionsError(c *check.C) {
 	s.cloudClient.doVerErr = true
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, cloudVersionsError)
@@ -471,7 +786,7 @@ func (s *runnerCleanupSuite) TestExecCallsDeleteForExcedentImages(c *check.C) {
 			cloud.GetImageID(s.options, i+base))
 	}
 
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	expectedCall := getDeleteKey(s.cloudClient.versions[imagesToKeep:])
 
@@ -486,7 +801,7 @@ func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteWithouExcedentImages(c *ch
 			cloud.GetImageID(s.options, i+base))
 	}
 
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(len(s.cloudClient.deleteCalls), check.Equals, 0)
 }
@@ -497,7 +812,7 @@ func (s *runnerCleanupSuite) TestExecDoesNotCallDeleteOnGetVersionsError(c *chec
 		s.cloudClient.versions = append(s.cloudClient.versions, "version"+strconv.Itoa(i))
 	}
 
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(len(s.cloudClient.deleteCalls), check.Equals, 0)
 }
@@ -508,14 +823,14 @@ func (s *runnerCleanupSuite) TestExecReturnsDeleteError(c *check.C) {
 		s.cloudClient.versions = append(s.cloudClient.versions, "version"+strconv.Itoa(i))
 	}
 
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, cloudDeleteError)
 }
 
 func (s *runnerPurgeSuite) TestExecCallsPurge(c *check.C) {
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(s.cloudClient.purgeCalls, check.Equals, 1)
 }
@@ -523,7 +838,7 @@ func (s *runnerPurgeSuite) TestExecCallsPurge(c *check.C) {
 func (s *runnerPurgeSuite) TestExecDoesNotCallPurgeOnNonPurgeAction(c *check.C) {
 	s.options.Action = "non-purge"
 
-	s.subject.Exec(s.options)
+	s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(s.cloudClient.purgeCalls, check.Equals, 0)
 }
@@ -531,12 +846,123 @@ func (s *runnerPurgeSuite) TestExecDoesNotCallPurgeOnNonPurgeAction(c *check.C)
 func (s *runnerPurgeSuite) TestExecReturnsPurgeError(c *check.C) {
 	s.cloudClient.doPurgeErr = true
 
-	err := s.subject.Exec(s.options)
+	err := s.subject.Exec(context.Background(), s.options)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err.Error(), check.Equals, cloudPurgeError)
 }
 
+func (s *runnerCacheSuite) TestExecPrunesAndListsCache(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.snapCache.pruneCalls, check.Equals, 1)
+	c.Assert(s.snapCache.listCalls, check.Equals, 1)
+}
+
+func (s *runnerCacheSuite) TestExecReturnsPruneError(c *check.C) {
+	s.snapCache.doPruneErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cachePruneError)
+	c.Assert(s.snapCache.listCalls, check.Equals, 0)
+}
+
+func (s *runnerCacheSuite) TestExecReturnsListError(c *check.C) {
+	s.snapCache.doListErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cacheListError)
+}
+
+func (s *runnerCacheSuite) TestExecReturnsErrCacheDisabledWithoutCache(c *check.C) {
+	subject := NewRunner(&fakeSiClient{}, &fakeCloudClient{}, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
+
+	err := subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrCacheDisabled{})
+}
+
+func (s *runnerLockSuite) TestExecWritesLockFromManifest(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	lock, err := manifest.ReadLock(s.options.LockFile)
+	c.Assert(err, check.IsNil)
+	c.Assert(lock.Snaps, check.DeepEquals, []manifest.Snap{
+		{Name: "mykernel", Type: manifest.TypeKernel, Channel: "edge", Revision: 3}})
+}
+
+func (s *runnerLockSuite) TestExecReturnsManifestReadError(c *check.C) {
+	s.options.ManifestFile += ".missing"
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	_, err = os.Stat(s.options.LockFile)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *runnerLockSuite) TestExecReturnsErrLockPathsWithoutPaths(c *check.C) {
+	for _, options := range []*flags.Options{
+		{Action: "lock", ManifestFile: s.options.ManifestFile},
+		{Action: "lock", LockFile: s.options.LockFile},
+	} {
+		err := s.subject.Exec(context.Background(), options)
+
+		c.Check(err, check.FitsTypeOf, &ErrLockPaths{})
+	}
+}
+
+func (s *runnerManifestSuite) TestExecGetsManifestOfGivenImage(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.getManifestCalls["myimage - mymanifest"], check.Equals, 1)
+	c.Assert(len(s.cloudClient.getVersionsCalls), check.Equals, 0)
+}
+
+func (s *runnerManifestSuite) TestExecGetsManifestOfLatestImage(c *check.C) {
+	s.options.ImageID = ""
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.cloudClient.getManifestCalls["newimage - mymanifest"], check.Equals, 1)
+}
+
+func (s *runnerManifestSuite) TestExecReturnsGetVersionsError(c *check.C) {
+	s.options.ImageID = ""
+	s.cloudClient.doVerErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudVersionsError)
+	c.Assert(len(s.cloudClient.getManifestCalls), check.Equals, 0)
+}
+
+func (s *runnerManifestSuite) TestExecReturnsGetManifestError(c *check.C) {
+	s.cloudClient.doManifestErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, cloudManifestError)
+}
+
+func (s *runnerManifestSuite) TestExecReturnsErrManifestPathWithoutPath(c *check.C) {
+	s.options.ManifestFile = ""
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrManifestPath{})
+}
+
 func getFakeKey(options *flags.Options) string {
 	return fmt.Sprintf("%s - %s - %s", options.Release, options.OSChannel, options.Arch)
 }
@@ -552,3 +978,40 @@ func getFullCreateKey(path string, options *flags.Options, ver int) string {
 func getDeleteKey(versions []string) string {
 	return strings.Join(versions, " ")
 }
+
+func (s *runnerChannelsSuite) SetUpSuite(c *check.C) {
+	s.siClient = &fakeSiClient{}
+	s.subject = NewRunner(s.siClient, &fakeCloudClient{}, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
+	s.options = &flags.Options{Action: "channels"}
+}
+
+func (s *runnerChannelsSuite) SetUpTest(c *check.C) {
+	s.siClient.getChannelsCalls = 0
+	s.siClient.doChannelsErr = false
+	s.siClient.channels = []si.Channel{
+		{Release: "15.04", Name: "edge", Devices: []string{"generic_amd64", "mydevice"}, Archs: []string{"amd64"}}}
+}
+
+func (s *runnerChannelsSuite) TestExecGetsChannels(c *check.C) {
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.siClient.getChannelsCalls, check.Equals, 1)
+}
+
+func (s *runnerChannelsSuite) TestExecReturnsGetChannelsError(c *check.C) {
+	s.siClient.doChannelsErr = true
+
+	err := s.subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.NotNil)
+	c.Assert(err.Error(), check.Equals, siChannelsError)
+}
+
+func (s *runnerChannelsSuite) TestExecReturnsErrChannelsUnsupported(c *check.C) {
+	subject := NewRunner(&fakePollster{}, &fakeCloudClient{}, &fakeImgDriver{}, nil, &fakeBuildHost{}, false)
+
+	err := subject.Exec(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrChannelsUnsupported{})
+}
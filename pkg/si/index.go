@@ -0,0 +1,142 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Types of the images of an index
+const (
+	TypeFull  = "full"
+	TypeDelta = "delta"
+)
+
+const (
+	errNoFullImageFmt = "No full image found for release %s, channel %s and arch %s"
+	errFilterFmt      = " matching %s"
+)
+
+// Index is the content of the index.json file of a release, channel and device
+type Index struct {
+	Global map[string]interface{} `json:"global"`
+	Images []Image                `json:"images"`
+}
+
+// Image is one of the versions of an index, full images hold the whole system
+// and delta images the changes from their base version
+type Image struct {
+	Description   string `json:"description"`
+	Type          string `json:"type"`
+	Version       int    `json:"version"`
+	Base          int    `json:"base,omitempty"`
+	VersionDetail string `json:"version_detail"`
+	Files         []File `json:"files"`
+}
+
+// File is one of the files that make up an image
+type File struct {
+	Checksum  string `json:"checksum"`
+	Order     int    `json:"order"`
+	Path      string `json:"path"`
+	Signature string `json:"signature"`
+	Size      int64  `json:"size"`
+}
+
+// Filter selects images by the components of their version_detail, an image
+// matches when it has all the components of the filter with the same values
+type Filter map[string]string
+
+func (f Filter) String() string {
+	var items []string
+	for key, value := range f {
+		items = append(items, key+"="+value)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+// Matches returns true if the image has all the components of the filter
+func (f Filter) Matches(image *Image) bool {
+	details := image.Details()
+	for key, value := range f {
+		if detail, ok := details[key]; !ok || detail != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ErrNoFullImage is the error returned when an index has no full image
+// matching the requested filter
+type ErrNoFullImage struct {
+	release, channel, arch string
+	filter                 Filter
+}
+
+func (e *ErrNoFullImage) Error() string {
+	msg := fmt.Sprintf(errNoFullImageFmt, e.release, e.channel, e.arch)
+	if len(e.filter) > 0 {
+		msg += fmt.Sprintf(errFilterFmt, e.filter)
+	}
+	return msg
+}
+
+// ParseIndex decodes the content of an index.json file
+func ParseIndex(content []byte) (*Index, error) {
+	index := &Index{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// Details returns the components of the version_detail of the image, which has
+// the form ubuntu=20150831,raw-device=20150831,version=157
+func (i *Image) Details() map[string]string {
+	details := make(map[string]string)
+	for _, item := range strings.Split(i.VersionDetail, ",") {
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			continue
+		}
+		details[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return details
+}
+
+// LatestFull returns the full image with the highest version matching filter,
+// a nil filter matches every image
+func (i *Index) LatestFull(filter Filter) (*Image, bool) {
+	var latest *Image
+	for n := range i.Images {
+		image := &i.Images[n]
+		if image.Type != TypeFull || !filter.Matches(image) {
+			continue
+		}
+		if latest == nil || image.Version > latest.Version {
+			latest = image
+		}
+	}
+	return latest, latest != nil
+}
@@ -0,0 +1,95 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&indexSuite{})
+
+type indexSuite struct {
+	index *Index
+}
+
+func (s *indexSuite) SetUpTest(c *check.C) {
+	var err error
+	s.index, err = ParseIndex([]byte(`{
+    "global": {"generated_at": "Wed Oct 21 06:11:44 UTC 2015"},
+    "images": [
+        {"type": "full", "version": 3, "version_detail": "ubuntu=20160101,device=20160101,version=3"},
+        {"type": "full", "version": 5, "version_detail": "ubuntu=20160303,device=20160101,version=5"},
+        {"type": "delta", "version": 6, "base": 5, "version_detail": "ubuntu=20160404,device=20160101,version=6"},
+        {"type": "full", "version": 4, "version_detail": "ubuntu=20160202,device=20160202,version=4"}
+    ]
+}`))
+	c.Assert(err, check.IsNil)
+}
+
+func (s *indexSuite) TestParseIndexReturnsUnmarshalError(c *check.C) {
+	_, err := ParseIndex([]byte("not json"))
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *indexSuite) TestParseIndexReadsDeltaBase(c *check.C) {
+	c.Assert(s.index.Images[2].Type, check.Equals, TypeDelta)
+	c.Assert(s.index.Images[2].Base, check.Equals, 5)
+}
+
+func (s *indexSuite) TestDetailsSplitsVersionDetail(c *check.C) {
+	image := &Image{VersionDetail: "ubuntu=20150831, raw-device=20150831,version=157,broken,=empty"}
+
+	c.Assert(image.Details(), check.DeepEquals, map[string]string{
+		"ubuntu": "20150831", "raw-device": "20150831", "version": "157"})
+}
+
+func (s *indexSuite) TestDetailsOfEmptyVersionDetail(c *check.C) {
+	c.Assert((&Image{}).Details(), check.DeepEquals, map[string]string{})
+}
+
+func (s *indexSuite) TestLatestFullSkipsDeltas(c *check.C) {
+	image, ok := s.index.LatestFull(nil)
+
+	c.Assert(ok, check.Equals, true)
+	c.Assert(image.Version, check.Equals, 5)
+}
+
+func (s *indexSuite) TestLatestFullAppliesFilter(c *check.C) {
+	image, ok := s.index.LatestFull(Filter{"device": "20160101"})
+	c.Assert(ok, check.Equals, true)
+	c.Assert(image.Version, check.Equals, 5)
+
+	image, ok = s.index.LatestFull(Filter{"ubuntu": "20160101", "device": "20160101"})
+	c.Assert(ok, check.Equals, true)
+	c.Assert(image.Version, check.Equals, 3)
+
+	_, ok = s.index.LatestFull(Filter{"ubuntu": "20160404"})
+	c.Assert(ok, check.Equals, false)
+
+	_, ok = s.index.LatestFull(Filter{"mykey": "myvalue"})
+	c.Assert(ok, check.Equals, false)
+}
+
+func (s *indexSuite) TestLatestFullOfEmptyIndex(c *check.C) {
+	_, ok := (&Index{}).LatestFull(nil)
+
+	c.Assert(ok, check.Equals, false)
+}
@@ -0,0 +1,195 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+)
+
+const (
+	keyringPath          = "/gpg/"
+	keyringArchiveSuffix = ".tar.xz"
+	keyringFile          = "keyring.gpg"
+	keyringMetaFile      = "keyring.json"
+	archiveMasterType    = "archive-master"
+	imageMasterType      = "image-master"
+	imageSigningType     = "image-signing"
+	deviceSigningType    = "device-signing"
+	blacklistType        = "blacklist"
+	errKeyringTypeFmt    = "it is a %s keyring instead of %s"
+	errKeyringExpiredFmt = "it expired on %s"
+	errMissingFileFmt    = "%s not found in the archive"
+)
+
+// keyringMeta is the content of the keyring.json file of a keyring archive
+type keyringMeta struct {
+	Type   string `json:"type"`
+	Expiry int64  `json:"expiry"`
+}
+
+// decompressXZ returns the decompressed content of an xz file
+var decompressXZ = func(content []byte) ([]byte, error) {
+	cmd := exec.Command("xz", "--decompress", "--stdout")
+	cmd.Stdin = bytes.NewReader(content)
+	output, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		return nil, fmt.Errorf("xz failed, %s", strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return output, err
+}
+
+// readKeyringArchive returns the keys of a system-image keyring archive, a
+// tar.xz file with a keyring.gpg keyring and its keyring.json description, that
+// must be of the given type and not expired
+func readKeyringArchive(name string, content []byte, keyringType string) (openpgp.EntityList, error) {
+	content, err := decompressXZ(content)
+	if err != nil {
+		return nil, &ErrKeyring{path: name, msg: err.Error()}
+	}
+	files := make(map[string][]byte)
+	archive := tar.NewReader(bytes.NewReader(content))
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, &ErrKeyring{path: name, msg: err.Error()}
+		}
+		fileName := strings.TrimPrefix(header.Name, "./")
+		if fileName != keyringFile && fileName != keyringMetaFile {
+			continue
+		}
+		if files[fileName], err = ioutil.ReadAll(archive); err != nil {
+			return nil, &ErrKeyring{path: name, msg: err.Error()}
+		}
+	}
+	for _, fileName := range []string{keyringFile, keyringMetaFile} {
+		if _, ok := files[fileName]; !ok {
+			return nil, &ErrKeyring{path: name, msg: fmt.Sprintf(errMissingFileFmt, fileName)}
+		}
+	}
+	var meta keyringMeta
+	if err = json.Unmarshal(files[keyringMetaFile], &meta); err != nil {
+		return nil, &ErrKeyring{path: name, msg: err.Error()}
+	}
+	if meta.Type != keyringType {
+		return nil, &ErrKeyring{path: name, msg: fmt.Sprintf(errKeyringTypeFmt, meta.Type, keyringType)}
+	}
+	if meta.Expiry != 0 && time.Unix(meta.Expiry, 0).Before(time.Now()) {
+		return nil, &ErrKeyring{path: name, msg: fmt.Sprintf(errKeyringExpiredFmt, time.Unix(meta.Expiry, 0).UTC())}
+	}
+	return readEntities(name, files[keyringFile])
+}
+
+// readEntities returns the keys of an armored or binary keyring
+func readEntities(name string, content []byte) (openpgp.EntityList, error) {
+	entities, err := openpgp.ReadArmoredKeyRing(bytes.NewReader(content))
+	if err != nil {
+		if entities, err = openpgp.ReadKeyRing(bytes.NewReader(content)); err != nil {
+			return nil, &ErrKeyring{path: name, msg: err.Error()}
+		}
+	}
+	if len(entities) == 0 {
+		return nil, &ErrKeyring{path: name, msg: errEmptyKeyring}
+	}
+	return entities, nil
+}
+
+// signingKeys returns the keys trusted to sign the files of server: its image
+// signing and device signing keyrings, checked up to the archive master keyring
+// through the image master one, without the keys of its blacklist
+func (c *Client) signingKeys(ctx context.Context, server string) (openpgp.EntityList, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if keys, ok := c.keys[server]; ok {
+		return keys, nil
+	}
+	imageMaster, err := c.getKeyring(ctx, server, imageMasterType, c.keyring, false)
+	if err != nil {
+		return nil, err
+	}
+	blacklist, err := c.getKeyring(ctx, server, blacklistType, imageMaster, true)
+	if err != nil {
+		return nil, err
+	}
+	imageMaster = withoutKeys(imageMaster, blacklist)
+	imageSigning, err := c.getKeyring(ctx, server, imageSigningType, imageMaster, false)
+	if err != nil {
+		return nil, err
+	}
+	imageSigning = withoutKeys(imageSigning, blacklist)
+	deviceSigning, err := c.getKeyring(ctx, server, deviceSigningType, imageSigning, true)
+	if err != nil {
+		return nil, err
+	}
+	keys := append(imageSigning, withoutKeys(deviceSigning, blacklist)...)
+	c.keys[server] = keys
+	return keys, nil
+}
+
+// getKeyring returns the keys of the keyring archive of the given type in
+// server, which must be signed by one of the keys of signers. An optional
+// keyring that the server doesn't have is empty
+func (c *Client) getKeyring(ctx context.Context, server, keyringType string, signers openpgp.EntityList, optional bool) (openpgp.EntityList, error) {
+	url := server + keyringPath + keyringType + keyringArchiveSuffix
+	content, err := c.httpClient.GetContext(ctx, url)
+	if err != nil {
+		if statusErr, ok := err.(*web.ErrHTTPStatus); ok && optional && statusErr.Code() == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if err = c.verify(ctx, signers, url, content); err != nil {
+		return nil, err
+	}
+	return readKeyringArchive(url, content, keyringType)
+}
+
+// withoutKeys returns the keys of keyring whose fingerprints are not in blacklist
+func withoutKeys(keyring, blacklist openpgp.EntityList) (keys openpgp.EntityList) {
+	for _, key := range keyring {
+		blacklisted := false
+		for _, other := range blacklist {
+			if key.PrimaryKey.Fingerprint == other.PrimaryKey.Fingerprint {
+				blacklisted = true
+				break
+			}
+		}
+		if !blacklisted {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
@@ -21,84 +21,281 @@
 package si
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strings"
+	"sync"
 
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
+	"golang.org/x/crypto/openpgp"
 )
 
+// DefaultServer is the base URL of the public system-image server
+const DefaultServer = "http://system-image.ubuntu.com"
+
 const (
-	baseURL      = "http://system-image.ubuntu.com/ubuntu-core"
-	dataFileName = "index.json"
+	basePath           = "ubuntu-core"
+	archPlaceholder    = "%s"
+	dataFileName       = "index.json"
+	channelsFileName   = "channels.json"
+	errNotAvailableFmt = "Release %s, channel %s and arch %s are not available in the system-image server"
 )
 
+// Config holds the location of the system-image server
+type Config struct {
+	// Servers are the base URLs of the server and its mirrors, in the order
+	// they are tried. If empty DefaultServer is used
+	Servers []string
+	// DevicePattern is the name of the device of an arch in the server, with %s
+	// replaced by the arch name. If empty the device of the arch profile is used
+	DevicePattern string
+	// HTTPS makes the http servers be queried over https
+	HTTPS bool
+	// Insecure makes the signatures of the files of the server not be checked
+	Insecure bool
+}
+
 // Client is the default implementation of Driver
 type Client struct {
-	httpClient web.Getter
+	httpClient    web.ContextGetter
+	keyring       openpgp.EntityList
+	servers       []string
+	devicePattern string
+	insecure      bool
+
+	mu sync.Mutex
+	// keys are the signing keys of each server, already checked
+	keys map[string]openpgp.EntityList
+}
+
+// NewClient is the Client constructor. The signatures of the files fetched
+// from the server are checked with its keyrings, which must chain up to the
+// archive master keyring. Unless config is insecure, every file is rejected
+// without an archive master keyring. A nil config means the public server
+func NewClient(httpClient web.ContextGetter, keyring openpgp.EntityList, config *Config) *Client {
+	if config == nil {
+		config = &Config{}
+	}
+	servers := config.Servers
+	if len(servers) == 0 {
+		servers = []string{DefaultServer}
+	}
+	c := &Client{httpClient: httpClient, keyring: keyring, devicePattern: config.DevicePattern,
+		insecure: config.Insecure, keys: make(map[string]openpgp.EntityList)}
+	for _, server := range servers {
+		server = strings.TrimSuffix(server, "/")
+		if config.HTTPS && strings.HasPrefix(server, "http://") {
+			server = "https://" + strings.TrimPrefix(server, "http://")
+		}
+		c.servers = append(c.servers, server)
+	}
+	return c
 }
 
-// NewClient is the Client constructor
-func NewClient(httpClient web.Getter) *Client {
-	return &Client{httpClient}
+// ErrNotAvailable is the error returned when the server has no images for the
+// requested release, channel and arch
+type ErrNotAvailable struct {
+	release, channel, arch string
 }
 
-type response struct {
-	Global interface{}
-	Images images
+func (e *ErrNotAvailable) Error() string {
+	return fmt.Sprintf(errNotAvailableFmt, e.release, e.channel, e.arch)
 }
 
-type images []image
+// Channel is a release and channel of the system-image server, together with
+// the devices that have images in it and the supported archs of those devices
+type Channel struct {
+	Release, Name string
+	Devices       []string
+	Archs         []string
+}
 
-type image struct {
-	Description   string
-	Type          string
-	Version       int
-	VersionDetail string `json:"version_detail"`
-	Files         files
+type byReleaseAndName []Channel
+
+func (c byReleaseAndName) Len() int      { return len(c) }
+func (c byReleaseAndName) Swap(i, j int) { c[i], c[j] = c[j], c[i] }
+func (c byReleaseAndName) Less(i, j int) bool {
+	if c[i].Release != c[j].Release {
+		return c[i].Release < c[j].Release
+	}
+	return c[i].Name < c[j].Name
 }
 
-type files []file
+// channelsResponse is the content of channels.json, keyed by base/release/channel
+type channelsResponse map[string]struct {
+	Devices map[string]json.RawMessage
+}
+
+// GetLatestVersion returns the highest version of the full images in the system
+// image server for the given release, channel and arch, or an error in case
+// something goes wrong
+func (c *Client) GetLatestVersion(ctx context.Context, options *flags.Options) (ver int, err error) {
+	return c.GetLatestMatchingVersion(ctx, options, nil)
+}
 
-type file struct {
-	CheckSum  string
-	Order     int
-	Path      string
-	Signature string
-	Size      int
+// GetLatestMatchingVersion returns the highest version of the full images whose
+// version_detail matches filter, ErrNoFullImage is returned if there is none
+func (c *Client) GetLatestMatchingVersion(ctx context.Context, options *flags.Options, filter Filter) (ver int, err error) {
+	index, err := c.GetIndex(ctx, options)
+	if err != nil {
+		return
+	}
+	image, ok := index.LatestFull(filter)
+	if !ok {
+		return 0, &ErrNoFullImage{release: options.Release, channel: options.OSChannel, arch: options.Arch, filter: filter}
+	}
+	return image.Version, nil
 }
 
-// GetLatestVersion returns the highest version from the system image server for the given
-// release, channel and arch, or an error in case something goes wrong
-func (c *Client) GetLatestVersion(options *flags.Options) (ver int, err error) {
-	url := generateURL(options)
-	content, err := c.httpClient.Get(url)
+// GetIndex returns the index of the given release, channel and arch
+func (c *Client) GetIndex(ctx context.Context, options *flags.Options) (index *Index, err error) {
+	path, err := c.indexPath(options)
 	if err != nil {
 		return
 	}
-	var res response
-	err = json.Unmarshal(content, &res)
+	if err = c.Validate(ctx, options); err != nil {
+		return
+	}
+	content, err := c.get(ctx, path)
+	if err != nil {
+		return
+	}
+	return ParseIndex(content)
+}
+
+// GetChannels returns the releases and channels available in the server, sorted
+// by release and channel name
+func (c *Client) GetChannels(ctx context.Context) (channels []Channel, err error) {
+	content, err := c.get(ctx, "/"+channelsFileName)
 	if err != nil {
 		return
 	}
+	var res channelsResponse
+	if err = json.Unmarshal(content, &res); err != nil {
+		return
+	}
+	for key, entry := range res {
+		parts := strings.Split(key, "/")
+		if len(parts) != 3 || parts[0] != basePath {
+			continue
+		}
+		channel := Channel{Release: parts[1], Name: parts[2]}
+		for device := range entry.Devices {
+			channel.Devices = append(channel.Devices, device)
+		}
+		sort.Strings(channel.Devices)
+		channel.Archs = c.archs(channel.Devices)
+		channels = append(channels, channel)
+	}
+	sort.Sort(byReleaseAndName(channels))
+	return
+}
 
-	index := len(res.Images) - 1
-	if index >= 0 {
-		for {
-			if res.Images[index].Type == "full" {
+// Validate returns ErrNotAvailable if the server hasn't got images for the
+// release, os channel and arch of the given options
+func (c *Client) Validate(ctx context.Context, options *flags.Options) error {
+	device, err := c.device(options.Arch)
+	if err != nil {
+		return err
+	}
+	channels, err := c.GetChannels(ctx)
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if channel.Release != options.Release || channel.Name != options.OSChannel {
+			continue
+		}
+		for _, channelDevice := range channel.Devices {
+			if channelDevice == device {
+				return nil
+			}
+		}
+	}
+	return &ErrNotAvailable{release: options.Release, channel: options.OSChannel, arch: options.Arch}
+}
+
+// get returns the content of the given path of the server, verifying its
+// signature unless the client is insecure. The mirrors are tried in order until one of
+// them succeeds, the error of the last one is returned if all of them fail
+func (c *Client) get(ctx context.Context, path string) (content []byte, err error) {
+	for n, server := range c.servers {
+		if n > 0 {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Warnf("Could not get %s from %s: %v, trying %s", path, c.servers[n-1], err, server)
+		}
+		if content, err = c.getURL(ctx, server, path); err == nil {
+			return
+		}
+	}
+	return
+}
+
+func (c *Client) getURL(ctx context.Context, server, path string) (content []byte, err error) {
+	url := server + path
+	content, err = c.httpClient.GetContext(ctx, url)
+	if err != nil {
+		return
+	}
+	if c.insecure {
+		log.Warnf("Not verifying the signature of %s", url)
+		return
+	}
+	if len(c.keyring) == 0 {
+		return nil, &ErrSignature{url: url, msg: errNoKeyring}
+	}
+	keys, err := c.signingKeys(ctx, server)
+	if err != nil {
+		return nil, err
+	}
+	if err = c.verify(ctx, keys, url, content); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// device returns the name in the server of the device of the given arch
+func (c *Client) device(archName string) (string, error) {
+	profile, err := arch.Get(archName)
+	if err != nil {
+		return "", err
+	}
+	if c.devicePattern == "" {
+		return profile.SIDevice, nil
+	}
+	return strings.Replace(c.devicePattern, archPlaceholder, profile.Name, -1), nil
+}
+
+// archs returns the names of the supported archs of the given devices
+func (c *Client) archs(devices []string) (archs []string) {
+	for _, name := range arch.Names() {
+		device, err := c.device(name)
+		if err != nil {
+			continue
+		}
+		for _, d := range devices {
+			if d == device {
+				archs = append(archs, name)
 				break
 			}
-			index--
 		}
-		ver = res.Images[index].Version
 	}
 	return
 }
 
-func generateURL(options *flags.Options) string {
-	if options.Arch == "arm" {
-		options.Arch += "hf"
+func (c *Client) indexPath(options *flags.Options) (string, error) {
+	device, err := c.device(options.Arch)
+	if err != nil {
+		return "", err
 	}
-	return fmt.Sprintf("%s/%s/%s/generic_%s/%s",
-		baseURL, options.Release, options.OSChannel, options.Arch, dataFileName)
+	return fmt.Sprintf("/%s/%s/%s/%s/%s",
+		basePath, options.Release, options.OSChannel, device, dataFileName), nil
 }
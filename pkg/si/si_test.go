@@ -20,11 +20,15 @@
 package si
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"strings"
 	"testing"
 
 	"gopkg.in/check.v1"
 
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/arch"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
 	"github.com/ubuntu-core/snappy-cloud-image/pkg/web"
 )
@@ -40,6 +44,7 @@ const (
 	testDefaultChannel = "edge"
 	testDefaultArch    = "amd64"
 	testImageVersion   = 198
+	testBaseURL        = DefaultServer + "/" + basePath
 	responseBase       = `{
     "global": {
         "generated_at": "Wed Oct 21 06:11:44 UTC 2015"
@@ -48,7 +53,9 @@ const (
         %s
     ]
 }`
-	imageBase = `{
+	channelsDevice = `"%s": {"index": "/ubuntu-core/%s/%s/%s/index.json"}`
+	channelsBase   = `"ubuntu-core/%s/%s": {"devices": {%s}}`
+	imageBase      = `{
             "description": "ubuntu=20150831,raw-device=20150831,version=157",
             "files": [
                 {
@@ -88,9 +95,14 @@ type siSuite struct {
 func Test(t *testing.T) { check.TestingT(t) }
 
 type fakeWebGetter struct {
-	calls  map[string]int
-	error  bool
-	output []byte
+	calls   map[string]int
+	error   bool
+	output  []byte
+	outputs map[string][]byte
+	// down are the servers whose urls return an error
+	down []string
+	// missing makes the urls without output return a 404 status
+	missing bool
 }
 
 func (w *fakeWebGetter) Get(url string) (output []byte, err error) {
@@ -98,18 +110,57 @@ func (w *fakeWebGetter) Get(url string) (output []byte, err error) {
 	if w.error {
 		err = &web.ErrHTTPGet{}
 	}
+	for _, server := range w.down {
+		if strings.HasPrefix(url, server+"/") {
+			err = &web.ErrHTTPGet{}
+		}
+	}
+	if output, ok := w.outputs[url]; ok {
+		return output, err
+	}
+	if w.missing {
+		return nil, web.NewErrHTTPStatus(url, http.StatusNotFound)
+	}
 	return w.output, err
 }
 
+func (w *fakeWebGetter) GetContext(ctx context.Context, url string) (output []byte, err error) {
+	if err = ctx.Err(); err != nil {
+		return
+	}
+	return w.Get(url)
+}
+
+// channelsJSON returns a channels.json with the given releases and channels,
+// all of them with the amd64 and armhf devices
+func channelsJSON(releases, channels []string) string {
+	var entries []string
+	for _, release := range releases {
+		for _, channel := range channels {
+			var devices []string
+			for _, device := range []string{"generic_amd64", "generic_armhf"} {
+				devices = append(devices, fmt.Sprintf(channelsDevice, device, release, channel, device))
+			}
+			entries = append(entries, fmt.Sprintf(channelsBase, release, channel, strings.Join(devices, ", ")))
+		}
+	}
+	return "{" + strings.Join(entries, ", ") + "}"
+}
+
 func (s *siSuite) SetUpSuite(c *check.C) {
 	s.webGetter = &fakeWebGetter{}
-	s.subject = NewClient(s.webGetter)
+	s.subject = NewClient(s.webGetter, nil, &Config{Insecure: true})
 }
 
 func (s *siSuite) SetUpTest(c *check.C) {
 	s.webGetter.calls = make(map[string]int)
 	s.webGetter.error = false
+	s.webGetter.down = nil
 	s.webGetter.output = []byte(validJSONResponse)
+	s.webGetter.outputs = map[string][]byte{
+		DefaultServer + "/" + channelsFileName: []byte(channelsJSON(
+			[]string{"15.04", "rolling"}, []string{"alpha", "edge", "stable"})),
+	}
 	s.defaultOptions = &flags.Options{
 		Release:   testDefaultRelease,
 		OSChannel: testDefaultChannel,
@@ -121,18 +172,18 @@ func (s *siSuite) TestGetLatestVersionQueriesTheRightUrl(c *check.C) {
 	testCases := []struct {
 		release, channel, arch, expected string
 	}{
-		{"15.04", "alpha", "amd64", baseURL + "/15.04/alpha/generic_amd64/" + dataFileName},
-		{"15.04", "alpha", "arm", baseURL + "/15.04/alpha/generic_armhf/" + dataFileName},
-		{"15.04", "edge", "amd64", baseURL + "/15.04/edge/generic_amd64/" + dataFileName},
-		{"15.04", "edge", "arm", baseURL + "/15.04/edge/generic_armhf/" + dataFileName},
-		{"15.04", "stable", "amd64", baseURL + "/15.04/stable/generic_amd64/" + dataFileName},
-		{"15.04", "stable", "arm", baseURL + "/15.04/stable/generic_armhf/" + dataFileName},
-		{"rolling", "alpha", "amd64", baseURL + "/rolling/alpha/generic_amd64/" + dataFileName},
-		{"rolling", "alpha", "arm", baseURL + "/rolling/alpha/generic_armhf/" + dataFileName},
-		{"rolling", "edge", "amd64", baseURL + "/rolling/edge/generic_amd64/" + dataFileName},
-		{"rolling", "edge", "arm", baseURL + "/rolling/edge/generic_armhf/" + dataFileName},
-		{"rolling", "stable", "amd64", baseURL + "/rolling/stable/generic_amd64/" + dataFileName},
-		{"rolling", "stable", "arm", baseURL + "/rolling/stable/generic_armhf/" + dataFileName},
+		{"15.04", "alpha", "amd64", testBaseURL + "/15.04/alpha/generic_amd64/" + dataFileName},
+		{"15.04", "alpha", "arm", testBaseURL + "/15.04/alpha/generic_armhf/" + dataFileName},
+		{"15.04", "edge", "amd64", testBaseURL + "/15.04/edge/generic_amd64/" + dataFileName},
+		{"15.04", "edge", "arm", testBaseURL + "/15.04/edge/generic_armhf/" + dataFileName},
+		{"15.04", "stable", "amd64", testBaseURL + "/15.04/stable/generic_amd64/" + dataFileName},
+		{"15.04", "stable", "arm", testBaseURL + "/15.04/stable/generic_armhf/" + dataFileName},
+		{"rolling", "alpha", "amd64", testBaseURL + "/rolling/alpha/generic_amd64/" + dataFileName},
+		{"rolling", "alpha", "arm", testBaseURL + "/rolling/alpha/generic_armhf/" + dataFileName},
+		{"rolling", "edge", "amd64", testBaseURL + "/rolling/edge/generic_amd64/" + dataFileName},
+		{"rolling", "edge", "arm", testBaseURL + "/rolling/edge/generic_armhf/" + dataFileName},
+		{"rolling", "stable", "amd64", testBaseURL + "/rolling/stable/generic_amd64/" + dataFileName},
+		{"rolling", "stable", "arm", testBaseURL + "/rolling/stable/generic_armhf/" + dataFileName},
 	}
 	for _, item := range testCases {
 		options := &flags.Options{
@@ -140,24 +191,41 @@ func (s *siSuite) TestGetLatestVersionQueriesTheRightUrl(c *check.C) {
 			OSChannel: item.channel,
 			Arch:      item.arch,
 		}
-		_, err := s.subject.GetLatestVersion(options)
+		_, err := s.subject.GetLatestVersion(context.Background(), options)
 
 		c.Check(err, check.IsNil)
 		c.Check(s.webGetter.calls[item.expected], check.Equals, 1)
 	}
 }
 
+func (s *siSuite) TestGetLatestVersionDoesNotModifyOptions(c *check.C) {
+	s.defaultOptions.Arch = "arm"
+
+	s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(s.defaultOptions.Arch, check.Equals, "arm")
+}
+
+func (s *siSuite) TestGetLatestVersionReturnsUnknownArchError(c *check.C) {
+	s.defaultOptions.Arch = "myarch"
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &arch.ErrUnknown{})
+	c.Assert(len(s.webGetter.calls), check.Equals, 0)
+}
+
 func (s *siSuite) TestGetLatestVersionReturnshttpGetterError(c *check.C) {
 	s.webGetter.error = true
 
-	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.NotNil)
 	c.Assert(err, check.FitsTypeOf, &web.ErrHTTPGet{})
 }
 
 func (s *siSuite) TestGetLatestVersionParsesJsonResponse(c *check.C) {
-	output, err := s.subject.GetLatestVersion(s.defaultOptions)
+	output, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.IsNil)
 	c.Assert(output, check.Equals, testImageVersion)
@@ -172,7 +240,7 @@ func (s *siSuite) TestGetLatestVersionGetsTheLatestVersion(c *check.C) {
 
 	s.webGetter.output = []byte(response)
 
-	output, err := s.subject.GetLatestVersion(s.defaultOptions)
+	output, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.IsNil)
 	c.Assert(output, check.Equals, testImageVersion)
@@ -187,7 +255,7 @@ func (s *siSuite) TestGetLatestVersionHonoursDeltas(c *check.C) {
 
 	s.webGetter.output = []byte(response)
 
-	output, err := s.subject.GetLatestVersion(s.defaultOptions)
+	output, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
 
 	c.Assert(err, check.IsNil)
 	c.Assert(output, check.Equals, testImageVersion)
@@ -196,7 +264,201 @@ func (s *siSuite) TestGetLatestVersionHonoursDeltas(c *check.C) {
 func (s *siSuite) TestGetLatestVersionReturnsUnmarshalError(c *check.C) {
 	s.webGetter.output = []byte("{{Not a valid JSON 'string']")
 
-	_, err := s.subject.GetLatestVersion(s.defaultOptions)
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *siSuite) TestGetLatestVersionHonoursContext(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.subject.GetLatestVersion(ctx, s.defaultOptions)
+
+	c.Assert(err, check.Equals, context.Canceled)
+}
+
+func (s *siSuite) TestGetChannelsParsesChannelsFile(c *check.C) {
+	s.webGetter.outputs[DefaultServer+"/"+channelsFileName] = []byte(`{
+    "ubuntu-core/rolling/edge": {"devices": {"generic_armhf": {}, "generic_amd64": {}}},
+    "ubuntu-core/15.04/stable": {"devices": {"generic_amd64": {}}, "hidden": true},
+    "ubuntu-touch/rolling/edge": {"devices": {"mako": {}}},
+    "ubuntu-core/15.04/edge": {"devices": {}}
+}`)
+
+	channels, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.IsNil)
+	c.Assert(channels, check.DeepEquals, []Channel{
+		{Release: "15.04", Name: "edge"},
+		{Release: "15.04", Name: "stable", Devices: []string{"generic_amd64"}, Archs: []string{"amd64"}},
+		{Release: "rolling", Name: "edge", Devices: []string{"generic_amd64", "generic_armhf"}, Archs: []string{"amd64", "armhf"}},
+	})
+}
+
+func (s *siSuite) TestGetChannelsReturnsHTTPError(c *check.C) {
+	s.webGetter.error = true
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &web.ErrHTTPGet{})
+}
+
+func (s *siSuite) TestGetChannelsReturnsUnmarshalError(c *check.C) {
+	s.webGetter.outputs[DefaultServer+"/"+channelsFileName] = []byte("not json")
+
+	_, err := s.subject.GetChannels(context.Background())
 
 	c.Assert(err, check.NotNil)
 }
+
+func (s *siSuite) TestValidateAcceptsAvailableCombination(c *check.C) {
+	s.defaultOptions.Arch = "arm"
+
+	c.Assert(s.subject.Validate(context.Background(), s.defaultOptions), check.IsNil)
+}
+
+func (s *siSuite) TestValidateReturnsErrNotAvailable(c *check.C) {
+	testCases := []struct {
+		release, channel, arch string
+	}{
+		{"16.10", testDefaultChannel, testDefaultArch},
+		{testDefaultRelease, "mychannel", testDefaultArch},
+		{testDefaultRelease, testDefaultChannel, "arm64"},
+	}
+	for _, item := range testCases {
+		options := &flags.Options{Release: item.release, OSChannel: item.channel, Arch: item.arch}
+
+		err := s.subject.Validate(context.Background(), options)
+
+		c.Check(err, check.FitsTypeOf, &ErrNotAvailable{})
+		c.Check(err.Error(), check.Equals, fmt.Sprintf(
+			"Release %s, channel %s and arch %s are not available in the system-image server",
+			item.release, item.channel, item.arch))
+	}
+}
+
+func (s *siSuite) TestGetLatestVersionValidatesOptions(c *check.C) {
+	s.defaultOptions.OSChannel = "mychannel"
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNotAvailable{})
+	c.Assert(s.webGetter.calls[DefaultServer+"/"+channelsFileName], check.Equals, 1)
+	c.Assert(len(s.webGetter.calls), check.Equals, 1)
+}
+
+func (s *siSuite) TestGetLatestVersionReturnsErrNoFullImageWithOnlyDeltas(c *check.C) {
+	images := fmt.Sprintf(imageBase, "delta", testImageVersion) + "," + fmt.Sprintf(imageBase, "delta", testImageVersion+1)
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, images))
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoFullImage{})
+	c.Assert(err.Error(), check.Equals, "No full image found for release rolling, channel edge and arch amd64")
+}
+
+func (s *siSuite) TestGetLatestVersionReturnsErrNoFullImageWithoutImages(c *check.C) {
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, ""))
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoFullImage{})
+}
+
+func (s *siSuite) TestGetLatestVersionGetsTheHighestVersion(c *check.C) {
+	images := fmt.Sprintf(imageBase, "full", testImageVersion) + "," + fmt.Sprintf(imageBase, "full", testImageVersion-1)
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, images))
+
+	output, err := s.subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, testImageVersion)
+}
+
+func (s *siSuite) TestGetLatestMatchingVersionFiltersByVersionDetail(c *check.C) {
+	s.webGetter.output = []byte(fmt.Sprintf(responseBase, `
+        {"type": "full", "version": 10, "version_detail": "ubuntu=20160101,version=10"},
+        {"type": "full", "version": 11, "version_detail": "ubuntu=20160202,version=11"},
+        {"type": "full", "version": 12, "version_detail": "ubuntu=20160303,version=12"}`))
+
+	output, err := s.subject.GetLatestMatchingVersion(context.Background(), s.defaultOptions, Filter{"ubuntu": "20160202"})
+
+	c.Assert(err, check.IsNil)
+	c.Assert(output, check.Equals, 11)
+}
+
+func (s *siSuite) TestGetLatestMatchingVersionReturnsErrNoFullImage(c *check.C) {
+	_, err := s.subject.GetLatestMatchingVersion(context.Background(), s.defaultOptions, Filter{"ubuntu": "20160202", "device": "1"})
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoFullImage{})
+	c.Assert(err.Error(), check.Equals,
+		"No full image found for release rolling, channel edge and arch amd64 matching device=1,ubuntu=20160202")
+}
+
+func (s *siSuite) TestGetIndexParsesImages(c *check.C) {
+	index, err := s.subject.GetIndex(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(index.Images), check.Equals, 1)
+	c.Assert(index.Images[0].Type, check.Equals, TypeFull)
+	c.Assert(index.Images[0].Version, check.Equals, testImageVersion)
+	c.Assert(len(index.Images[0].Files), check.Equals, 3)
+	c.Assert(index.Images[0].Files[1].Size, check.Equals, int64(88374184))
+}
+
+func (s *siSuite) TestGetLatestVersionFailsOverToMirrors(c *check.C) {
+	mirror := "http://mirror.example.com"
+	s.webGetter.outputs[mirror+"/"+channelsFileName] = s.webGetter.outputs[DefaultServer+"/"+channelsFileName]
+	s.webGetter.down = []string{DefaultServer}
+	subject := NewClient(s.webGetter, nil, &Config{Servers: []string{DefaultServer, mirror + "/"}, Insecure: true})
+
+	ver, err := subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, testImageVersion)
+	c.Assert(s.webGetter.calls[DefaultServer+"/"+channelsFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls[mirror+"/"+channelsFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls[testBaseURL+"/rolling/edge/generic_amd64/"+dataFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls[mirror+"/"+basePath+"/rolling/edge/generic_amd64/"+dataFileName], check.Equals, 1)
+}
+
+func (s *siSuite) TestGetLatestVersionReturnsErrorWhenAllMirrorsFail(c *check.C) {
+	mirror := "http://mirror.example.com"
+	s.webGetter.down = []string{DefaultServer, mirror}
+	subject := NewClient(s.webGetter, nil, &Config{Servers: []string{DefaultServer, mirror}, Insecure: true})
+
+	_, err := subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.FitsTypeOf, &web.ErrHTTPGet{})
+	c.Assert(s.webGetter.calls[DefaultServer+"/"+channelsFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls[mirror+"/"+channelsFileName], check.Equals, 1)
+}
+
+func (s *siSuite) TestGetChannelsUsesHTTPS(c *check.C) {
+	subject := NewClient(s.webGetter, nil, &Config{Servers: []string{DefaultServer, "https://mirror.example.com"}, HTTPS: true, Insecure: true})
+	s.webGetter.down = []string{"https://system-image.ubuntu.com"}
+
+	subject.GetChannels(context.Background())
+
+	c.Assert(s.webGetter.calls["https://system-image.ubuntu.com/"+channelsFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls["https://mirror.example.com/"+channelsFileName], check.Equals, 1)
+	c.Assert(s.webGetter.calls[DefaultServer+"/"+channelsFileName], check.Equals, 0)
+}
+
+func (s *siSuite) TestGetLatestVersionUsesDevicePattern(c *check.C) {
+	s.webGetter.outputs[DefaultServer+"/"+channelsFileName] = []byte(`{
+    "ubuntu-core/rolling/edge": {"devices": {"lab_amd64": {}, "generic_armhf": {}}}
+}`)
+	subject := NewClient(s.webGetter, nil, &Config{DevicePattern: "lab_%s", Insecure: true})
+
+	_, err := subject.GetLatestVersion(context.Background(), s.defaultOptions)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(s.webGetter.calls[testBaseURL+"/rolling/edge/lab_amd64/"+dataFileName], check.Equals, 1)
+
+	channels, err := subject.GetChannels(context.Background())
+
+	c.Assert(err, check.IsNil)
+	c.Assert(channels[0].Archs, check.DeepEquals, []string{"amd64"})
+}
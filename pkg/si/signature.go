@@ -0,0 +1,97 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+const (
+	signatureSuffix   = ".asc"
+	errSignatureFmt   = "Invalid signature of %s: %s"
+	errKeyringFmt     = "Could not read keyring %s: %s"
+	errNoSignatureFmt = "could not get the signature, %v"
+	errEmptyKeyring   = "no keys found"
+	errNoKeyring      = "there is no archive master keyring to check it"
+)
+
+// ErrSignature is the error returned when a file of the server is not signed by
+// any of the keys trusted to sign it
+type ErrSignature struct {
+	url, msg string
+}
+
+func (e *ErrSignature) Error() string {
+	return fmt.Sprintf(errSignatureFmt, e.url, e.msg)
+}
+
+// ErrKeyring is the error returned when a keyring file can't be loaded
+type ErrKeyring struct {
+	path, msg string
+}
+
+func (e *ErrKeyring) Error() string {
+	return fmt.Sprintf(errKeyringFmt, e.path, e.msg)
+}
+
+// ReadKeyring loads the public keys of the given archive master keyring files,
+// either the archive-master.tar.xz archive of system-image or OpenPGP keyrings,
+// armored or binary. They are trusted without checking any signature
+func ReadKeyring(paths ...string) (keyring openpgp.EntityList, err error) {
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var entities openpgp.EntityList
+		if strings.HasSuffix(path, keyringArchiveSuffix) {
+			entities, err = readKeyringArchive(path, content, archiveMasterType)
+		} else {
+			entities, err = readEntities(path, content)
+		}
+		if err != nil {
+			return nil, err
+		}
+		keyring = append(keyring, entities...)
+	}
+	return
+}
+
+// verify checks that the armored detached signature published next to url
+// signs content with one of the keys of keyring
+func (c *Client) verify(ctx context.Context, keyring openpgp.EntityList, url string, content []byte) error {
+	if len(keyring) == 0 {
+		return &ErrSignature{url: url, msg: errNoKeyring}
+	}
+	signature, err := c.httpClient.GetContext(ctx, url+signatureSuffix)
+	if err != nil {
+		return &ErrSignature{url: url, msg: fmt.Sprintf(errNoSignatureFmt, err)}
+	}
+	if _, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(content), bytes.NewReader(signature)); err != nil {
+		return &ErrSignature{url: url, msg: err.Error()}
+	}
+	return nil
+}
@@ -0,0 +1,380 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package si
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"gopkg.in/check.v1"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/flags"
+)
+
+var _ = check.Suite(&signatureSuite{})
+
+// signatureSuite checks a client that verifies the files of the server against
+// a chain of keyrings generated for the tests, from the archive master to the
+// image signing keys
+type signatureSuite struct {
+	subject                                *Client
+	webGetter                              *fakeWebGetter
+	dir                                    string
+	archive, master, signer, device, other *openpgp.Entity
+	channelsURL, indexURL                  string
+	options                                *flags.Options
+	decompressXZ                           func([]byte) ([]byte, error)
+}
+
+func (s *signatureSuite) SetUpSuite(c *check.C) {
+	s.archive = s.newEntity(c, "archive master")
+	s.master = s.newEntity(c, "image master")
+	s.signer = s.newEntity(c, "image signing")
+	s.device = s.newEntity(c, "device signing")
+	s.other = s.newEntity(c, "other")
+	s.channelsURL = DefaultServer + "/" + channelsFileName
+	s.indexURL = testBaseURL + "/" + testDefaultRelease + "/" + testDefaultChannel + "/generic_amd64/" + dataFileName
+	s.decompressXZ = decompressXZ
+}
+
+func (s *signatureSuite) SetUpTest(c *check.C) {
+	// the keyring archives of the tests are plain tar files
+	decompressXZ = func(content []byte) ([]byte, error) { return content, nil }
+	s.dir = c.MkDir()
+	s.webGetter = &fakeWebGetter{calls: make(map[string]int), outputs: make(map[string][]byte), missing: true}
+	s.subject = NewClient(s.webGetter, openpgp.EntityList{s.archive}, nil)
+	s.options = &flags.Options{Release: testDefaultRelease, OSChannel: testDefaultChannel, Arch: testDefaultArch}
+
+	s.publishKeyring(c, imageMasterType, imageMasterType, s.archive, s.master)
+	s.publishKeyring(c, imageSigningType, imageSigningType, s.master, s.signer)
+	s.publish(c, s.channelsURL, channelsJSON([]string{testDefaultRelease}, []string{testDefaultChannel}), s.signer)
+	s.publish(c, s.indexURL, validJSONResponse, s.signer)
+}
+
+func (s *signatureSuite) TearDownTest(c *check.C) {
+	decompressXZ = s.decompressXZ
+}
+
+func (s *signatureSuite) newEntity(c *check.C, name string) *openpgp.Entity {
+	entity, err := openpgp.NewEntity(name, "", "keys@example.com", nil)
+	c.Assert(err, check.IsNil)
+	return entity
+}
+
+// publish makes the fake server return content for url, signed by signer
+func (s *signatureSuite) publish(c *check.C, url, content string, signer *openpgp.Entity) {
+	var signature bytes.Buffer
+	c.Assert(openpgp.ArmoredDetachSign(&signature, signer, bytes.NewReader([]byte(content)), nil), check.IsNil)
+	s.webGetter.outputs[url] = []byte(content)
+	s.webGetter.outputs[url+signatureSuffix] = signature.Bytes()
+}
+
+// publishKeyring makes the fake server return the keyring archive of the given
+// name, declared of keyringType and signed by signer
+func (s *signatureSuite) publishKeyring(c *check.C, name, keyringType string, signer *openpgp.Entity, entities ...*openpgp.Entity) {
+	url := DefaultServer + keyringPath + name + keyringArchiveSuffix
+	s.publish(c, url, s.keyringArchive(c, keyringType, time.Now().Add(time.Hour), entities...), signer)
+}
+
+// keyringArchive returns a keyring archive with the given keys, not compressed
+func (s *signatureSuite) keyringArchive(c *check.C, keyringType string, expiry time.Time, entities ...*openpgp.Entity) string {
+	var keyring, archive bytes.Buffer
+	for _, entity := range entities {
+		c.Assert(entity.Serialize(&keyring), check.IsNil)
+	}
+	meta := fmt.Sprintf(`{"type": "%s", "expiry": %d}`, keyringType, expiry.Unix())
+	w := tar.NewWriter(&archive)
+	for name, content := range map[string][]byte{keyringFile: keyring.Bytes(), keyringMetaFile: []byte(meta)} {
+		c.Assert(w.WriteHeader(&tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(content))}), check.IsNil)
+		_, err := w.Write(content)
+		c.Assert(err, check.IsNil)
+	}
+	c.Assert(w.Close(), check.IsNil)
+	return archive.String()
+}
+
+func (s *signatureSuite) writeKeyring(c *check.C, name string, armored bool, entities ...*openpgp.Entity) string {
+	var buf bytes.Buffer
+	w := &buf
+	if armored {
+		aw, err := armor.Encode(&buf, openpgp.PublicKeyType, nil)
+		c.Assert(err, check.IsNil)
+		for _, entity := range entities {
+			c.Assert(entity.Serialize(aw), check.IsNil)
+		}
+		c.Assert(aw.Close(), check.IsNil)
+	} else {
+		for _, entity := range entities {
+			c.Assert(entity.Serialize(w), check.IsNil)
+		}
+	}
+	path := filepath.Join(s.dir, name)
+	c.Assert(ioutil.WriteFile(path, buf.Bytes(), 0644), check.IsNil)
+	return path
+}
+
+func (s *signatureSuite) TestGetLatestVersionAcceptsSignedFiles(c *check.C) {
+	ver, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, testImageVersion)
+	c.Assert(s.webGetter.calls[s.channelsURL+signatureSuffix], check.Equals, 1)
+	c.Assert(s.webGetter.calls[s.indexURL+signatureSuffix], check.Equals, 1)
+}
+
+func (s *signatureSuite) TestGetLatestVersionGetsTheKeyringsOnce(c *check.C) {
+	_, err := s.subject.GetLatestVersion(context.Background(), s.options)
+	c.Assert(err, check.IsNil)
+	_, err = s.subject.GetLatestVersion(context.Background(), s.options)
+	c.Assert(err, check.IsNil)
+
+	for _, name := range []string{imageMasterType, blacklistType, imageSigningType, deviceSigningType} {
+		c.Check(s.webGetter.calls[DefaultServer+keyringPath+name+keyringArchiveSuffix], check.Equals, 1, check.Commentf(name))
+	}
+}
+
+func (s *signatureSuite) TestGetLatestVersionRejectsTamperedIndex(c *check.C) {
+	s.webGetter.outputs[s.indexURL] = []byte(fmt.Sprintf(responseBase, fmt.Sprintf(imageBase, "full", testImageVersion+1)))
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetLatestVersionRejectsUnsignedIndex(c *check.C) {
+	delete(s.webGetter.outputs, s.indexURL+signatureSuffix)
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetLatestVersionRejectsIndexSignedByUnknownKey(c *check.C) {
+	s.publish(c, s.indexURL, validJSONResponse, s.other)
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+	c.Assert(s.webGetter.calls[s.indexURL], check.Equals, 1)
+}
+
+func (s *signatureSuite) TestGetLatestVersionRejectsIndexSignedByImageMaster(c *check.C) {
+	s.publish(c, s.indexURL, validJSONResponse, s.master)
+
+	_, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetLatestVersionAcceptsIndexSignedByDeviceKey(c *check.C) {
+	s.publishKeyring(c, deviceSigningType, deviceSigningType, s.signer, s.device)
+	s.publish(c, s.indexURL, validJSONResponse, s.device)
+
+	ver, err := s.subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, testImageVersion)
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsDeviceKeyringNotSignedByImageSigning(c *check.C) {
+	s.publishKeyring(c, deviceSigningType, deviceSigningType, s.other, s.device)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsImageMasterNotSignedByArchiveMaster(c *check.C) {
+	s.publishKeyring(c, imageMasterType, imageMasterType, s.other, s.master)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+	c.Assert(err.Error(), check.Matches, "Invalid signature of .*/gpg/image-master.tar.xz: .*")
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsImageSigningNotSignedByImageMaster(c *check.C) {
+	s.publishKeyring(c, imageSigningType, imageSigningType, s.archive, s.signer)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsBlacklistedSigningKey(c *check.C) {
+	s.publishKeyring(c, blacklistType, blacklistType, s.master, s.signer)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsKeyringSignedByBlacklistedImageMasterKey(c *check.C) {
+	s.publishKeyring(c, imageMasterType, imageMasterType, s.archive, s.master, s.other)
+	s.publishKeyring(c, blacklistType, blacklistType, s.master, s.other)
+	s.publishKeyring(c, imageSigningType, imageSigningType, s.other, s.signer)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsBlacklistNotSignedByImageMaster(c *check.C) {
+	s.publishKeyring(c, blacklistType, blacklistType, s.other, s.other)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsKeyringOfOtherType(c *check.C) {
+	s.publishKeyring(c, imageSigningType, imageMasterType, s.master, s.signer)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrKeyring{})
+	c.Assert(err.Error(), check.Matches, ".* it is a image-master keyring instead of image-signing")
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsExpiredKeyring(c *check.C) {
+	url := DefaultServer + keyringPath + imageSigningType + keyringArchiveSuffix
+	s.publish(c, url, s.keyringArchive(c, imageSigningType, time.Now().Add(-time.Hour), s.signer), s.master)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrKeyring{})
+	c.Assert(err.Error(), check.Matches, ".* it expired on .*")
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsMissingImageSigningKeyring(c *check.C) {
+	delete(s.webGetter.outputs, DefaultServer+keyringPath+imageSigningType+keyringArchiveSuffix)
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.NotNil)
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsTamperedChannels(c *check.C) {
+	s.webGetter.outputs[s.channelsURL] = []byte(channelsJSON([]string{"16.04"}, []string{testDefaultChannel}))
+
+	_, err := s.subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+}
+
+func (s *signatureSuite) TestGetChannelsRejectsFilesWithoutArchiveMaster(c *check.C) {
+	subject := NewClient(s.webGetter, nil, nil)
+
+	_, err := subject.GetChannels(context.Background())
+
+	c.Assert(err, check.FitsTypeOf, &ErrSignature{})
+	c.Assert(err.Error(), check.Equals, "Invalid signature of "+s.channelsURL+": "+errNoKeyring)
+}
+
+func (s *signatureSuite) TestGetLatestVersionOfInsecureClientDoesntCheckSignatures(c *check.C) {
+	s.webGetter.outputs = map[string][]byte{
+		s.channelsURL: s.webGetter.outputs[s.channelsURL],
+		s.indexURL:    s.webGetter.outputs[s.indexURL],
+	}
+	subject := NewClient(s.webGetter, nil, &Config{Insecure: true})
+
+	ver, err := subject.GetLatestVersion(context.Background(), s.options)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(ver, check.Equals, testImageVersion)
+}
+
+func (s *signatureSuite) TestReadKeyringLoadsArmoredAndBinaryKeyrings(c *check.C) {
+	armored := s.writeKeyring(c, "archive-master.asc", true, s.other)
+	binary := s.writeKeyring(c, "archive-master.gpg", false, s.archive)
+
+	keyring, err := ReadKeyring(armored, binary)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(keyring), check.Equals, 2)
+	c.Assert(keyring[0].PrimaryKey.KeyId, check.Equals, s.other.PrimaryKey.KeyId)
+	c.Assert(keyring[1].PrimaryKey.KeyId, check.Equals, s.archive.PrimaryKey.KeyId)
+
+	subject := NewClient(s.webGetter, keyring, nil)
+	_, err = subject.GetLatestVersion(context.Background(), s.options)
+	c.Assert(err, check.IsNil)
+}
+
+func (s *signatureSuite) TestReadKeyringLoadsArchiveMasterArchive(c *check.C) {
+	path := filepath.Join(s.dir, "archive-master"+keyringArchiveSuffix)
+	content := s.keyringArchive(c, archiveMasterType, time.Now().Add(time.Hour), s.archive)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+
+	keyring, err := ReadKeyring(path)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(len(keyring), check.Equals, 1)
+	c.Assert(keyring[0].PrimaryKey.KeyId, check.Equals, s.archive.PrimaryKey.KeyId)
+}
+
+func (s *signatureSuite) TestReadKeyringRejectsArchiveOfOtherType(c *check.C) {
+	path := filepath.Join(s.dir, "image-master"+keyringArchiveSuffix)
+	content := s.keyringArchive(c, imageMasterType, time.Now().Add(time.Hour), s.master)
+	c.Assert(ioutil.WriteFile(path, []byte(content), 0644), check.IsNil)
+
+	_, err := ReadKeyring(path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrKeyring{})
+}
+
+func (s *signatureSuite) TestReadKeyringReturnsErrKeyring(c *check.C) {
+	path := filepath.Join(s.dir, "broken.gpg")
+	c.Assert(ioutil.WriteFile(path, []byte("not a keyring"), 0644), check.IsNil)
+
+	_, err := ReadKeyring(path)
+
+	c.Assert(err, check.FitsTypeOf, &ErrKeyring{})
+}
+
+func (s *signatureSuite) TestReadKeyringReturnsMissingFileError(c *check.C) {
+	_, err := ReadKeyring(filepath.Join(s.dir, "missing.gpg"))
+
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *signatureSuite) TestDecompressXZ(c *check.C) {
+	cmd := exec.Command("xz", "--compress", "--stdout")
+	cmd.Stdin = bytes.NewReader([]byte("keyring"))
+	compressed, err := cmd.Output()
+	c.Assert(err, check.IsNil)
+
+	content, err := s.decompressXZ(compressed)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(string(content), check.Equals, "keyring")
+
+	_, err = s.decompressXZ([]byte("not xz"))
+
+	c.Assert(err, check.NotNil)
+}
@@ -0,0 +1,122 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package web
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	cacheBodySuffix = ".body"
+	cacheMetaSuffix = ".json"
+)
+
+var now = time.Now
+
+// cacheEntry is a response stored in the cache, with the validators used to
+// revalidate it
+type cacheEntry struct {
+	URL          string    `json:"url"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last-modified,omitempty"`
+	Stored       time.Time `json:"stored"`
+	content      []byte
+}
+
+// conditional returns the headers that make the request fail with 304 if the
+// entry is still valid
+func (e *cacheEntry) conditional() http.Header {
+	header := make(http.Header)
+	if e.ETag != "" {
+		header.Set("If-None-Match", e.ETag)
+	}
+	if e.LastModified != "" {
+		header.Set("If-Modified-Since", e.LastModified)
+	}
+	return header
+}
+
+// diskCache keeps each response in dir as a body file and a metadata file,
+// named after the digest of the url
+type diskCache struct {
+	dir string
+}
+
+func (d *diskCache) path(url string) string {
+	digest := sha256.Sum256([]byte(url))
+	return filepath.Join(d.dir, hex.EncodeToString(digest[:]))
+}
+
+// load returns the entry of the given url, false if there is none
+func (d *diskCache) load(url string) (*cacheEntry, bool) {
+	path := d.path(url)
+	meta, err := ioutil.ReadFile(path + cacheMetaSuffix)
+	if err != nil {
+		return nil, false
+	}
+	entry := &cacheEntry{}
+	if err = json.Unmarshal(meta, entry); err != nil || entry.URL != url {
+		return nil, false
+	}
+	if entry.content, err = ioutil.ReadFile(path + cacheBodySuffix); err != nil {
+		return nil, false
+	}
+	return entry, true
+}
+
+// store writes the entry, the metadata goes last so that a partially written
+// entry is never loaded
+func (d *diskCache) store(entry *cacheEntry) error {
+	if err := os.MkdirAll(d.dir, 0755); err != nil {
+		return err
+	}
+	path := d.path(entry.URL)
+	meta, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = writeFileAtomic(path+cacheBodySuffix, entry.content); err != nil {
+		return err
+	}
+	return writeFileAtomic(path+cacheMetaSuffix, meta)
+}
+
+func writeFileAtomic(path string, content []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err = tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
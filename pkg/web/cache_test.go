@@ -0,0 +1,239 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package web
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+const (
+	testETag         = `"v1"`
+	testLastModified = "Mon, 01 Feb 2016 10:00:00 GMT"
+)
+
+var _ = check.Suite(&cacheSuite{})
+
+// cacheSuite checks the cache against a server that honours the conditional
+// requests of the paths /etag and /last-modified
+type cacheSuite struct {
+	server   *httptest.Server
+	dir      string
+	requests map[string]int
+	full     map[string]int
+	content  []byte
+	etag     string
+	clock    time.Time
+	backNow  func() time.Time
+}
+
+func (s *cacheSuite) SetUpSuite(c *check.C) {
+	s.backNow = now
+	now = func() time.Time { return s.clock }
+}
+
+func (s *cacheSuite) TearDownSuite(c *check.C) {
+	now = s.backNow
+}
+
+func (s *cacheSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.requests = make(map[string]int)
+	s.full = make(map[string]int)
+	s.content = response
+	s.etag = testETag
+	s.clock = time.Date(2016, 2, 1, 10, 0, 0, 0, time.UTC)
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests[r.URL.Path]++
+		switch r.URL.Path {
+		case "/etag":
+			w.Header().Set("ETag", s.etag)
+			if match := r.Header.Get("If-None-Match"); match == testETag || match == s.etag {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		case "/error":
+			w.Header().Set("ETag", testETag)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		case "/last-modified":
+			w.Header().Set("Last-Modified", testLastModified)
+			if r.Header.Get("If-Modified-Since") == testLastModified {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+		s.full[r.URL.Path]++
+		w.Write(s.content)
+	}))
+}
+
+func (s *cacheSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *cacheSuite) subject(maxAge time.Duration, bypass bool) *Client {
+	return NewClient(&Config{CacheDir: s.dir, CacheMaxAge: maxAge, BypassCache: bypass})
+}
+
+func (s *cacheSuite) TestGetRevalidatesWithETag(c *check.C) {
+	url := s.server.URL + "/etag"
+	_, err := s.subject(0, false).Get(url)
+	c.Assert(err, check.IsNil)
+
+	content, err := s.subject(0, false).Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.requests["/etag"], check.Equals, 2)
+	c.Assert(s.full["/etag"], check.Equals, 1)
+}
+
+func (s *cacheSuite) TestGetRevalidatesWithLastModified(c *check.C) {
+	url := s.server.URL + "/last-modified"
+	subject := s.subject(0, false)
+	subject.Get(url)
+
+	content, err := subject.Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.requests["/last-modified"], check.Equals, 2)
+	c.Assert(s.full["/last-modified"], check.Equals, 1)
+}
+
+func (s *cacheSuite) TestGetDoesNotCacheWithoutValidators(c *check.C) {
+	url := s.server.URL + "/plain"
+	subject := s.subject(0, false)
+	subject.Get(url)
+	subject.Get(url)
+
+	c.Assert(s.full["/plain"], check.Equals, 2)
+	files, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(files), check.Equals, 0)
+}
+
+func (s *cacheSuite) TestGetUsesFreshEntriesWithinMaxAge(c *check.C) {
+	url := s.server.URL + "/plain"
+	subject := s.subject(time.Minute, false)
+	subject.Get(url)
+	s.content = []byte("new content")
+
+	s.clock = s.clock.Add(30 * time.Second)
+	content, err := subject.Get(url)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.requests["/plain"], check.Equals, 1)
+
+	s.clock = s.clock.Add(time.Minute)
+	content, err = subject.Get(url)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, s.content)
+	c.Assert(s.requests["/plain"], check.Equals, 2)
+}
+
+func (s *cacheSuite) TestGetRefreshesRevalidatedEntries(c *check.C) {
+	url := s.server.URL + "/etag"
+	subject := s.subject(time.Minute, false)
+	subject.Get(url)
+
+	s.clock = s.clock.Add(2 * time.Minute)
+	subject.Get(url)
+	s.clock = s.clock.Add(30 * time.Second)
+	subject.Get(url)
+
+	c.Assert(s.requests["/etag"], check.Equals, 2)
+	c.Assert(s.full["/etag"], check.Equals, 1)
+}
+
+func (s *cacheSuite) TestGetKeepsValidatorsOfNotModifiedResponses(c *check.C) {
+	url := s.server.URL + "/etag"
+	subject := s.subject(0, false)
+	subject.Get(url)
+	s.etag = `"v2"`
+
+	content, err := subject.Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.full["/etag"], check.Equals, 1)
+	entry, ok := (&diskCache{dir: s.dir}).load(url)
+	c.Assert(ok, check.Equals, true)
+	c.Assert(entry.ETag, check.Equals, `"v2"`)
+}
+
+func (s *cacheSuite) TestGetRevalidatesEntriesStoredInTheFuture(c *check.C) {
+	url := s.server.URL + "/etag"
+	subject := s.subject(time.Hour, false)
+	subject.Get(url)
+
+	s.clock = s.clock.Add(-time.Minute)
+	content, err := subject.Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.requests["/etag"], check.Equals, 2)
+	c.Assert(s.full["/etag"], check.Equals, 1)
+}
+
+func (s *cacheSuite) TestGetBypassesCache(c *check.C) {
+	url := s.server.URL + "/etag"
+	s.subject(0, false).Get(url)
+	s.content = []byte("new content")
+
+	content, err := s.subject(time.Hour, true).Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, s.content)
+	c.Assert(s.full["/etag"], check.Equals, 2)
+
+	content, err = s.subject(time.Hour, false).Get(url)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, s.content)
+}
+
+func (s *cacheSuite) TestGetIgnoresCorruptEntries(c *check.C) {
+	url := s.server.URL + "/etag"
+	subject := s.subject(0, false)
+	subject.Get(url)
+	path := (&diskCache{dir: s.dir}).path(url)
+	c.Assert(ioutil.WriteFile(path+cacheMetaSuffix, []byte("not json"), 0644), check.IsNil)
+
+	content, err := subject.Get(url)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.full["/etag"], check.Equals, 2)
+}
+
+func (s *cacheSuite) TestGetDoesNotCacheErrors(c *check.C) {
+	subject := NewClient(&Config{CacheDir: filepath.Join(s.dir, "cache")})
+
+	_, err := subject.Get(s.server.URL + "/error")
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPStatus{})
+	_, err = ioutil.ReadDir(filepath.Join(s.dir, "cache"))
+	c.Assert(err, check.NotNil)
+}
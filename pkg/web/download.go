@@ -0,0 +1,329 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package web
+
+import (
+	"context"
+	"crypto"
+	// the hashes available for the expected digests
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	// snap digests are sha3-384
+	_ "golang.org/x/crypto/sha3"
+)
+
+const (
+	partialSuffix      = ".partial"
+	validatorSuffix    = ".validator"
+	downloadBufferSize = 32 * 1024
+	errSizeFmt         = "Size mismatch downloading %s, expected %d bytes and got %d"
+	errDigestFmt       = "Digest mismatch downloading %s, expected %s and got %s"
+	errRangeFmt        = "Unexpected range %q resuming %s at byte %d"
+	errHashFmt         = "Hash %v of the digest of %s is not available"
+)
+
+// Meter receives the progress of a download, it is satisfied by the
+// progress meters of the snappy packages
+type Meter interface {
+	Start(name string, total float64)
+	Set(current float64)
+	Finished()
+}
+
+// Downloader has the method for streaming the content of an url to a file
+type Downloader interface {
+	Download(ctx context.Context, url, path string, expected Expected, meter Meter) error
+}
+
+// Expected holds the known details of a file to be downloaded, the zero
+// values mean they are not checked
+type Expected struct {
+	Size int64
+	// Digest is the hex encoded digest of the file with Hash, SHA256 if not set
+	Digest string
+	Hash   crypto.Hash
+}
+
+// ErrSize is the error returned when the downloaded file hasn't got the
+// expected size
+type ErrSize struct {
+	url            string
+	expected, size int64
+}
+
+func (e *ErrSize) Error() string {
+	return fmt.Sprintf(errSizeFmt, e.url, e.expected, e.size)
+}
+
+// ErrDigest is the error returned when the downloaded file hasn't got the
+// expected digest
+type ErrDigest struct {
+	url, expected, digest string
+}
+
+func (e *ErrDigest) Error() string {
+	return fmt.Sprintf(errDigestFmt, e.url, e.expected, e.digest)
+}
+
+// Download writes the content of url to path. The data is written first to
+// path.partial, which is kept on failure so that the next call resumes from
+// where it was left with a Range request. The ETag or Last-Modified header of
+// the response is kept in path.partial.validator and sent in If-Range, so that
+// the server sends the whole file again if it changed in between, and a
+// partial file without it is downloaded from the start. Interrupted transfers
+// are resumed the same way while there are retries left, the retries are
+// reset each time some data is received. The expected size and digest are
+// checked once the transfer is complete, and a file that doesn't match them is
+// removed. meter can be nil
+func (c *Client) Download(ctx context.Context, url, path string, expected Expected, meter Meter) (err error) {
+	c.once.Do(c.init)
+	if meter == nil {
+		meter = nopMeter{}
+	}
+	partial := path + partialSuffix
+	validator := partial + validatorSuffix
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+
+	for failures := 0; ; {
+		var received int64
+		if received, err = c.downloadFrom(ctx, url, file, validator, expected.Size, meter); err == nil {
+			break
+		}
+		if received > 0 {
+			failures = 0
+		}
+		if ctx.Err() != nil || failures >= c.config.Retries || !retryable(err) {
+			return
+		}
+		if err = c.wait(ctx, failures, url, err); err != nil {
+			return
+		}
+		failures++
+	}
+	meter.Finished()
+
+	if err = file.Close(); err != nil {
+		return
+	}
+	os.Remove(validator)
+	if err = verifyDownload(url, partial, expected); err != nil {
+		os.Remove(partial)
+		return
+	}
+	return os.Rename(partial, path)
+}
+
+// downloadFrom makes a single request for the data missing in file and
+// appends it, it returns the number of bytes received. The validator of the
+// data in file is read from and written to validatorPath
+func (c *Client) downloadFrom(ctx context.Context, url string, file *os.File, validatorPath string, size int64, meter Meter) (received int64, err error) {
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return
+	}
+	validator := readValidator(validatorPath)
+	// without a validator the data may belong to another version of the file
+	if (size > 0 && offset > size) || (offset > 0 && validator == "") {
+		if offset, err = restart(file); err != nil {
+			return
+		}
+	}
+	header := make(http.Header)
+	if offset > 0 {
+		log.Debugf("Resuming %s at byte %d", url, offset)
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		header.Set("If-Range", validator)
+	}
+	a, err := c.start(ctx, url, header)
+	if err != nil {
+		return
+	}
+	defer a.Close()
+
+	switch status := a.resp.StatusCode; {
+	case status == http.StatusPartialContent:
+		contentRange := a.resp.Header.Get("Content-Range")
+		if start, ok := rangeStart(contentRange); !ok || start != offset {
+			restart(file)
+			return 0, &ErrHTTPGet{msg: fmt.Sprintf(errRangeFmt, contentRange, url, offset)}
+		}
+	case status == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		// nothing left to download if the file has the length of the data
+		contentRange := a.resp.Header.Get("Content-Range")
+		if total, ok := rangeTotal(contentRange); ok && total == offset && (size == 0 || offset == size) {
+			return 0, nil
+		}
+		restart(file)
+		return 0, &ErrHTTPGet{msg: fmt.Sprintf(errRangeFmt, contentRange, url, offset)}
+	case status >= 200 && status <= 299:
+		// the server ignored the range or the file changed, start over
+		if offset, err = restart(file); err != nil {
+			return
+		}
+		if err = writeValidator(validatorPath, a.resp.Header); err != nil {
+			return
+		}
+	default:
+		return 0, &ErrHTTPStatus{url: url, code: status}
+	}
+
+	total := float64(size)
+	if a.resp.ContentLength >= 0 {
+		total = float64(offset + a.resp.ContentLength)
+	}
+	meter.Start(path.Base(url), total)
+	meter.Set(float64(offset))
+
+	buf := make([]byte, downloadBufferSize)
+	for {
+		n, readErr := a.Read(buf)
+		if n > 0 {
+			if _, err = file.Write(buf[:n]); err != nil {
+				return
+			}
+			received += int64(n)
+			meter.Set(float64(offset + received))
+		}
+		if readErr == io.EOF {
+			return received, nil
+		}
+		if readErr != nil {
+			return received, &ErrBodyRead{msg: a.msg(readErr)}
+		}
+	}
+}
+
+// restart empties the partial file
+func restart(file *os.File) (offset int64, err error) {
+	if err = file.Truncate(0); err != nil {
+		return
+	}
+	return file.Seek(0, io.SeekStart)
+}
+
+// rangeStart returns the first byte of a Content-Range header, which has the
+// form bytes start-end/total
+func rangeStart(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(contentRange, "bytes "), "-", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(parts[0], 10, 64)
+	return start, err == nil
+}
+
+// rangeTotal returns the length of the file of a Content-Range header, which
+// has the form bytes start-end/total or bytes */total
+func rangeTotal(contentRange string) (int64, bool) {
+	if !strings.HasPrefix(contentRange, "bytes ") {
+		return 0, false
+	}
+	parts := strings.SplitN(contentRange, "/", 2)
+	if len(parts) != 2 {
+		return 0, false
+	}
+	total, err := strconv.ParseInt(parts[1], 10, 64)
+	return total, err == nil
+}
+
+// readValidator returns the validator stored in path, or an empty string if
+// there is none
+func readValidator(path string) string {
+	validator, err := ioutil.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(validator)
+}
+
+// writeValidator stores in path the strong ETag of header, or its
+// Last-Modified date, which can be sent in If-Range. The file is removed when
+// the header has neither
+func writeValidator(path string, header http.Header) error {
+	validator := header.Get("ETag")
+	if validator == "" || strings.HasPrefix(validator, "W/") {
+		validator = header.Get("Last-Modified")
+	}
+	if validator == "" {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return ioutil.WriteFile(path, []byte(validator), 0644)
+}
+
+func verifyDownload(url, partial string, expected Expected) error {
+	file, err := os.Open(partial)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if expected.Size > 0 {
+		info, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		if info.Size() != expected.Size {
+			return &ErrSize{url: url, expected: expected.Size, size: info.Size()}
+		}
+	}
+	if expected.Digest == "" {
+		return nil
+	}
+	hash := expected.Hash
+	if hash == 0 {
+		hash = crypto.SHA256
+	}
+	if !hash.Available() {
+		return fmt.Errorf(errHashFmt, hash, url)
+	}
+	h := hash.New()
+	if _, err = io.Copy(h, file); err != nil {
+		return err
+	}
+	if digest := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(digest, expected.Digest) {
+		return &ErrDigest{url: url, expected: expected.Digest, digest: digest}
+	}
+	return nil
+}
+
+type nopMeter struct{}
+
+func (nopMeter) Start(name string, total float64) {}
+func (nopMeter) Set(current float64)              {}
+func (nopMeter) Finished()                        {}
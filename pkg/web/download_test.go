@@ -0,0 +1,359 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package web
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"gopkg.in/check.v1"
+)
+
+var _ = check.Suite(&downloadSuite{})
+
+// downloadSuite checks the downloads against a server that honours the Range
+// and If-Range requests of /file, ignores them in /no-range and drops the
+// first connection of /interrupted half way. The files have the etag ETag
+type downloadSuite struct {
+	server      *httptest.Server
+	dir         string
+	target      string
+	content     []byte
+	etag        string
+	mu          sync.Mutex
+	ranges      map[string][]string
+	ifRanges    map[string][]string
+	interrupted bool
+}
+
+type fakeMeter struct {
+	names    []string
+	totals   []float64
+	current  float64
+	finished int
+}
+
+func (m *fakeMeter) Start(name string, total float64) {
+	m.names = append(m.names, name)
+	m.totals = append(m.totals, total)
+}
+
+func (m *fakeMeter) Set(current float64) {
+	m.current = current
+}
+
+func (m *fakeMeter) Finished() {
+	m.finished++
+}
+
+func (s *downloadSuite) SetUpTest(c *check.C) {
+	s.dir = c.MkDir()
+	s.target = filepath.Join(s.dir, "image.img")
+	s.content = bytes.Repeat([]byte("0123456789"), 10000)
+	s.etag = `"v1"`
+	s.ranges = make(map[string][]string)
+	s.ifRanges = make(map[string][]string)
+	s.interrupted = false
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.ranges[r.URL.Path] = append(s.ranges[r.URL.Path], r.Header.Get("Range"))
+		s.ifRanges[r.URL.Path] = append(s.ifRanges[r.URL.Path], r.Header.Get("If-Range"))
+		interrupt := r.URL.Path == "/interrupted" && !s.interrupted
+		s.interrupted = s.interrupted || interrupt
+		s.mu.Unlock()
+		switch {
+		case r.URL.Path == "/missing":
+			http.NotFound(w, r)
+		case r.URL.Path == "/no-range":
+			w.Write(s.content)
+		case interrupt:
+			w.Header().Set("ETag", s.etag)
+			w.Header().Set("Content-Length", strconv.Itoa(len(s.content)))
+			w.Write(s.content[:len(s.content)/2])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		default:
+			w.Header().Set("ETag", s.etag)
+			http.ServeContent(w, r, "image.img", time.Time{}, bytes.NewReader(s.content))
+		}
+	}))
+}
+
+func (s *downloadSuite) TearDownTest(c *check.C) {
+	s.server.Close()
+}
+
+func (s *downloadSuite) subject() *Client {
+	return NewClient(&Config{Retries: 2, BackoffBase: time.Millisecond, BackoffMax: time.Millisecond})
+}
+
+func (s *downloadSuite) download(path string, expected Expected, meter Meter) error {
+	return s.subject().Download(context.Background(), s.server.URL+path, s.target, expected, meter)
+}
+
+// writePartial writes a partial file with content, downloaded when the file
+// had the etag ETag
+func (s *downloadSuite) writePartial(c *check.C, content []byte, etag string) {
+	c.Assert(ioutil.WriteFile(s.target+partialSuffix, content, 0644), check.IsNil)
+	if etag != "" {
+		c.Assert(ioutil.WriteFile(s.target+partialSuffix+validatorSuffix, []byte(etag), 0644), check.IsNil)
+	}
+}
+
+func (s *downloadSuite) assertDownloaded(c *check.C) {
+	content, err := ioutil.ReadFile(s.target)
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, s.content)
+	_, err = os.Stat(s.target + partialSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(s.target + partialSuffix + validatorSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *downloadSuite) digest() string {
+	digest := sha256.Sum256(s.content)
+	return hex.EncodeToString(digest[:])
+}
+
+func (s *downloadSuite) TestDownloadWritesFile(c *check.C) {
+	err := s.download("/file", Expected{Size: int64(len(s.content)), Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{""})
+}
+
+func (s *downloadSuite) TestDownloadReportsProgress(c *check.C) {
+	meter := &fakeMeter{}
+
+	err := s.download("/file", Expected{}, meter)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(meter.names, check.DeepEquals, []string{"file"})
+	c.Assert(meter.totals, check.DeepEquals, []float64{float64(len(s.content))})
+	c.Assert(meter.current, check.Equals, float64(len(s.content)))
+	c.Assert(meter.finished, check.Equals, 1)
+}
+
+func (s *downloadSuite) TestDownloadResumesPartialFile(c *check.C) {
+	s.writePartial(c, s.content[:1000], s.etag)
+	meter := &fakeMeter{}
+
+	err := s.download("/file", Expected{Digest: s.digest()}, meter)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{"bytes=1000-"})
+	c.Assert(s.ifRanges["/file"], check.DeepEquals, []string{s.etag})
+	c.Assert(meter.totals, check.DeepEquals, []float64{float64(len(s.content))})
+}
+
+func (s *downloadSuite) TestDownloadRestartsPartialFileWithoutValidator(c *check.C) {
+	s.writePartial(c, []byte("stale content"), "")
+
+	err := s.download("/file", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{""})
+}
+
+func (s *downloadSuite) TestDownloadRestartsChangedFile(c *check.C) {
+	s.writePartial(c, []byte("stale content"), `"v0"`)
+
+	err := s.download("/file", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{"bytes=13-"})
+	c.Assert(s.ifRanges["/file"], check.DeepEquals, []string{`"v0"`})
+}
+
+func (s *downloadSuite) TestDownloadKeepsValidatorOfPartialFile(c *check.C) {
+	subject := NewClient(&Config{})
+
+	err := subject.Download(context.Background(), s.server.URL+"/interrupted", s.target, Expected{}, nil)
+
+	c.Assert(err, check.NotNil)
+	validator, err := ioutil.ReadFile(s.target + partialSuffix + validatorSuffix)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(validator), check.Equals, s.etag)
+}
+
+func (s *downloadSuite) TestDownloadRestartsWhenRangeIsIgnored(c *check.C) {
+	s.writePartial(c, []byte("stale content"), s.etag)
+
+	err := s.download("/no-range", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/no-range"], check.DeepEquals, []string{"bytes=13-"})
+}
+
+func (s *downloadSuite) TestDownloadRestartsPartialFileLargerThanExpected(c *check.C) {
+	s.writePartial(c, append(s.content, "trailing"...), s.etag)
+
+	err := s.download("/file", Expected{Size: int64(len(s.content))}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{""})
+}
+
+func (s *downloadSuite) TestDownloadRestartsPartialFileLargerThanTheServerOne(c *check.C) {
+	s.writePartial(c, append(s.content, "trailing"...), s.etag)
+
+	err := s.download("/file", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{"bytes=100008-", ""})
+}
+
+func (s *downloadSuite) TestDownloadCompletesFinishedPartialFile(c *check.C) {
+	s.writePartial(c, s.content, s.etag)
+
+	err := s.download("/file", Expected{Size: int64(len(s.content)), Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/file"], check.DeepEquals, []string{"bytes=100000-"})
+}
+
+func (s *downloadSuite) TestDownloadResumesInterruptedTransfer(c *check.C) {
+	err := s.download("/interrupted", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/interrupted"], check.HasLen, 2)
+	c.Assert(s.ranges["/interrupted"][0], check.Equals, "")
+	c.Assert(s.ranges["/interrupted"][1], check.Not(check.Equals), "")
+}
+
+func (s *downloadSuite) TestDownloadKeepsPartialFileWhenRetriesAreExhausted(c *check.C) {
+	subject := NewClient(&Config{})
+
+	err := subject.Download(context.Background(), s.server.URL+"/interrupted", s.target, Expected{}, nil)
+
+	c.Assert(err, check.FitsTypeOf, &ErrBodyRead{})
+	partial, err := ioutil.ReadFile(s.target + partialSuffix)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(partial) > 0, check.Equals, true)
+	c.Assert(bytes.HasPrefix(s.content, partial), check.Equals, true)
+
+	err = s.download("/interrupted", Expected{Digest: s.digest()}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+	c.Assert(s.ranges["/interrupted"][1], check.Equals, "bytes="+strconv.Itoa(len(partial))+"-")
+}
+
+func (s *downloadSuite) TestDownloadReturnsErrSize(c *check.C) {
+	err := s.download("/file", Expected{Size: 10}, nil)
+
+	c.Assert(err, check.FitsTypeOf, &ErrSize{})
+	_, err = os.Stat(s.target + partialSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	_, err = os.Stat(s.target)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *downloadSuite) TestDownloadReturnsErrDigest(c *check.C) {
+	err := s.download("/file", Expected{Digest: "0123"}, nil)
+
+	c.Assert(err, check.FitsTypeOf, &ErrDigest{})
+	c.Assert(err.Error(), check.Equals, "Digest mismatch downloading "+s.server.URL+"/file, expected 0123 and got "+s.digest())
+	_, err = os.Stat(s.target + partialSuffix)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *downloadSuite) TestDownloadChecksDigestWithHash(c *check.C) {
+	digest := sha512.Sum512(s.content)
+
+	err := s.download("/file", Expected{Digest: hex.EncodeToString(digest[:]), Hash: crypto.SHA512}, nil)
+
+	c.Assert(err, check.IsNil)
+	s.assertDownloaded(c)
+}
+
+func (s *downloadSuite) TestDownloadReturnsErrHTTPStatus(c *check.C) {
+	err := s.download("/missing", Expected{}, nil)
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPStatus{})
+	c.Assert(s.ranges["/missing"], check.HasLen, 1)
+}
+
+func (s *downloadSuite) TestDownloadHonoursContext(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := s.subject().Download(ctx, s.server.URL+"/file", s.target, Expected{}, nil)
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPGet{})
+	_, err = os.Stat(s.target)
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}
+
+func (s *downloadSuite) TestRangeTotal(c *check.C) {
+	for _, t := range []struct {
+		contentRange string
+		total        int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 200, true},
+		{"bytes */200", 200, true},
+		{"bytes 0-0/*", 0, false},
+		{"items 1-2/3", 0, false},
+		{"", 0, false},
+	} {
+		total, ok := rangeTotal(t.contentRange)
+		c.Check(total, check.Equals, t.total, check.Commentf(t.contentRange))
+		c.Check(ok, check.Equals, t.ok, check.Commentf(t.contentRange))
+	}
+}
+
+func (s *downloadSuite) TestRangeStart(c *check.C) {
+	for _, t := range []struct {
+		contentRange string
+		start        int64
+		ok           bool
+	}{
+		{"bytes 100-199/200", 100, true},
+		{"bytes 0-0/*", 0, true},
+		{"bytes */200", 0, false},
+		{"items 1-2/3", 0, false},
+		{"", 0, false},
+	} {
+		start, ok := rangeStart(t.contentRange)
+		c.Check(start, check.Equals, t.start, check.Commentf(t.contentRange))
+		c.Check(ok, check.Equals, t.ok, check.Commentf(t.contentRange))
+	}
+}
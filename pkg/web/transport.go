@@ -0,0 +1,172 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package web
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	errCAFileFmt     = "No PEM certificates found in %s"
+	errClientCertMsg = "The client certificate and its key must be given together"
+)
+
+var (
+	systemCertPool = x509.SystemCertPool
+	// systemCABundle is the file with the certificates trusted by the system
+	systemCABundle = "/etc/ssl/certs/ca-certificates.crt"
+)
+
+// TransportConfig holds the network settings of the outbound connections
+type TransportConfig struct {
+	// Proxy is the URL of the proxy, with the credentials of authenticating
+	// proxies as user:password. If empty the proxy environment variables are used
+	Proxy string
+	// CAFiles are PEM files with certificates trusted besides the system ones
+	CAFiles []string
+	// ClientCert and ClientKey are the PEM files of the certificate presented
+	// to the servers that require one
+	ClientCert, ClientKey string
+	// InsecureSkipVerify disables the verification of the server certificates,
+	// only meant for test labs
+	InsecureSkipVerify bool
+	// ConnectTimeout is the maximum time to establish a connection, 0 means no limit
+	ConnectTimeout time.Duration
+}
+
+// ErrCAFile is the error returned when a CA file has no certificates
+type ErrCAFile struct {
+	path string
+}
+
+func (e *ErrCAFile) Error() string {
+	return fmt.Sprintf(errCAFileFmt, e.path)
+}
+
+// ErrClientCert is the error returned when only one of the client certificate
+// and its key is given
+type ErrClientCert struct{}
+
+func (e *ErrClientCert) Error() string {
+	return errClientCertMsg
+}
+
+// NewTransport returns a transport with the given settings
+func NewTransport(config *TransportConfig) (*http.Transport, error) {
+	proxy := http.ProxyFromEnvironment
+	if config.Proxy != "" {
+		proxyURL, err := url.Parse(config.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(proxyURL)
+	}
+	tlsConfig, err := newTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &http.Transport{
+		Proxy: proxy,
+		DialContext: (&net.Dialer{
+			Timeout:   config.ConnectTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:     tlsConfig,
+		TLSHandshakeTimeout: config.ConnectTimeout,
+	}, nil
+}
+
+// WriteCABundle writes to path the certificates trusted by the system followed
+// by those of the CA files, for the commands that take a single bundle that
+// replaces the system one
+func (config *TransportConfig) WriteCABundle(path string) error {
+	bundle, err := ioutil.ReadFile(systemCABundle)
+	if err != nil {
+		log.Warnf("Could not read the system certificates: %v", err)
+	}
+	for _, caFile := range config.CAFiles {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return err
+		}
+		if len(bundle) > 0 && bundle[len(bundle)-1] != '\n' {
+			bundle = append(bundle, '\n')
+		}
+		bundle = append(bundle, pem...)
+	}
+	return ioutil.WriteFile(path, bundle, 0644)
+}
+
+// CommandEnv returns the environment variables that give the network settings
+// to the commands run by the tool: the proxy, when there is one, and the CA
+// bundle written by WriteCABundle, when caBundle is not empty, for the
+// python-requests library and the openstack client
+func (config *TransportConfig) CommandEnv(caBundle string) (env []string) {
+	if config.Proxy != "" {
+		env = append(env, "http_proxy="+config.Proxy, "https_proxy="+config.Proxy)
+	}
+	if caBundle != "" {
+		env = append(env, "REQUESTS_CA_BUNDLE="+caBundle, "OS_CACERT="+caBundle)
+	}
+	return
+}
+
+func newTLSConfig(config *TransportConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.InsecureSkipVerify {
+		log.Warn("Not verifying the certificates of the servers")
+	}
+	if len(config.CAFiles) > 0 {
+		pool, err := systemCertPool()
+		if err != nil {
+			log.Warnf("Could not load the system certificates: %v", err)
+			pool = x509.NewCertPool()
+		}
+		for _, path := range config.CAFiles {
+			pem, err := ioutil.ReadFile(path)
+			if err != nil {
+				return nil, err
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, &ErrCAFile{path: path}
+			}
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return nil, &ErrClientCert{}
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
@@ -20,12 +20,32 @@
 package web
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	defaultConnectTimeout = 30 * time.Second
+	defaultReadTimeout    = 60 * time.Second
+	defaultRetries        = 3
+	defaultBackoffBase    = time.Second
+	defaultBackoffMax     = 30 * time.Second
+	errHTTPStatusFmt      = "Unexpected status %d getting %s"
+	errTimeoutFmt         = "Timeout of %s exceeded getting %s"
 )
 
 var (
-	httpGet = http.Get
+	httpDo = (*http.Client).Do
+	after  = time.After
+	jitter = rand.Int63n
 )
 
 // Getter has the generic Get method for retrieving the contents of an url
@@ -33,39 +53,338 @@ type Getter interface {
 	Get(string) (content []byte, err error)
 }
 
-// Client is the default web client
-type Client struct{}
+// ContextGetter is a Getter whose requests can be abandoned through a context
+type ContextGetter interface {
+	Getter
+	GetContext(ctx context.Context, url string) (content []byte, err error)
+}
+
+// Config holds the settings of a Client
+type Config struct {
+	// ConnectTimeout is the maximum time to establish a connection, 0 means no limit
+	ConnectTimeout time.Duration
+	// ReadTimeout is the maximum time to wait for the response headers and for
+	// each read of the body, 0 means no limit
+	ReadTimeout time.Duration
+	// Retries is the number of times a request is retried after a network
+	// error or a 5xx response
+	Retries int
+	// BackoffBase is the delay before the first retry, it doubles on each
+	// retry up to BackoffMax. A random jitter of up to half the delay is
+	// subtracted from it
+	BackoffBase, BackoffMax time.Duration
+	// CacheDir is the directory of the response cache, if empty responses are
+	// not cached. Cached responses are revalidated with conditional requests
+	// using their ETag and Last-Modified headers
+	CacheDir string
+	// CacheMaxAge is the time cached responses are used without revalidating
+	// them, 0 means they are always revalidated
+	CacheMaxAge time.Duration
+	// BypassCache makes every request go to the server, the responses are
+	// still stored in the cache
+	BypassCache bool
+	// Transport makes the requests, if nil a transport with ConnectTimeout and
+	// the proxy environment variables is used
+	Transport http.RoundTripper
+	// Header has the headers sent with every request
+	Header http.Header
+}
+
+// DefaultConfig returns the settings of a zero Client
+func DefaultConfig() *Config {
+	return &Config{
+		ConnectTimeout: defaultConnectTimeout,
+		ReadTimeout:    defaultReadTimeout,
+		Retries:        defaultRetries,
+		BackoffBase:    defaultBackoffBase,
+		BackoffMax:     defaultBackoffMax,
+	}
+}
+
+// Client is the default web client, the zero value uses DefaultConfig
+type Client struct {
+	config     *Config
+	httpClient *http.Client
+	cache      *diskCache
+	once       sync.Once
+}
 
-// ErrHTTPGet is the type of the errors returned when http.Get fails
+// NewClient is the Client constructor, a nil config means DefaultConfig
+func NewClient(config *Config) *Client {
+	return &Client{config: config}
+}
+
+// ErrHTTPGet is the type of the errors returned when the request fails
 type ErrHTTPGet struct {
 	msg string
 }
 
+// ErrRequest is the type of the errors returned when the request can't be made,
+// like for an invalid url. They are not retried
+type ErrRequest struct {
+	msg string
+}
+
 // ErrBodyRead is the type of the errors returned when reading resp.Body fails
 type ErrBodyRead struct {
 	msg string
 }
 
+// ErrHTTPStatus is the type of the errors returned when the response has a
+// status code other than 2xx
+type ErrHTTPStatus struct {
+	url  string
+	code int
+}
+
 // Get retrieves the contents of the given url and return them as a string, with
 // the eventual errors in the process
 func (c *Client) Get(url string) (content []byte, err error) {
-	resp, err := httpGet(url)
-	defer resp.Body.Close()
+	return c.GetContext(context.Background(), url)
+}
+
+// GetContext is like Get, the request and its retries are abandoned when ctx
+// is done. Network errors and 5xx responses are retried with exponential backoff
+func (c *Client) GetContext(ctx context.Context, url string) (content []byte, err error) {
+	c.once.Do(c.init)
+	var entry *cacheEntry
+	header := make(http.Header)
+	if c.cache != nil && !c.config.BypassCache {
+		if cached, ok := c.cache.load(url); ok {
+			// a negative age means the clock went back, the entry is stale
+			if age := now().Sub(cached.Stored); age >= 0 && age < c.config.CacheMaxAge {
+				log.Infof("Cache hit for %s, stored %s ago", url, age)
+				return cached.content, nil
+			}
+			entry, header = cached, cached.conditional()
+		}
+	}
+	resp, err := c.getWithRetries(ctx, url, header)
+	if err != nil {
+		return
+	}
+	if resp.notModified && entry != nil {
+		log.Infof("Cache hit for %s, not modified", url)
+		// the validators of a 304 replace the stored ones
+		if etag := resp.header.Get("ETag"); etag != "" {
+			entry.ETag = etag
+		}
+		if lastModified := resp.header.Get("Last-Modified"); lastModified != "" {
+			entry.LastModified = lastModified
+		}
+		entry.Stored = now()
+		c.store(entry)
+		return entry.content, nil
+	}
+	if c.cache != nil {
+		log.Infof("Cache miss for %s", url)
+		c.store(&cacheEntry{URL: url, ETag: resp.header.Get("ETag"), LastModified: resp.header.Get("Last-Modified"),
+			Stored: now(), content: resp.content})
+	}
+	return resp.content, nil
+}
+
+func (c *Client) getWithRetries(ctx context.Context, url string, header http.Header) (resp *result, err error) {
+	for attempt := 0; ; attempt++ {
+		resp, err = c.get(ctx, url, header)
+		if err == nil || ctx.Err() != nil || attempt >= c.config.Retries || !retryable(err) {
+			return
+		}
+		if err = c.wait(ctx, attempt, url, err); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// wait sleeps the backoff delay of the given retry, it returns an error if ctx
+// is done before
+func (c *Client) wait(ctx context.Context, retry int, url string, err error) error {
+	delay := c.backoff(retry)
+	log.Debugf("Getting %s failed: %v, retrying in %s", url, err, delay)
+	select {
+	case <-ctx.Done():
+		return &ErrHTTPGet{msg: ctx.Err().Error()}
+	case <-after(delay):
+		return nil
+	}
+}
+
+// store saves the entry in the cache, responses without validators are only
+// kept when they can be used without revalidation
+func (c *Client) store(entry *cacheEntry) {
+	if entry.ETag == "" && entry.LastModified == "" && c.config.CacheMaxAge <= 0 {
+		return
+	}
+	if err := c.cache.store(entry); err != nil {
+		log.Warnf("Could not cache the response of %s: %v", entry.URL, err)
+	}
+}
+
+func (c *Client) init() {
+	if c.config == nil {
+		c.config = DefaultConfig()
+	}
+	transport := c.config.Transport
+	if transport == nil {
+		transport, _ = NewTransport(&TransportConfig{ConnectTimeout: c.config.ConnectTimeout})
+	}
+	c.httpClient = &http.Client{Transport: transport}
+	if c.config.CacheDir != "" {
+		c.cache = &diskCache{dir: c.config.CacheDir}
+	}
+}
+
+// result is the outcome of a successful request, notModified is true for
+// the 304 answers to conditional requests
+type result struct {
+	content     []byte
+	header      http.Header
+	notModified bool
+}
+
+// get makes a single request
+func (c *Client) get(ctx context.Context, url string, header http.Header) (res *result, err error) {
+	a, err := c.start(ctx, url, header)
 	if err != nil {
-		return nil, &ErrHTTPGet{msg: err.Error()}
+		return
+	}
+	defer a.Close()
+	if a.resp.StatusCode == http.StatusNotModified && len(header) > 0 {
+		return &result{header: a.resp.Header, notModified: true}, nil
+	}
+	if a.resp.StatusCode < 200 || a.resp.StatusCode > 299 {
+		return nil, &ErrHTTPStatus{url: url, code: a.resp.StatusCode}
 	}
 
-	content, err = ioutil.ReadAll(resp.Body)
+	content, err := ioutil.ReadAll(a)
 	if err != nil {
-		return nil, &ErrBodyRead{msg: err.Error()}
+		return nil, &ErrBodyRead{msg: a.msg(err)}
+	}
+	return &result{content: content, header: a.resp.Header}, nil
+}
+
+// attempt is a request in progress, the read timeout is enforced by
+// cancelling it when no progress is made for that long
+type attempt struct {
+	url      string
+	resp     *http.Response
+	cancel   context.CancelFunc
+	timer    *time.Timer
+	timeout  time.Duration
+	timedOut int32
+}
+
+// start sends the request and waits for the response headers, the attempt
+// must be closed when the response is not needed any more
+func (c *Client) start(ctx context.Context, url string, header http.Header) (*attempt, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	a := &attempt{url: url, cancel: cancel, timeout: c.config.ReadTimeout}
+	if a.timeout > 0 {
+		a.timer = time.AfterFunc(a.timeout, func() {
+			atomic.StoreInt32(&a.timedOut, 1)
+			cancel()
+		})
+	}
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		a.Close()
+		return nil, &ErrRequest{msg: err.Error()}
+	}
+	for key, values := range c.config.Header {
+		req.Header[key] = values
+	}
+	for key, values := range header {
+		req.Header[key] = values
+	}
+	if a.resp, err = httpDo(c.httpClient, req.WithContext(ctx)); err != nil {
+		a.Close()
+		return nil, &ErrHTTPGet{msg: a.msg(err)}
+	}
+	return a, nil
+}
+
+// Read reads the body of the response, pushing back the read timeout each time
+// some data is read
+func (a *attempt) Read(buf []byte) (n int, err error) {
+	n, err = a.resp.Body.Read(buf)
+	if a.timer != nil && n > 0 {
+		a.timer.Reset(a.timeout)
 	}
 	return
 }
 
+// Close releases the response and stops the timer of the attempt
+func (a *attempt) Close() error {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if a.resp != nil {
+		a.resp.Body.Close()
+	}
+	a.cancel()
+	return nil
+}
+
+// msg returns the message of an error of the attempt, which is a timeout
+// if it was cancelled by the timer
+func (a *attempt) msg(err error) string {
+	if atomic.LoadInt32(&a.timedOut) == 1 {
+		return fmt.Sprintf(errTimeoutFmt, a.timeout, a.url)
+	}
+	return err.Error()
+}
+
+// backoff returns the delay before the given retry
+func (c *Client) backoff(attempt int) time.Duration {
+	base, max := c.config.BackoffBase, c.config.BackoffMax
+	if base <= 0 {
+		return 0
+	}
+	delay := base
+	for i := 0; i < attempt && (max <= 0 || delay < max); i++ {
+		delay *= 2
+	}
+	if max > 0 && delay > max {
+		delay = max
+	}
+	return delay - time.Duration(jitter(int64(delay/2)+1))
+}
+
+// retryable returns true for the network errors and 5xx responses
+func retryable(err error) bool {
+	switch e := err.(type) {
+	case *ErrHTTPGet, *ErrBodyRead:
+		return true
+	case *ErrHTTPStatus:
+		return e.code >= 500
+	}
+	return false
+}
+
 func (e *ErrHTTPGet) Error() string {
 	return e.msg
 }
 
+func (e *ErrRequest) Error() string {
+	return e.msg
+}
+
 func (e *ErrBodyRead) Error() string {
 	return e.msg
 }
+
+func (e *ErrHTTPStatus) Error() string {
+	return fmt.Sprintf(errHTTPStatusFmt, e.code, e.url)
+}
+
+// NewErrHTTPStatus returns the error of a response to url with the given
+// status code
+func NewErrHTTPStatus(url string, code int) *ErrHTTPStatus {
+	return &ErrHTTPStatus{url: url, code: code}
+}
+
+// Code returns the status code of the response
+func (e *ErrHTTPStatus) Code() int {
+	return e.code
+}
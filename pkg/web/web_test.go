@@ -20,9 +20,13 @@ package web
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/check.v1"
 )
@@ -31,10 +35,12 @@ const (
 	testURL        = "http://example.com"
 	httpErrMsg     = "http.Get failed"
 	bodyReadErrMsg = "read of resp.Body failed"
+	testRetries    = 2
 )
 
 var (
 	_        = check.Suite(&webSuite{})
+	_        = check.Suite(&webServerSuite{})
 	response = []byte("This is the response string")
 )
 
@@ -46,9 +52,15 @@ type fakeBody struct {
 
 type webSuite struct {
 	subject      *Client
-	backHTTPGet  func(string) (resp *http.Response, err error)
+	backHTTPDo   func(*http.Client, *http.Request) (*http.Response, error)
+	backAfter    func(time.Duration) <-chan time.Time
+	backJitter   func(int64) int64
 	httpGetCalls map[string]int
 	httpGetError bool
+	statuses     []int
+	delays       []time.Duration
+	jitter       bool
+	lastHeader   http.Header
 
 	body *fakeBody
 }
@@ -68,31 +80,64 @@ func (b *fakeBody) Close() (err error) {
 func Test(t *testing.T) { check.TestingT(t) }
 
 func (s *webSuite) SetUpSuite(c *check.C) {
-	s.subject = &Client{}
 	s.body = &fakeBody{}
-	s.backHTTPGet = httpGet
-	httpGet = s.fakeHTTPGet
+	s.backHTTPDo = httpDo
+	httpDo = s.fakeHTTPDo
+	s.backAfter = after
+	after = s.fakeAfter
+	s.backJitter = jitter
+	jitter = s.fakeJitter
 }
 
 func (s *webSuite) TearDownSuite(c *check.C) {
-	httpGet = s.backHTTPGet
+	httpDo = s.backHTTPDo
+	after = s.backAfter
+	jitter = s.backJitter
 }
 
 func (s *webSuite) SetUpTest(c *check.C) {
+	s.subject = NewClient(&Config{Retries: testRetries, BackoffBase: time.Second, BackoffMax: 4 * time.Second})
 	s.httpGetCalls = make(map[string]int)
 	s.httpGetError = false
+	s.statuses = nil
+	s.delays = nil
+	s.jitter = false
 	s.body.Reset()
 	s.body.readError = false
 	s.body.closeCalls = 0
 }
 
-func (s *webSuite) fakeHTTPGet(url string) (resp *http.Response, err error) {
+// fakeHTTPDo answers with the next status of s.statuses, 200 when there are
+// no more
+func (s *webSuite) fakeHTTPDo(client *http.Client, req *http.Request) (resp *http.Response, err error) {
+	url := req.URL.String()
 	s.httpGetCalls[url]++
-	resp = &http.Response{Body: s.body}
+	s.lastHeader = req.Header
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
 	if s.httpGetError {
-		return resp, fmt.Errorf(httpErrMsg)
+		return nil, fmt.Errorf(httpErrMsg)
+	}
+	status := http.StatusOK
+	if len(s.statuses) > 0 {
+		status, s.statuses = s.statuses[0], s.statuses[1:]
 	}
-	return resp, nil
+	return &http.Response{StatusCode: status, Body: s.body}, nil
+}
+
+func (s *webSuite) fakeAfter(d time.Duration) <-chan time.Time {
+	s.delays = append(s.delays, d)
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func (s *webSuite) fakeJitter(n int64) int64 {
+	if s.jitter {
+		return n - 1
+	}
+	return 0
 }
 
 func (s *webSuite) TestGetCallsHttpGet(c *check.C) {
@@ -131,3 +176,157 @@ func (s *webSuite) TestGetCallsBodyClose(c *check.C) {
 
 	c.Assert(s.body.closeCalls, check.Equals, 1)
 }
+
+func (s *webSuite) TestGetRetriesNetworkErrors(c *check.C) {
+	s.httpGetError = true
+
+	s.subject.Get(testURL)
+
+	c.Assert(s.httpGetCalls[testURL], check.Equals, testRetries+1)
+}
+
+func (s *webSuite) TestGetRetriesServerErrors(c *check.C) {
+	s.statuses = []int{http.StatusServiceUnavailable, http.StatusBadGateway}
+	s.body.Write(response)
+
+	content, err := s.subject.Get(testURL)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+	c.Assert(s.httpGetCalls[testURL], check.Equals, 3)
+	c.Assert(s.body.closeCalls, check.Equals, 3)
+}
+
+func (s *webSuite) TestGetReturnsErrHTTPStatus(c *check.C) {
+	s.statuses = []int{http.StatusInternalServerError, http.StatusInternalServerError, http.StatusInternalServerError}
+
+	_, err := s.subject.Get(testURL)
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPStatus{})
+	c.Assert(err.(*ErrHTTPStatus).Code(), check.Equals, http.StatusInternalServerError)
+	c.Assert(err.Error(), check.Equals, "Unexpected status 500 getting "+testURL)
+}
+
+func (s *webSuite) TestGetDoesNotRetryClientErrors(c *check.C) {
+	s.statuses = []int{http.StatusNotFound}
+
+	_, err := s.subject.Get(testURL)
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPStatus{})
+	c.Assert(err.(*ErrHTTPStatus).Code(), check.Equals, http.StatusNotFound)
+	c.Assert(s.httpGetCalls[testURL], check.Equals, 1)
+}
+
+func (s *webSuite) TestGetDoesNotRetryInvalidRequests(c *check.C) {
+	_, err := s.subject.Get("http://invalid host/")
+
+	c.Assert(err, check.FitsTypeOf, &ErrRequest{})
+	c.Assert(len(s.httpGetCalls), check.Equals, 0)
+	c.Assert(len(s.delays), check.Equals, 0)
+}
+
+func (s *webSuite) TestGetBacksOffExponentially(c *check.C) {
+	subject := NewClient(&Config{Retries: 4, BackoffBase: time.Second, BackoffMax: 4 * time.Second})
+	s.httpGetError = true
+
+	subject.Get(testURL)
+
+	c.Assert(s.delays, check.DeepEquals, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second})
+}
+
+func (s *webSuite) TestGetSubtractsJitterFromBackoff(c *check.C) {
+	s.httpGetError = true
+	s.jitter = true
+
+	s.subject.Get(testURL)
+
+	c.Assert(s.delays, check.DeepEquals, []time.Duration{time.Second / 2, time.Second})
+}
+
+func (s *webSuite) TestGetContextStopsOnCancel(c *check.C) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := s.subject.GetContext(ctx, testURL)
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPGet{})
+	c.Assert(s.httpGetCalls[testURL], check.Equals, 1)
+	c.Assert(len(s.delays), check.Equals, 0)
+}
+
+func (s *webSuite) TestGetSendsConfiguredHeaders(c *check.C) {
+	subject := NewClient(&Config{Header: http.Header{"X-Ubuntu-Series": {"16"}}})
+
+	subject.Get(testURL)
+
+	c.Assert(s.lastHeader.Get("X-Ubuntu-Series"), check.Equals, "16")
+}
+
+func (s *webSuite) TestZeroClientUsesDefaultConfig(c *check.C) {
+	subject := &Client{}
+
+	subject.Get(testURL)
+
+	c.Assert(subject.config, check.DeepEquals, DefaultConfig())
+}
+
+// webServerSuite checks the timeouts against a real server
+type webServerSuite struct {
+	server  *httptest.Server
+	release chan struct{}
+}
+
+func (s *webServerSuite) SetUpTest(c *check.C) {
+	s.release = make(chan struct{})
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/slow-headers":
+			<-s.release
+		case "/slow-body":
+			w.Write([]byte("partial"))
+			w.(http.Flusher).Flush()
+			<-s.release
+		case "/missing":
+			http.NotFound(w, r)
+		default:
+			w.Write(response)
+		}
+	}))
+}
+
+func (s *webServerSuite) TearDownTest(c *check.C) {
+	close(s.release)
+	s.server.Close()
+}
+
+func (s *webServerSuite) subject() *Client {
+	return NewClient(&Config{ConnectTimeout: time.Second, ReadTimeout: 50 * time.Millisecond})
+}
+
+func (s *webServerSuite) TestGetReturnsBody(c *check.C) {
+	content, err := s.subject().Get(s.server.URL)
+
+	c.Assert(err, check.IsNil)
+	c.Assert(content, check.DeepEquals, response)
+}
+
+func (s *webServerSuite) TestGetReturnsNotFound(c *check.C) {
+	_, err := s.subject().Get(s.server.URL + "/missing")
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPStatus{})
+	c.Assert(err.(*ErrHTTPStatus).Code(), check.Equals, http.StatusNotFound)
+}
+
+func (s *webServerSuite) TestGetTimesOutWaitingForHeaders(c *check.C) {
+	_, err := s.subject().Get(s.server.URL + "/slow-headers")
+
+	c.Assert(err, check.FitsTypeOf, &ErrHTTPGet{})
+	c.Assert(strings.HasPrefix(err.Error(), "Timeout of 50ms exceeded"), check.Equals, true)
+}
+
+func (s *webServerSuite) TestGetTimesOutOnStalledBody(c *check.C) {
+	_, err := s.subject().Get(s.server.URL + "/slow-body")
+
+	c.Assert(err, check.FitsTypeOf, &ErrBodyRead{})
+	c.Assert(strings.HasPrefix(err.Error(), "Timeout of 50ms exceeded"), check.Equals, true)
+}
@@ -0,0 +1,207 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+// Package workspace manages the temporary directory where an image is built,
+// making sure that it is removed together with the loop devices left behind by
+// the build whatever the outcome
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	log "github.com/Sirupsen/logrus"
+
+	"github.com/ubuntu-core/snappy-cloud-image/pkg/cli"
+)
+
+const (
+	dirPrefix     = "snappy-cloud-image-"
+	errNoSpaceFmt = "Not enough free space in %s, %d bytes available and %d required"
+	errDfFmt      = "Unexpected output of df: %q"
+	// hostLoopScript prints the loop devices of the build host whose backing
+	// file is inside the directory given as its argument, like loopDevices
+	hostLoopScript = `for f in /sys/block/loop*/loop/backing_file; do ` +
+		`case "$(cat "$f" 2>/dev/null)" in "$1"/*) d=${f#/sys/block/}; echo /dev/${d%%/*};; esac; done`
+)
+
+var (
+	freeSpace   = diskFree
+	sysBlockDir = "/sys/block"
+)
+
+// ErrNoSpace is the error returned when the root of the workspace hasn't got
+// the required free space
+type ErrNoSpace struct {
+	root           string
+	free, required uint64
+}
+
+func (e *ErrNoSpace) Error() string {
+	return fmt.Sprintf(errNoSpaceFmt, e.root, e.free, e.required)
+}
+
+// Workspace is a temporary directory for a build
+type Workspace struct {
+	dir       string
+	keep      bool
+	commander cli.Commander
+	remote    bool
+	once      sync.Once
+	err       error
+}
+
+// New checks that root has at least minFree bytes available and creates a
+// workspace under it, the system temporary directory is used if root is empty.
+// commander runs the build commands, it detaches the loop devices left behind.
+// When remote is set it runs them on the build host, in its copy of the
+// workspace, so the free space is checked and the loop devices are listed there.
+// Unless keep is set, the workspace is removed by Cleanup
+func New(root string, minFree uint64, keep bool, commander cli.Commander, remote bool) (w *Workspace, err error) {
+	if root == "" {
+		root = os.TempDir()
+	}
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return
+	}
+	var free uint64
+	if remote {
+		free, err = hostFreeSpace(commander, root)
+	} else {
+		free, err = freeSpace(root)
+	}
+	if err != nil {
+		return
+	}
+	if free < minFree {
+		return nil, &ErrNoSpace{root: root, free: free, required: minFree}
+	}
+	dir, err := ioutil.TempDir(root, dirPrefix)
+	if err != nil {
+		return
+	}
+	log.Debug("Created workspace ", dir)
+
+	return &Workspace{dir: dir, keep: keep, commander: commander, remote: remote}, nil
+}
+
+// Dir returns the path of the workspace
+func (w *Workspace) Dir() string {
+	return w.dir
+}
+
+// Cleanup detaches the loop devices backed by files in the workspace and
+// removes it, it can be called more than once
+func (w *Workspace) Cleanup() error {
+	w.once.Do(func() {
+		if w.keep {
+			log.Info("Keeping workspace ", w.dir)
+			return
+		}
+		w.err = w.cleanup()
+	})
+	return w.err
+}
+
+func (w *Workspace) cleanup() error {
+	devices, err := w.loopDevices()
+	if err != nil {
+		log.Warnf("Could not list the loop devices of %s: %v", w.dir, err)
+	}
+	for _, device := range devices {
+		log.Debug("Detaching loop device ", device)
+		if err := w.detach(device); err != nil {
+			log.Warnf("Could not detach loop device %s: %v", device, err)
+		}
+	}
+	log.Debug("Removing workspace ", w.dir)
+	return os.RemoveAll(w.dir)
+}
+
+// loopDevices returns the loop devices backed by files in the workspace, on
+// the build host if the build is remote
+func (w *Workspace) loopDevices() ([]string, error) {
+	if !w.remote {
+		return loopDevices(w.dir)
+	}
+	output, err := cli.Stdout(context.Background(), w.commander, "sh", "-c", hostLoopScript, "sh", w.dir)
+	return strings.Fields(output), err
+}
+
+// detach detaches a loop device, ubuntu-device-flash runs through sudo so its
+// loop devices belong to root
+func (w *Workspace) detach(device string) error {
+	_, err := w.commander.ExecCommand(context.Background(), "sudo", "losetup", "-d", device)
+	return err
+}
+
+// loopDevices returns the loop devices whose backing file is inside dir
+func loopDevices(dir string) (devices []string, err error) {
+	entries, err := filepath.Glob(filepath.Join(sysBlockDir, "loop*", "loop", "backing_file"))
+	if err != nil {
+		return
+	}
+	prefix := dir + string(filepath.Separator)
+	for _, entry := range entries {
+		content, err := ioutil.ReadFile(entry)
+		if err != nil {
+			// the device was detached after listing it
+			continue
+		}
+		if strings.HasPrefix(strings.TrimSpace(string(content)), prefix) {
+			name := filepath.Base(filepath.Dir(filepath.Dir(entry)))
+			devices = append(devices, filepath.Join("/dev", name))
+		}
+	}
+	return
+}
+
+// hostFreeSpace returns the space available in the copy of path of the build
+// host
+func hostFreeSpace(host cli.Commander, path string) (uint64, error) {
+	output, err := cli.Stdout(context.Background(), host, "df", "--output=avail", "-B1", path)
+	if err != nil {
+		return 0, err
+	}
+	// the header and the available bytes
+	fields := strings.Fields(output)
+	if len(fields) != 2 {
+		return 0, fmt.Errorf(errDfFmt, output)
+	}
+	free, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf(errDfFmt, output)
+	}
+	return free, nil
+}
+
+func diskFree(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
@@ -0,0 +1,180 @@
+// -*- Mode: Go; indent-tabs-mode: t -*-
+
+/*
+ * Copyright (C) 2016 Canonical Ltd
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU General Public License version 3 as
+ * published by the Free Software Foundation.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU General Public License for more details.
+ *
+ * You should have received a copy of the GNU General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ */
+
+package workspace
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/check.v1"
+)
+
+const testFreeSpace = 1000
+
+// fakeHost is a commander answering df with its free space and the loop
+// device script with its devices
+type fakeHost struct {
+	free    string
+	devices string
+	calls   []string
+}
+
+func (f *fakeHost) ExecCommand(ctx context.Context, cmds ...string) (string, error) {
+	f.calls = append(f.calls, strings.Join(cmds, " "))
+	switch cmds[0] {
+	case "df":
+		return "Avail\n" + f.free + "\n", nil
+	case "sh":
+		return f.devices, nil
+	}
+	return "", nil
+}
+
+var _ = check.Suite(&workspaceSuite{})
+
+func Test(t *testing.T) { check.TestingT(t) }
+
+type workspaceSuite struct {
+	root, sysDir string
+	local        *fakeHost
+	backupSysDir string
+	backupFree   func(string) (uint64, error)
+}
+
+func (s *workspaceSuite) SetUpSuite(c *check.C) {
+	s.backupSysDir = sysBlockDir
+	s.backupFree = freeSpace
+
+	freeSpace = func(string) (uint64, error) { return testFreeSpace, nil }
+}
+
+func (s *workspaceSuite) TearDownSuite(c *check.C) {
+	sysBlockDir = s.backupSysDir
+	freeSpace = s.backupFree
+}
+
+func (s *workspaceSuite) SetUpTest(c *check.C) {
+	s.root = filepath.Join(c.MkDir(), "root")
+	s.sysDir = c.MkDir()
+	sysBlockDir = s.sysDir
+	s.local = &fakeHost{}
+}
+
+func (s *workspaceSuite) addLoopDevice(c *check.C, name, backingFile string) {
+	dir := filepath.Join(s.sysDir, name, "loop")
+	c.Assert(os.MkdirAll(dir, 0755), check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(dir, "backing_file"), []byte(backingFile+"\n"), 0644), check.IsNil)
+}
+
+func (s *workspaceSuite) TestNewCreatesDirUnderRoot(c *check.C) {
+	w, err := New(s.root, testFreeSpace, false, s.local, false)
+	c.Assert(err, check.IsNil)
+	defer w.Cleanup()
+
+	c.Assert(filepath.Dir(w.Dir()), check.Equals, s.root)
+	c.Assert(strings.HasPrefix(filepath.Base(w.Dir()), dirPrefix), check.Equals, true)
+	info, err := os.Stat(w.Dir())
+	c.Assert(err, check.IsNil)
+	c.Assert(info.IsDir(), check.Equals, true)
+}
+
+func (s *workspaceSuite) TestNewReturnsErrNoSpace(c *check.C) {
+	_, err := New(s.root, testFreeSpace+1, false, s.local, false)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoSpace{})
+	c.Assert(err.Error(), check.Equals,
+		"Not enough free space in "+s.root+", 1000 bytes available and 1001 required")
+	entries, err := ioutil.ReadDir(s.root)
+	c.Assert(err, check.IsNil)
+	c.Assert(len(entries), check.Equals, 0)
+}
+
+func (s *workspaceSuite) TestCleanupRemovesDir(c *check.C) {
+	w, err := New(s.root, 0, false, s.local, false)
+	c.Assert(err, check.IsNil)
+	c.Assert(ioutil.WriteFile(filepath.Join(w.Dir(), "udf.img"), []byte("image"), 0644), check.IsNil)
+
+	c.Assert(w.Cleanup(), check.IsNil)
+
+	_, err = os.Stat(w.Dir())
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+	c.Assert(w.Cleanup(), check.IsNil)
+}
+
+func (s *workspaceSuite) TestCleanupKeepsDir(c *check.C) {
+	w, err := New(s.root, 0, true, s.local, false)
+	c.Assert(err, check.IsNil)
+	s.addLoopDevice(c, "loop0", filepath.Join(w.Dir(), "udf.raw"))
+
+	c.Assert(w.Cleanup(), check.IsNil)
+
+	_, err = os.Stat(w.Dir())
+	c.Assert(err, check.IsNil)
+	c.Assert(len(s.local.calls), check.Equals, 0)
+}
+
+func (s *workspaceSuite) TestCleanupDetachesLoopDevicesOfWorkspace(c *check.C) {
+	w, err := New(s.root, 0, false, s.local, false)
+	c.Assert(err, check.IsNil)
+	s.addLoopDevice(c, "loop0", filepath.Join(w.Dir(), "udf.raw"))
+	s.addLoopDevice(c, "loop1", "/var/lib/other.img")
+	s.addLoopDevice(c, "loop2", w.Dir()+"-other/udf.raw")
+
+	c.Assert(w.Cleanup(), check.IsNil)
+
+	c.Assert(s.local.calls, check.DeepEquals, []string{"sudo losetup -d /dev/loop0"})
+}
+
+func (s *workspaceSuite) TestNewChecksFreeSpaceOfHost(c *check.C) {
+	host := &fakeHost{free: "999"}
+
+	_, err := New(s.root, testFreeSpace, false, host, true)
+
+	c.Assert(err, check.FitsTypeOf, &ErrNoSpace{})
+	c.Assert(host.calls, check.DeepEquals, []string{"df --output=avail -B1 " + s.root})
+}
+
+func (s *workspaceSuite) TestNewReturnsErrorOfHostFreeSpace(c *check.C) {
+	_, err := New(s.root, testFreeSpace, false, &fakeHost{free: "lots"}, true)
+
+	c.Assert(err, check.ErrorMatches, `Unexpected output of df: "Avail\\nlots\\n"`)
+}
+
+func (s *workspaceSuite) TestCleanupDetachesLoopDevicesOfHost(c *check.C) {
+	host := &fakeHost{free: "1000", devices: "/dev/loop3\n/dev/loop4\n"}
+	w, err := New(s.root, testFreeSpace, false, host, true)
+	c.Assert(err, check.IsNil)
+	s.addLoopDevice(c, "loop0", filepath.Join(w.Dir(), "udf.raw"))
+
+	c.Assert(w.Cleanup(), check.IsNil)
+
+	c.Assert(host.calls[1:], check.DeepEquals, []string{
+		"sh -c " + hostLoopScript + " sh " + w.Dir(),
+		"sudo losetup -d /dev/loop3",
+		"sudo losetup -d /dev/loop4",
+	})
+	c.Assert(len(s.local.calls), check.Equals, 0)
+	_, err = os.Stat(w.Dir())
+	c.Assert(os.IsNotExist(err), check.Equals, true)
+}